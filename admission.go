@@ -0,0 +1,126 @@
+package rcutil
+
+import (
+	"fmt"
+	"hash/maphash"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// AdmissionFilter decides whether the response is stored in the cache.
+// It is called before the response is written to the cache files.
+type AdmissionFilter func(key string, req *http.Request, res *http.Response) bool
+
+// admit returns ErrNotAdmitted if the response is not admitted to the cache.
+// The size of a body of unknown length is checked by admitBody while it is written.
+func (c *DiskCache) admit(key string, req *http.Request, res *http.Response) error {
+	if res.ContentLength >= 0 {
+		if err := c.admitSize(res.ContentLength); err != nil {
+			return err
+		}
+	}
+	if c.admissionFilter != nil && !c.admissionFilter(key, req, res) {
+		return fmt.Errorf("%w (rejected by the admission filter)", ErrNotAdmitted)
+	}
+	// Entries already in the cache have been admitted
+	if c.doorkeeper != nil && !c.m.Has(key) {
+		if n := c.doorkeeper.add(key); n < c.doorkeeperRequests {
+			return fmt.Errorf("%w (stored %d of %d times)", ErrNotAdmitted, n, c.doorkeeperRequests)
+		}
+	}
+	return nil
+}
+
+// admitSize returns ErrNotAdmitted if the size of the body is out of MinObjectBytes and MaxObjectBytes.
+func (c *DiskCache) admitSize(n int64) error {
+	if c.maxObjectBytes != NoLimitObjectBytes && uint64(n) > c.maxObjectBytes {
+		return fmt.Errorf("%w (%d bytes > %d bytes)", ErrNotAdmitted, n, c.maxObjectBytes)
+	}
+	if uint64(n) < c.minObjectBytes {
+		return fmt.Errorf("%w (%d bytes < %d bytes)", ErrNotAdmitted, n, c.minObjectBytes)
+	}
+	return nil
+}
+
+// admitBody returns a copy of the response whose body of unknown length fails the read with ErrNotAdmitted
+// as soon as it exceeds MaxObjectBytes, so that a huge body is not written to the disk.
+// The returned function checks the size of the body after it has been read.
+func (c *DiskCache) admitBody(res *http.Response) (*http.Response, func() error) {
+	if res.ContentLength >= 0 || (c.maxObjectBytes == NoLimitObjectBytes && c.minObjectBytes == 0) {
+		return res, func() error { return nil }
+	}
+	b := &admissionBody{ReadCloser: res.Body, c: c}
+	r := *res
+	r.Body = b
+	return &r, func() error {
+		return c.admitSize(b.n)
+	}
+}
+
+// admissionBody counts the bytes read from the body.
+type admissionBody struct {
+	io.ReadCloser
+	c *DiskCache
+	n int64
+}
+
+func (b *admissionBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if b.c.maxObjectBytes != NoLimitObjectBytes && uint64(b.n) > b.c.maxObjectBytes {
+		return n, fmt.Errorf("%w (more than %d bytes)", ErrNotAdmitted, b.c.maxObjectBytes)
+	}
+	return n, err
+}
+
+const doorkeeperHashes = 4
+
+// countingBloomFilter counts how many times keys are added with saturating counters.
+// The counters are halved periodically so that keys added long ago are forgotten.
+type countingBloomFilter struct {
+	counters []uint8
+	mask     uint64
+	seed     maphash.Seed
+	adds     int
+	resetAt  int
+	mu       sync.Mutex
+}
+
+func newCountingBloomFilter(expectedKeys int) *countingBloomFilter {
+	// 10 counters per key keep the false positive rate of 4 hashes around 1%
+	size := 64
+	for size < 10*expectedKeys {
+		size <<= 1
+	}
+	return &countingBloomFilter{
+		counters: make([]uint8, size),
+		mask:     uint64(size - 1),
+		seed:     maphash.MakeSeed(),
+		resetAt:  10 * expectedKeys,
+	}
+}
+
+// add adds the key and returns the estimated number of times it has been added.
+func (f *countingBloomFilter) add(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h := maphash.String(f.seed, key)
+	h1, h2 := h, h>>32|1
+	est := uint8(255)
+	for i := uint64(0); i < doorkeeperHashes; i++ {
+		j := (h1 + i*h2) & f.mask
+		if f.counters[j] < 255 {
+			f.counters[j]++
+		}
+		est = min(est, f.counters[j])
+	}
+	f.adds++
+	if f.adds >= f.resetAt {
+		for j := range f.counters {
+			f.counters[j] >>= 1
+		}
+		f.adds /= 2
+	}
+	return int(est)
+}
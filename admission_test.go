@@ -0,0 +1,184 @@
+package rcutil
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2manymws/rc"
+)
+
+func TestDiskCacheAdmission(t *testing.T) {
+	tests := []struct {
+		name          string
+		opts          []DiskCacheOption
+		body          string
+		contentLength int64
+		wantErr       bool
+	}{
+		{"no limit", nil, "hello", 5, false},
+		{"max", []DiskCacheOption{MaxObjectBytes(5)}, "hello", 5, false},
+		{"larger than max", []DiskCacheOption{MaxObjectBytes(4)}, "hello", 5, true},
+		{"unknown length larger than max", []DiskCacheOption{MaxObjectBytes(4)}, strings.Repeat("hello", 10000), -1, true},
+		{"unknown length within max", []DiskCacheOption{MaxObjectBytes(5)}, "hello", -1, false},
+		{"min", []DiskCacheOption{MinObjectBytes(5)}, "hello", 5, false},
+		{"smaller than min", []DiskCacheOption{MinObjectBytes(6)}, "hello", 5, true},
+		{"unknown length smaller than min", []DiskCacheOption{MinObjectBytes(6)}, "hello", -1, true},
+		{"admitted by filter", []DiskCacheOption{UseAdmissionFilter(func(key string, req *http.Request, res *http.Response) bool {
+			return res.Header.Get("X-Test") == "test"
+		})}, "hello", 5, false},
+		{"rejected by filter", []DiskCacheOption{UseAdmissionFilter(func(key string, req *http.Request, res *http.Response) bool {
+			return req.URL.Path != "/foo"
+		})}, "hello", 5, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dc, err := NewDiskCache(root, 1*time.Hour, append(tt.opts, DisableWarmUp())...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := "test"
+			req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+			res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"X-Test": {"test"}}, Body: newBody([]byte(tt.body)), ContentLength: tt.contentLength}
+			err = dc.Store(key, req, res)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, got, err := dc.Load(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := readBody(got.Body); got != tt.body {
+					t.Errorf("got %q, want %q", got, tt.body)
+				}
+				return
+			}
+			if !errors.Is(err, ErrNotAdmitted) {
+				t.Errorf("got %v, want %v", err, ErrNotAdmitted)
+			}
+			if _, _, err := dc.Load(key); !errors.Is(err, rc.ErrCacheNotFound) {
+				t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+			}
+			if tmps, _ := filepath.Glob(filepath.Join(root, tmpFilePattern)); len(tmps) != 0 {
+				t.Errorf("temporary files are left: %v", tmps)
+			}
+		})
+	}
+
+	if _, err := NewDiskCache(t.TempDir(), 1*time.Hour, UseAdmissionFilter(nil)); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestDiskCacheDoorkeeper(t *testing.T) {
+	dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, EnableDoorkeeper(2, 100), DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := func(key string) error {
+		req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/" + key}, Body: newBody(nil)}
+		res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("hello")), ContentLength: 5}
+		return dc.Store(key, req, res)
+	}
+	if err := store("a"); !errors.Is(err, ErrNotAdmitted) {
+		t.Errorf("got %v, want %v", err, ErrNotAdmitted)
+	}
+	if err := store("a"); err != nil {
+		t.Errorf("the second store should be admitted: %v", err)
+	}
+	if err := store("a"); err != nil {
+		t.Errorf("the entry in the cache should be replaced: %v", err)
+	}
+	if err := store("b"); !errors.Is(err, ErrNotAdmitted) {
+		t.Errorf("got %v, want %v", err, ErrNotAdmitted)
+	}
+
+	for _, n := range []int{0, 256} {
+		if _, err := NewDiskCache(t.TempDir(), 1*time.Hour, EnableDoorkeeper(n, 100)); err == nil {
+			t.Errorf("%d: want error", n)
+		}
+	}
+}
+
+func TestDiskCacheStoreStreamAdmission(t *testing.T) {
+	body := strings.Repeat("hello", 10000)
+	tests := []struct {
+		name          string
+		opts          []DiskCacheOption
+		contentLength int64
+		wantErr       bool
+		wantStored    bool
+	}{
+		{"admitted", []DiskCacheOption{MaxObjectBytes(uint64(len(body)))}, -1, false, true},
+		{"rejected before streaming", []DiskCacheOption{MaxObjectBytes(10)}, int64(len(body)), true, false},
+		{"discarded while streaming", []DiskCacheOption{MaxObjectBytes(10)}, -1, false, false},
+		{"discarded after streaming", []DiskCacheOption{MinObjectBytes(uint64(len(body) + 1))}, -1, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dc, err := NewDiskCache(root, 1*time.Hour, append(tt.opts, DisableWarmUp())...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := "test"
+			req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+			res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte(body)), ContentLength: tt.contentLength}
+			got, err := dc.StoreStream(key, req, res)
+			if tt.wantErr {
+				if !errors.Is(err, ErrNotAdmitted) {
+					t.Errorf("got %v, want %v", err, ErrNotAdmitted)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The client receives the whole body regardless of the admission
+			b, err := io.ReadAll(got.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != body {
+				t.Errorf("got %d bytes, want %d bytes", len(b), len(body))
+			}
+			if err := got.Body.Close(); err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = dc.Load(key)
+			if stored := err == nil; stored != tt.wantStored {
+				t.Errorf("got stored %v, want %v: %v", stored, tt.wantStored, err)
+			}
+			entries, err := os.ReadDir(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if strings.HasPrefix(e.Name(), tmpFilePrefix) {
+					t.Errorf("temporary file is left: %s", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestCountingBloomFilter(t *testing.T) {
+	// The counters are halved on every 10 adds
+	f := newCountingBloomFilter(1)
+	for i := 1; i <= 10; i++ {
+		if got := f.add("a"); got != i {
+			t.Errorf("got %d, want %d", got, i)
+		}
+	}
+	if got := f.add("a"); got != 6 {
+		t.Errorf("got %d, want %d", got, 6)
+	}
+}
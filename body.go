@@ -0,0 +1,98 @@
+package rcutil
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+)
+
+// FileBody is a response body backed by a section of a cache file.
+// It implements io.ReadSeeker and io.ReaderAt, so it can be served with http.ServeContent or ServeRange.
+type FileBody struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func newFileBody(f *os.File, offset, length int64) *FileBody {
+	return &FileBody{
+		SectionReader: io.NewSectionReader(f, offset, length),
+		f:             f,
+	}
+}
+
+// Close closes the cache file.
+func (b *FileBody) Close() error {
+	return b.f.Close()
+}
+
+// WriteTo writes the rest of the body to w.
+// The body is passed to w as an io.LimitedReader of the *os.File, so that it can be sent with sendfile(2)
+// when w is a *net.TCPConn or an http.ResponseWriter.
+func (b *FileBody) WriteTo(w io.Writer) (int64, error) {
+	pos, err := b.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	_, offset, length := b.Outer()
+	if _, err := b.f.Seek(offset+pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, &io.LimitedReader{R: b.f, N: length - pos})
+	if _, serr := b.Seek(n, io.SeekCurrent); serr != nil {
+		err = errors.Join(err, serr)
+	}
+	return n, err
+}
+
+// bodyIndex returns the offset and the length of the body in the response file.
+// It returns false if the body is not stored as it is (e.g. chunked) or its length is unknown.
+func bodyIndex(p string) (offset, length int64, ok bool) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, 0, false
+	}
+	rc := &readCounter{Reader: f}
+	br := bufio.NewReader(rc)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return 0, 0, false
+	}
+	if len(res.TransferEncoding) > 0 || res.ContentLength < 0 {
+		return 0, 0, false
+	}
+	// The header block ends where the bufio.Reader has consumed up to
+	offset = rc.bytes - int64(br.Buffered())
+	if offset+res.ContentLength != fi.Size() {
+		return 0, 0, false
+	}
+	return offset, res.ContentLength, true
+}
+
+// decodeResWithIndex decodes the header block of the response file and returns the response
+// whose body is the section of the file at offset.
+func decodeResWithIndex(f *os.File, offset, length int64) (*http.Response, error) {
+	res, err := DecodeRes(io.NewSectionReader(f, 0, offset))
+	if err != nil {
+		return nil, err
+	}
+	res.Body = newFileBody(f, offset, length)
+	return res, nil
+}
+
+type readCounter struct {
+	io.Reader
+	bytes int64
+}
+
+func (rc *readCounter) Read(p []byte) (int, error) {
+	n, err := rc.Reader.Read(p)
+	rc.bytes += int64(n)
+	return n, err
+}
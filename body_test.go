@@ -0,0 +1,176 @@
+package rcutil
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/2manymws/rc"
+)
+
+func TestBodyIndex(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        string
+		wantOffset int64
+		wantLength int64
+		wantOK     bool
+	}{
+		{"Content-Length", "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", 38, 5, true},
+		{"empty body", "HTTP/1.1 204 No Content\r\n\r\n", 27, 0, true},
+		{"chunked", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", 0, 0, false},
+		{"no Content-Length", "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nhello", 0, 0, false},
+		{"truncated", "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello", 0, 0, false},
+		{"broken", "broken", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "res")
+			if err := os.WriteFile(p, []byte(tt.raw), 0600); err != nil {
+				t.Fatal(err)
+			}
+			offset, length, ok := bodyIndex(p)
+			if ok != tt.wantOK {
+				t.Errorf("got %v, want %v", ok, tt.wantOK)
+			}
+			if offset != tt.wantOffset || length != tt.wantLength {
+				t.Errorf("got (%d, %d), want (%d, %d)", offset, length, tt.wantOffset, tt.wantLength)
+			}
+		})
+	}
+}
+
+func TestDiskCacheLoadFileBody(t *testing.T) {
+	root := t.TempDir()
+	dc, err := NewDiskCache(root, 1*time.Hour, DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+	newRes := func(contentLength int64) *http.Response {
+		return &http.Response{
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"X-Test": {"test"}},
+			Body:          newBody([]byte("0123456789")),
+			ContentLength: contentLength,
+		}
+	}
+	if err := dc.Store("indexed", req, newRes(10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.Store("chunked", req, newRes(-1)); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("indexed", func(t *testing.T) {
+		info, err := dc.Info("indexed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ContentLength != 10 {
+			t.Errorf("got %d, want %d", info.ContentLength, 10)
+		}
+		_, res, err := dc.Load("indexed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, ok := res.Body.(*FileBody)
+		if !ok {
+			t.Fatalf("got %T, want *FileBody", res.Body)
+		}
+		if got := res.Header.Get("X-Test"); got != "test" {
+			t.Errorf("got %q, want %q", got, "test")
+		}
+		p := make([]byte, 3)
+		if _, err := b.ReadAt(p, 7); err != nil {
+			t.Fatal(err)
+		}
+		if string(p) != "789" {
+			t.Errorf("got %q, want %q", string(p), "789")
+		}
+		if _, err := b.Seek(2, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(b, p); err != nil {
+			t.Fatal(err)
+		}
+		if string(p) != "234" {
+			t.Errorf("got %q, want %q", string(p), "234")
+		}
+		buf := &bytes.Buffer{}
+		n, err := b.WriteTo(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 5 || buf.String() != "56789" {
+			t.Errorf("got (%d, %q), want (%d, %q)", n, buf.String(), 5, "56789")
+		}
+		if _, err := b.Read(p); !errors.Is(err, io.EOF) {
+			t.Errorf("got %v, want %v", err, io.EOF)
+		}
+	})
+
+	t.Run("chunked", func(t *testing.T) {
+		info, err := dc.Info("chunked")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ContentLength != -1 {
+			t.Errorf("got %d, want %d", info.ContentLength, -1)
+		}
+		_, res, err := dc.Load("chunked")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := res.Body.(*FileBody); ok {
+			t.Error("want streamed body")
+		}
+		if got := readBody(res.Body); got != "0123456789" {
+			t.Errorf("got %q, want %q", got, "0123456789")
+		}
+	})
+
+	t.Run("warm up", func(t *testing.T) {
+		dc2, err := NewDiskCache(root, 1*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-dc2.warmUpDone
+		info, err := dc2.Info("indexed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ContentLength != 10 {
+			t.Errorf("got %d, want %d", info.ContentLength, 10)
+		}
+		rreq := &http.Request{Method: http.MethodGet, Header: http.Header{"Range": {"bytes=-3"}}}
+		_, res, err := dc2.Load("indexed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ServeRange(rreq, res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.StatusCode != http.StatusPartialContent {
+			t.Errorf("got %d, want %d", got.StatusCode, http.StatusPartialContent)
+		}
+		if got := readBody(got.Body); got != "789" {
+			t.Errorf("got %q, want %q", got, "789")
+		}
+	})
+
+	if _, err := dc.Info("notfound"); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+}
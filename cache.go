@@ -0,0 +1,31 @@
+package rcutil
+
+import (
+	"net/http"
+	"time"
+)
+
+var (
+	_ Cache = &DiskCache{}
+	_ Cache = &MemoryCache{}
+	_ Cache = &TieredCache{}
+)
+
+// Cache is the storage of responses keyed by cache keys, implemented by DiskCache, MemoryCache and TieredCache.
+// Load returns rc.ErrCacheNotFound if the entry is not stored, and may return rc.ErrCacheExpired if it is expired.
+// Store returns ErrCacheFull if the entry can not be stored within the limits of the cache.
+// The package cachetest provides the conformance tests of the implementations.
+type Cache interface {
+	// Store stores the response in the cache with the default TTL.
+	Store(key string, req *http.Request, res *http.Response) error
+	// StoreWithTTL stores the response in the cache with the specified TTL. NoLimitTTL means the entry never expires.
+	StoreWithTTL(key string, req *http.Request, res *http.Response, ttl time.Duration) error
+	// Load loads the response from the cache.
+	Load(key string) (*http.Request, *http.Response, error)
+	// Delete deletes the cache.
+	Delete(key string)
+	// Metrics returns the metrics of the cache.
+	Metrics() Metrics
+	// Close stops the goroutines of the cache. A cache composed of other caches closes them too.
+	Close() error
+}
@@ -0,0 +1,170 @@
+package rcutil
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/2manymws/rc"
+)
+
+var _ rc.Cacher = &Cacher{}
+
+// KeyFunc returns the cache key of the request.
+// The variants of the key are selected by the Vary header of the response, so it should not include the request header fields.
+type KeyFunc func(req *http.Request) (string, error)
+
+// TTLFunc returns the TTL of the response received at now. The response is not stored if it returns false.
+type TTLFunc func(req *http.Request, res *http.Response, now time.Time) (time.Duration, bool)
+
+// DefaultKeyFunc is a KeyFunc that returns the seed of the method, host, path and query of the request.
+func DefaultKeyFunc(req *http.Request) (string, error) {
+	return Seed(req, nil)
+}
+
+// RFC9111TTL is a TTLFunc that returns the remaining freshness lifetime of the response evaluated by EvaluateCachePolicy.
+// The response is not stored if it is not storable in a shared cache.
+func RFC9111TTL(req *http.Request, res *http.Response, now time.Time) (time.Duration, bool) {
+	p := EvaluateCachePolicy(req, res, now)
+	return p.TTL, p.Storable
+}
+
+// Cacher is an implementation of rc.Cacher that stores responses in DiskCache.
+// Responses are stored as the variants of the key selected by their Vary header, for the TTL of TTLFunc,
+// only if the methods of the requests and the status codes of the responses are allowed.
+type Cacher struct {
+	dc                       *DiskCache
+	keyFunc                  KeyFunc
+	ttlFunc                  TTLFunc
+	methods                  map[string]struct{}
+	statusCodes              map[int]struct{}
+	disableCacheResultHeader bool
+}
+
+// CacherOption is an option for Cacher.
+type CacherOption func(*Cacher) error
+
+// UseKeyFunc sets the KeyFunc of the cache keys. The default is DefaultKeyFunc.
+func UseKeyFunc(fn KeyFunc) CacherOption {
+	return func(c *Cacher) error {
+		if fn == nil {
+			return errors.New("key func must not be nil")
+		}
+		c.keyFunc = fn
+		return nil
+	}
+}
+
+// UseTTLFunc sets the TTLFunc of the responses. The default is RFC9111TTL.
+func UseTTLFunc(fn TTLFunc) CacherOption {
+	return func(c *Cacher) error {
+		if fn == nil {
+			return errors.New("ttl func must not be nil")
+		}
+		c.ttlFunc = fn
+		return nil
+	}
+}
+
+// AllowMethods sets the methods of the requests whose responses are stored and loaded. The default is GET and HEAD.
+func AllowMethods(methods ...string) CacherOption {
+	return func(c *Cacher) error {
+		if len(methods) == 0 {
+			return errors.New("at least one method must be allowed")
+		}
+		c.methods = make(map[string]struct{}, len(methods))
+		for _, m := range methods {
+			c.methods[m] = struct{}{}
+		}
+		return nil
+	}
+}
+
+// AllowStatusCodes sets the status codes of the responses that are stored.
+// The default is the status codes that are heuristically cacheable.
+// See https://httpwg.org/specs/rfc9110.html#rfc.section.15.1
+func AllowStatusCodes(codes ...int) CacherOption {
+	return func(c *Cacher) error {
+		if len(codes) == 0 {
+			return errors.New("at least one status code must be allowed")
+		}
+		c.statusCodes = make(map[int]struct{}, len(codes))
+		for _, code := range codes {
+			c.statusCodes[code] = struct{}{}
+		}
+		return nil
+	}
+}
+
+// DisableCacheResultHeader disables setting the X-Cache header of the responses.
+func DisableCacheResultHeader() CacherOption {
+	return func(c *Cacher) error {
+		c.disableCacheResultHeader = true
+		return nil
+	}
+}
+
+// NewCacher returns a new Cacher that stores responses in dc.
+func NewCacher(dc *DiskCache, opts ...CacherOption) (*Cacher, error) {
+	c := &Cacher{
+		dc:          dc,
+		keyFunc:     DefaultKeyFunc,
+		ttlFunc:     RFC9111TTL,
+		methods:     map[string]struct{}{http.MethodGet: {}, http.MethodHead: {}},
+		statusCodes: make(map[int]struct{}, len(heuristicallyCacheableStatusCodes)),
+	}
+	for code := range heuristicallyCacheableStatusCodes {
+		c.statusCodes[code] = struct{}{}
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Load loads the response to the request from the cache.
+// It returns rc.ErrCacheNotFound if the method of the request is not allowed.
+// The X-Cache header of the response is set to HIT unless DisableCacheResultHeader is specified.
+func (c *Cacher) Load(req *http.Request) (*http.Request, *http.Response, error) {
+	if _, ok := c.methods[req.Method]; !ok {
+		return nil, nil, rc.ErrCacheNotFound
+	}
+	key, err := c.keyFunc(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	cachedReq, cachedRes, err := c.dc.LoadVary(key, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !c.disableCacheResultHeader {
+		SetCacheResultHeader(cachedRes, true)
+	}
+	return cachedReq, cachedRes, nil
+}
+
+// Store stores the response to the request received at now in the cache.
+// It does nothing if the method, the status code or the TTL does not allow the response to be stored.
+// The X-Cache header of the response is set to MISS unless DisableCacheResultHeader is specified.
+func (c *Cacher) Store(req *http.Request, res *http.Response, now time.Time) error {
+	if !c.disableCacheResultHeader {
+		SetCacheResultHeader(res, false)
+	}
+	if _, ok := c.methods[req.Method]; !ok {
+		return nil
+	}
+	if _, ok := c.statusCodes[res.StatusCode]; !ok {
+		return nil
+	}
+	ttl, ok := c.ttlFunc(req, res, now)
+	if !ok {
+		return nil
+	}
+	key, err := c.keyFunc(req)
+	if err != nil {
+		return err
+	}
+	return c.dc.StoreVaryWithTTL(key, req, res, ttl)
+}
@@ -0,0 +1,124 @@
+package rcutil
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/2manymws/rc"
+)
+
+func TestCacher(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		opts      []CacherOption
+		method    string
+		query     string
+		status    int
+		header    http.Header
+		loadQuery string
+		wantHit   bool
+	}{
+		{"max-age", nil, http.MethodGet, "", http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, "", true},
+		{"Expires", nil, http.MethodGet, "", http.StatusOK, http.Header{"Date": {now.UTC().Format(http.TimeFormat)}, "Expires": {now.Add(1 * time.Hour).UTC().Format(http.TimeFormat)}}, "", true},
+		{"no-store", nil, http.MethodGet, "", http.StatusOK, http.Header{"Cache-Control": {"no-store"}}, "", false},
+		{"no explicit expiration time", nil, http.MethodGet, "", http.StatusOK, http.Header{}, "", false},
+		{"method not allowed", nil, http.MethodPost, "", http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, "", false},
+		{"allowed method not cacheable by RFC 9111", []CacherOption{AllowMethods(http.MethodPost)}, http.MethodPost, "", http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, "", false},
+		{"status code not allowed", nil, http.MethodGet, "", http.StatusInternalServerError, http.Header{"Cache-Control": {"max-age=60"}}, "", false},
+		{"allowed status code", []CacherOption{AllowStatusCodes(http.StatusInternalServerError)}, http.MethodGet, "", http.StatusInternalServerError, http.Header{"Cache-Control": {"max-age=60"}}, "", true},
+		{"another query", nil, http.MethodGet, "a=1", http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, "a=2", false},
+		{"key func", []CacherOption{UseKeyFunc(func(req *http.Request) (string, error) {
+			return req.Host + req.URL.Path, nil
+		})}, http.MethodGet, "a=1", http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, "a=2", true},
+		{"ttl func", []CacherOption{UseTTLFunc(func(req *http.Request, res *http.Response, now time.Time) (time.Duration, bool) {
+			return 1 * time.Hour, true
+		})}, http.MethodGet, "", http.StatusOK, http.Header{"Cache-Control": {"no-store"}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, DisableWarmUp())
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := NewCacher(dc, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &http.Request{Method: tt.method, Host: "example.com", Header: http.Header{}, URL: &url.URL{Path: "/foo", RawQuery: tt.query}, Body: newBody(nil)}
+			res := &http.Response{StatusCode: tt.status, Header: tt.header, Body: newBody([]byte("hello"))}
+			if err := c.Store(req, res, now); err != nil {
+				t.Fatal(err)
+			}
+			if got := res.Header.Get(CacheResultHeader); got != CacheMiss {
+				t.Errorf("got %q, want %q", got, CacheMiss)
+			}
+
+			req = &http.Request{Method: tt.method, Host: "example.com", Header: http.Header{}, URL: &url.URL{Path: "/foo", RawQuery: tt.loadQuery}}
+			if tt.loadQuery == "" {
+				req.URL.RawQuery = tt.query
+			}
+			_, got, err := c.Load(req)
+			if !tt.wantHit {
+				if !errors.Is(err, rc.ErrCacheNotFound) {
+					t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v := got.Header.Get(CacheResultHeader); v != CacheHit {
+				t.Errorf("got %q, want %q", v, CacheHit)
+			}
+			if body := readBody(got.Body); body != "hello" {
+				t.Errorf("got %q, want %q", body, "hello")
+			}
+		})
+	}
+}
+
+func TestCacherVary(t *testing.T) {
+	dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCacher(dc, DisableCacheResultHeader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRequest := func(encoding string) *http.Request {
+		return &http.Request{Method: http.MethodGet, Host: "example.com", Header: http.Header{"Accept-Encoding": {encoding}}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+	}
+	for _, encoding := range []string{"gzip", "br"} {
+		res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Encoding"}}, Body: newBody([]byte(encoding))}
+		if err := c.Store(newRequest(encoding), res, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if got := res.Header.Get(CacheResultHeader); got != "" {
+			t.Errorf("got %q, want no header", got)
+		}
+	}
+	for _, encoding := range []string{"gzip", "br"} {
+		_, res, err := c.Load(newRequest(encoding))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readBody(res.Body); got != encoding {
+			t.Errorf("got %q, want %q", got, encoding)
+		}
+		if got := res.Header.Get(CacheResultHeader); got != "" {
+			t.Errorf("got %q, want no header", got)
+		}
+	}
+	if _, _, err := c.Load(newRequest("deflate")); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+
+	if _, err := NewCacher(dc, AllowMethods()); err == nil {
+		t.Error("want error")
+	}
+}
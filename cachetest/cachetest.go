@@ -0,0 +1,372 @@
+// Package cachetest provides the conformance tests of the implementations of rcutil.Cache.
+package cachetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/2manymws/rc"
+	"github.com/2manymws/rcutil"
+)
+
+// Config is the configuration of the cache under test.
+type Config struct {
+	// DefaultTTL is the TTL of the entries stored by Store.
+	DefaultTTL time.Duration
+	// MaxKeys is the maximum number of keys. rcutil.NoLimitKeys means no limit.
+	MaxKeys uint64
+	// MaxTotalBytes is the maximum number of bytes. rcutil.NoLimitTotalBytes means no limit.
+	MaxTotalBytes uint64
+}
+
+// NewCacheFunc returns a new empty cache of the configuration.
+// It should skip the test by t.Skip if the cache does not support the configuration.
+type NewCacheFunc func(t testing.TB, cfg Config) rcutil.Cache
+
+// Run runs the conformance tests of the cache returned by newCache.
+// The cache is closed at the end of each test.
+// The tests check the behavior that DiskCache guarantees:
+//   - Load returns the stored entry, and rc.ErrCacheNotFound or rc.ErrCacheExpired after it is deleted or expired.
+//   - The number of keys and the total bytes never exceed the limits. The cache either evicts entries
+//     or returns rcutil.ErrCacheFull, and the entry stored last is kept if it is stored without an error.
+//   - The cache can be used concurrently.
+func Run(t *testing.T, newCache NewCacheFunc) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, newCache NewCacheFunc)
+	}{
+		{"StoreAndLoad", testStoreAndLoad},
+		{"Replace", testReplace},
+		{"Delete", testDelete},
+		{"TTL", testTTL},
+		{"DefaultTTL", testDefaultTTL},
+		{"NoLimitTTL", testNoLimitTTL},
+		{"MaxKeys", testMaxKeys},
+		{"MaxTotalBytes", testMaxTotalBytes},
+		{"Concurrency", testConcurrency},
+		{"Close", testClose},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newCache)
+		})
+	}
+}
+
+func open(t *testing.T, newCache NewCacheFunc, cfg Config) rcutil.Cache {
+	t.Helper()
+	c := newCache(t, cfg)
+	t.Cleanup(func() {
+		if err := c.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return c
+}
+
+func newRequest(key string) *http.Request {
+	return &http.Request{
+		Method: http.MethodGet,
+		Host:   "example.com",
+		Header: http.Header{"X-Key": {key}},
+		URL:    &url.URL{Path: "/" + key},
+		Body:   http.NoBody,
+	}
+}
+
+func newResponse(body string) *http.Response {
+	return &http.Response{
+		Status:        http.StatusText(http.StatusOK),
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"X-Test": {"test"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+func store(c rcutil.Cache, key, body string) error {
+	return c.Store(key, newRequest(key), newResponse(body))
+}
+
+func storeWithTTL(c rcutil.Cache, key, body string, ttl time.Duration) error {
+	return c.StoreWithTTL(key, newRequest(key), newResponse(body), ttl)
+}
+
+// load loads the entry and returns its body.
+func load(c rcutil.Cache, key string) (string, error) {
+	req, res, err := c.Load(key)
+	if err != nil {
+		return "", err
+	}
+	b, err := io.ReadAll(res.Body)
+	if err := errors.Join(err, res.Body.Close()); err != nil {
+		return "", err
+	}
+	if req.URL.Path != "/"+key {
+		return "", fmt.Errorf("got request for %q, want %q", req.URL.Path, "/"+key)
+	}
+	return string(b), nil
+}
+
+func isNotFound(err error) bool {
+	return errors.Is(err, rc.ErrCacheNotFound) || errors.Is(err, rc.ErrCacheExpired)
+}
+
+// eventually returns the metrics once cond is satisfied, or after a second.
+// The metrics of caches that write entries in the background may lag behind Store.
+func eventually(c rcutil.Cache, cond func(rcutil.Metrics) bool) rcutil.Metrics {
+	deadline := time.Now().Add(1 * time.Second)
+	for {
+		m := c.Metrics()
+		if cond(m) || time.Now().After(deadline) {
+			return m
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testStoreAndLoad(t *testing.T, newCache NewCacheFunc) {
+	c := open(t, newCache, Config{DefaultTTL: 1 * time.Hour})
+	if err := store(c, "a", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	req, res, err := c.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("X-Key"); got != "a" {
+		t.Errorf("got %q, want %q", got, "a")
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("got %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	if got := res.Header.Get("X-Test"); got != "test" {
+		t.Errorf("got %q, want %q", got, "test")
+	}
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := res.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte("hello")) {
+		t.Errorf("got %q, want %q", b, "hello")
+	}
+
+	if _, err := load(c, "unknown"); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+	if m := c.Metrics(); m.Hits != 1 || m.Misses != 1 {
+		t.Errorf("got %d hits and %d misses, want 1 and 1", m.Hits, m.Misses)
+	}
+	m := eventually(c, func(m rcutil.Metrics) bool {
+		return m.KeyCount == 1 && m.TotalBytes > 0
+	})
+	if m.KeyCount != 1 || m.TotalBytes == 0 {
+		t.Errorf("got %d keys and %d bytes, want 1 key and some bytes", m.KeyCount, m.TotalBytes)
+	}
+}
+
+func testReplace(t *testing.T, newCache NewCacheFunc) {
+	c := open(t, newCache, Config{DefaultTTL: 1 * time.Hour})
+	if err := store(c, "a", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store(c, "a", "new"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := load(c, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "new" {
+		t.Errorf("got %q, want %q", got, "new")
+	}
+	m := eventually(c, func(m rcutil.Metrics) bool {
+		return m.KeyCount == 1
+	})
+	if m.KeyCount != 1 {
+		t.Errorf("got %d keys, want %d", m.KeyCount, 1)
+	}
+}
+
+func testDelete(t *testing.T, newCache NewCacheFunc) {
+	c := open(t, newCache, Config{DefaultTTL: 1 * time.Hour})
+	if err := store(c, "a", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	c.Delete("a")
+	c.Delete("unknown")
+	if _, err := load(c, "a"); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+	// The key can be stored again
+	if err := store(c, "a", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := load(c, "a"); err != nil || got != "again" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func testTTL(t *testing.T, newCache NewCacheFunc) {
+	c := open(t, newCache, Config{DefaultTTL: 1 * time.Hour})
+	if err := storeWithTTL(c, "short", "hello", 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeWithTTL(c, "long", "hello", 1*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := load(c, "short"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := load(c, "short"); !isNotFound(err) {
+		t.Errorf("got %v, want %v or %v", err, rc.ErrCacheNotFound, rc.ErrCacheExpired)
+	}
+	if _, err := load(c, "long"); err != nil {
+		t.Error(err)
+	}
+}
+
+func testDefaultTTL(t *testing.T, newCache NewCacheFunc) {
+	c := open(t, newCache, Config{DefaultTTL: 100 * time.Millisecond})
+	if err := store(c, "a", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := load(c, "a"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := load(c, "a"); !isNotFound(err) {
+		t.Errorf("got %v, want %v or %v", err, rc.ErrCacheNotFound, rc.ErrCacheExpired)
+	}
+}
+
+func testNoLimitTTL(t *testing.T, newCache NewCacheFunc) {
+	c := open(t, newCache, Config{DefaultTTL: 100 * time.Millisecond})
+	if err := storeWithTTL(c, "a", "hello", rcutil.NoLimitTTL); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := load(c, "a"); err != nil {
+		t.Error(err)
+	}
+}
+
+func testMaxKeys(t *testing.T, newCache NewCacheFunc) {
+	const maxKeys = 3
+	c := open(t, newCache, Config{DefaultTTL: 1 * time.Hour, MaxKeys: maxKeys})
+	for i := 0; i < maxKeys*3; i++ {
+		key := fmt.Sprintf("key%d", i)
+		err := store(c, key, "hello")
+		if err != nil && !errors.Is(err, rcutil.ErrCacheFull) {
+			t.Fatal(err)
+		}
+		if got := c.Metrics().KeyCount; got > maxKeys {
+			t.Errorf("got %d keys, want at most %d", got, maxKeys)
+		}
+		if err != nil {
+			continue
+		}
+		if _, err := load(c, key); err != nil {
+			t.Errorf("the entry stored last is not kept: %v", err)
+		}
+	}
+}
+
+func testMaxTotalBytes(t *testing.T, newCache NewCacheFunc) {
+	const maxTotalBytes = 8 * 1024
+	c := open(t, newCache, Config{DefaultTTL: 1 * time.Hour, MaxTotalBytes: maxTotalBytes})
+	body := strings.Repeat("a", 1024)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		err := store(c, key, body)
+		if err != nil && !errors.Is(err, rcutil.ErrCacheFull) {
+			t.Fatal(err)
+		}
+		if got := c.Metrics().TotalBytes; got > maxTotalBytes {
+			t.Errorf("got %d bytes, want at most %d", got, maxTotalBytes)
+		}
+		if err != nil {
+			continue
+		}
+		if got, err := load(c, key); err != nil || got != body {
+			t.Errorf("the entry stored last is not kept: %v", err)
+		}
+	}
+
+	// The entry larger than the cache is never stored
+	if err := store(c, "large", strings.Repeat("a", maxTotalBytes+1)); !errors.Is(err, rcutil.ErrCacheFull) {
+		t.Errorf("got %v, want %v", err, rcutil.ErrCacheFull)
+	}
+	if _, err := load(c, "large"); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+	if got := c.Metrics().TotalBytes; got > maxTotalBytes {
+		t.Errorf("got %d bytes, want at most %d", got, maxTotalBytes)
+	}
+}
+
+func testConcurrency(t *testing.T, newCache NewCacheFunc) {
+	const (
+		concurrency = 8
+		keys        = 10
+		operations  = 50
+	)
+	c := open(t, newCache, Config{DefaultTTL: 1 * time.Hour})
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(i))) //nolint:gosec
+			for j := 0; j < operations; j++ {
+				key := fmt.Sprintf("key%d", r.Intn(keys))
+				switch r.Intn(3) {
+				case 0:
+					if err := store(c, key, fmt.Sprintf("%s-%d-%d", key, i, j)); err != nil {
+						t.Error(err)
+					}
+				case 1:
+					got, err := load(c, key)
+					switch {
+					case isNotFound(err):
+					case err != nil:
+						t.Error(err)
+					case !strings.HasPrefix(got, key+"-"):
+						// The body of another entry is returned
+						t.Errorf("got %q for %q", got, key)
+					}
+				default:
+					c.Delete(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if got := c.Metrics().KeyCount; got > keys {
+		t.Errorf("got %d keys, want at most %d", got, keys)
+	}
+}
+
+func testClose(t *testing.T, newCache NewCacheFunc) {
+	c := open(t, newCache, Config{DefaultTTL: 1 * time.Hour})
+	if err := store(c, "a", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	// Close can be called more than once
+	if err := c.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,61 @@
+package cachetest
+
+import (
+	"testing"
+
+	"github.com/2manymws/rcutil"
+)
+
+func newDiskCache(t testing.TB, cfg Config, opts ...rcutil.DiskCacheOption) *rcutil.DiskCache {
+	t.Helper()
+	opts = append([]rcutil.DiskCacheOption{rcutil.DisableWarmUp(), rcutil.MaxKeys(cfg.MaxKeys), rcutil.MaxTotalBytes(cfg.MaxTotalBytes)}, opts...)
+	dc, err := rcutil.NewDiskCache(t.TempDir(), cfg.DefaultTTL, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dc
+}
+
+func newTieredCache(t testing.TB, cfg Config, opts ...rcutil.TieredCacheOption) *rcutil.TieredCache {
+	t.Helper()
+	dc := newDiskCache(t, cfg)
+	mc := rcutil.NewMemoryCache(cfg.MaxTotalBytes, cfg.DefaultTTL, rcutil.MemoryMaxKeys(cfg.MaxKeys))
+	tc, err := rcutil.NewTieredCache(mc, dc, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+func TestDiskCache(t *testing.T) {
+	Run(t, func(t testing.TB, cfg Config) rcutil.Cache {
+		return newDiskCache(t, cfg)
+	})
+}
+
+func TestDiskCacheWithAutoAdjust(t *testing.T) {
+	Run(t, func(t testing.TB, cfg Config) rcutil.Cache {
+		if cfg.MaxTotalBytes == rcutil.NoLimitTotalBytes {
+			t.Skip("auto-adjust requires the limit of total bytes")
+		}
+		return newDiskCache(t, cfg, rcutil.EnableAutoAdjust())
+	})
+}
+
+func TestMemoryCache(t *testing.T) {
+	Run(t, func(t testing.TB, cfg Config) rcutil.Cache {
+		return rcutil.NewMemoryCache(cfg.MaxTotalBytes, cfg.DefaultTTL, rcutil.MemoryMaxKeys(cfg.MaxKeys))
+	})
+}
+
+func TestTieredCache(t *testing.T) {
+	Run(t, func(t testing.TB, cfg Config) rcutil.Cache {
+		return newTieredCache(t, cfg)
+	})
+}
+
+func TestTieredCacheWithWriteBack(t *testing.T) {
+	Run(t, func(t testing.TB, cfg Config) rcutil.Cache {
+		return newTieredCache(t, cfg, rcutil.EnableWriteBack(10))
+	})
+}
@@ -0,0 +1,256 @@
+package rcutil
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/2manymws/rc"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// ChecksumAlgorithm is an algorithm of the checksums of cache files.
+type ChecksumAlgorithm int
+
+const (
+	// ChecksumNone does not compute checksums (default).
+	ChecksumNone ChecksumAlgorithm = iota
+	// ChecksumCRC32C computes CRC-32C (Castagnoli) checksums. It is fast and detects accidental corruption.
+	ChecksumCRC32C
+	// ChecksumSHA256 computes SHA-256 checksums.
+	ChecksumSHA256
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func (a ChecksumAlgorithm) String() string {
+	switch a {
+	case ChecksumCRC32C:
+		return "crc32c"
+	case ChecksumSHA256:
+		return "sha256"
+	default:
+		return "none"
+	}
+}
+
+func (a ChecksumAlgorithm) newHash() hash.Hash {
+	switch a {
+	case ChecksumCRC32C:
+		return crc32.New(crc32cTable)
+	case ChecksumSHA256:
+		return sha256.New()
+	default:
+		return nil
+	}
+}
+
+// formatChecksum returns the checksum in the form of "algorithm:hex".
+func formatChecksum(a ChecksumAlgorithm, h hash.Hash) string {
+	return a.String() + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// parseChecksum returns the algorithm of the checksum in the form of "algorithm:hex".
+func parseChecksum(sum string) (ChecksumAlgorithm, error) {
+	name, _, _ := strings.Cut(sum, ":")
+	for _, a := range []ChecksumAlgorithm{ChecksumCRC32C, ChecksumSHA256} {
+		if name == a.String() {
+			return a, nil
+		}
+	}
+	return ChecksumNone, fmt.Errorf("unknown checksum algorithm: %s", name)
+}
+
+// checksumReader computes the checksum of what is read from the cache file.
+type checksumReader struct {
+	r    io.Reader
+	a    ChecksumAlgorithm
+	h    hash.Hash
+	want string
+}
+
+func newChecksumReader(r io.Reader, want string) (*checksumReader, error) {
+	a, err := parseChecksum(want)
+	if err != nil {
+		return nil, err
+	}
+	return &checksumReader{r: r, a: a, h: a.newHash(), want: want}, nil
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	_, _ = r.h.Write(p[:n]) //nostyle:handlerrors
+	return n, err
+}
+
+// finish reads the rest of the file and compares the checksum.
+func (r *checksumReader) finish() error {
+	if _, err := io.Copy(r.h, r.r); err != nil {
+		return err
+	}
+	if got := formatChecksum(r.a, r.h); got != r.want {
+		return fmt.Errorf("%w: got %s, want %s", ErrChecksumMismatch, got, r.want)
+	}
+	return nil
+}
+
+// checksumBody is a response body that fails the read at the end of the body if the checksum of the response file does not match.
+type checksumBody struct {
+	io.ReadCloser
+	cr         *checksumReader
+	f          io.Closer
+	onMismatch func()
+	done       bool
+	err        error
+}
+
+func (b *checksumBody) Read(p []byte) (int, error) {
+	if b.done {
+		if b.err != nil {
+			return 0, b.err
+		}
+		return 0, io.EOF
+	}
+	n, err := b.ReadCloser.Read(p)
+	if !errors.Is(err, io.EOF) {
+		return n, err
+	}
+	b.done = true
+	if b.err = b.cr.finish(); b.err != nil {
+		b.onMismatch()
+		return n, b.err
+	}
+	return n, io.EOF
+}
+
+func (b *checksumBody) Close() error {
+	return errors.Join(b.ReadCloser.Close(), b.f.Close())
+}
+
+// verifyFile verifies the checksum of the whole file. The verification fails with the error of ctx once ctx is done.
+func verifyFile(ctx context.Context, p, want string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cr, err := newChecksumReader(contextReader(ctx, f), want)
+	if err != nil {
+		return err
+	}
+	return cr.finish()
+}
+
+// Verify verifies the checksums of the files of the cache entry.
+// If they do not match, the entry is deleted and it returns ErrChecksumMismatch.
+// Entries stored without checksums are not verified.
+func (c *DiskCache) Verify(key string) (err error) {
+	c.keyMu.RLockKey(key)
+	defer func() {
+		err = errors.Join(err, c.keyMu.RUnlockKey(key))
+	}()
+	i := c.m.Get(key, ttlcache.WithDisableTouchOnHit[string, *cacheItem]())
+	if i == nil {
+		return rc.ErrCacheNotFound
+	}
+	ci := i.Value()
+	for _, f := range []struct{ suffix, sum string }{
+		{reqCacheSuffix, ci.reqChecksum},
+		{resCacheSuffix, ci.resChecksum},
+	} {
+		if f.sum == "" {
+			continue
+		}
+		if err := verifyFile(context.Background(), ci.pathkey+f.suffix, f.sum); err != nil {
+			c.deleteCorrupted(ci)
+			return err
+		}
+	}
+	return nil
+}
+
+// Scrub verifies the checksums of all cache entries and deletes the corrupted entries.
+func (c *DiskCache) Scrub() error {
+	return c.scrub(context.Background())
+}
+
+func (c *DiskCache) scrub(ctx context.Context) error {
+	var keys []string
+	c.m.Range(func(i *ttlcache.Item[string, *cacheItem]) bool {
+		keys = append(keys, i.Key())
+		return true
+	})
+	var err error
+	for _, key := range keys {
+		select {
+		case <-ctx.Done():
+			return err
+		default:
+		}
+		if verr := c.Verify(key); verr != nil && !errors.Is(verr, ErrChecksumMismatch) && !errors.Is(verr, rc.ErrCacheNotFound) {
+			err = errors.Join(err, verr)
+		}
+	}
+	return err
+}
+
+// StartScrub starts the goroutine that scrubs the cache at the interval.
+// It returns an error if the interval is not positive.
+func (c *DiskCache) StartScrub(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid scrub interval: %s", interval)
+	}
+	c.scrubMu.Lock()
+	defer c.scrubMu.Unlock()
+	if c.scrubStopCancelFunc != nil {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.scrubStopCancelFunc = cancel
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_ = c.scrub(ctx) //nostyle:handlerrors
+			}
+		}
+	}()
+	return nil
+}
+
+// StopScrub stops the goroutine of scrubbing.
+func (c *DiskCache) StopScrub() {
+	c.scrubMu.Lock()
+	defer c.scrubMu.Unlock()
+	if c.scrubStopCancelFunc == nil {
+		return
+	}
+	c.scrubStopCancelFunc()
+	c.scrubStopCancelFunc = nil
+}
+
+// deleteCorrupted deletes the corrupted entry unless it has been replaced by a new entry.
+// It checks the entry under c.mu instead of the lock of the key, because it is called both with the lock held
+// and while the body is read after the lock is released.
+func (c *DiskCache) deleteCorrupted(ci *cacheItem) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[ci.key] != ci {
+		return
+	}
+	atomic.AddUint64(&c.checksumMismatches, 1)
+	c.m.Delete(ci.key)
+}
@@ -0,0 +1,197 @@
+package rcutil
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2manymws/rc"
+)
+
+// corruptFile flips a byte of old in the file.
+func corruptFile(t *testing.T, p, old string) {
+	t.Helper()
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.LastIndex(b, []byte(old))
+	if i < 0 {
+		t.Fatalf("%q is not found in %s", old, p)
+	}
+	b[i] ^= 1
+	if err := os.WriteFile(p, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskCacheChecksum(t *testing.T) {
+	body := strings.Repeat("hello", 10000)
+	tests := []struct {
+		name          string
+		algorithm     ChecksumAlgorithm
+		contentLength int64
+	}{
+		{"crc32c", ChecksumCRC32C, int64(len(body))},
+		{"sha256", ChecksumSHA256, int64(len(body))},
+		{"chunked", ChecksumCRC32C, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dc, err := NewDiskCache(root, 1*time.Hour, EnableChecksum(tt.algorithm), DisableWarmUp())
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := "test"
+			req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+			res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte(body)), ContentLength: tt.contentLength}
+			if err := dc.Store(key, req, res); err != nil {
+				t.Fatal(err)
+			}
+			if err := dc.Verify(key); err != nil {
+				t.Fatal(err)
+			}
+			_, got, err := dc.Load(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readBody(got.Body); got != body {
+				t.Errorf("got %d bytes, want %d bytes", len(got), len(body))
+			}
+
+			// A corrupted body fails the read at the end of the body
+			corruptFile(t, dc.pathkey(key)+resCacheSuffix, "hello")
+			_, got, err = dc.Load(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadAll(got.Body); !errors.Is(err, ErrChecksumMismatch) {
+				t.Errorf("got %v, want %v", err, ErrChecksumMismatch)
+			}
+			if err := got.Body.Close(); err != nil {
+				t.Error(err)
+			}
+			if _, _, err := dc.Load(key); !errors.Is(err, rc.ErrCacheNotFound) {
+				t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+			}
+			if got := dc.Metrics().ChecksumMismatches; got != 1 {
+				t.Errorf("got %d, want %d", got, 1)
+			}
+		})
+	}
+
+	if _, err := NewDiskCache(t.TempDir(), 1*time.Hour, EnableChecksum(ChecksumNone)); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestDiskCacheChecksumMismatchAfterReplace(t *testing.T) {
+	dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, EnableChecksum(ChecksumCRC32C), DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := func(body string) {
+		t.Helper()
+		req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+		res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte(body)), ContentLength: int64(len(body))}
+		if err := dc.Store("key", req, res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store("hello")
+	corruptFile(t, dc.pathkey("key")+resCacheSuffix, "hello")
+	_, got, err := dc.Load("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The corruption of the replaced entry is found after the entry is replaced
+	store("world")
+	if _, err := io.ReadAll(got.Body); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("got %v, want %v", err, ErrChecksumMismatch)
+	}
+	if err := got.Body.Close(); err != nil {
+		t.Error(err)
+	}
+	_, got, err = dc.Load("key")
+	if err != nil {
+		t.Fatalf("the new entry is deleted: %v", err)
+	}
+	if body := readBody(got.Body); body != "world" {
+		t.Errorf("got %q, want %q", body, "world")
+	}
+	if got := dc.Metrics().ChecksumMismatches; got != 0 {
+		t.Errorf("got %d, want %d", got, 0)
+	}
+}
+
+func TestDiskCacheScrub(t *testing.T) {
+	root := t.TempDir()
+	dc, err := NewDiskCache(root, 1*time.Hour, EnableChecksum(ChecksumCRC32C), DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"a", "b", "c"}
+	for _, key := range keys {
+		req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/" + key}, Body: newBody(nil)}
+		res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("hello")), ContentLength: 5}
+		if err := dc.Store(key, req, res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corruptFile(t, dc.pathkey("a")+reqCacheSuffix, "/a")
+	corruptFile(t, dc.pathkey("b")+resCacheSuffix, "hello")
+	if err := dc.Scrub(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		_, _, err := dc.Load(key)
+		if key == "c" {
+			if err != nil {
+				t.Errorf("%s: %v", key, err)
+			}
+			continue
+		}
+		if !errors.Is(err, rc.ErrCacheNotFound) {
+			t.Errorf("%s: got %v, want %v", key, err, rc.ErrCacheNotFound)
+		}
+	}
+	if got := dc.Metrics().ChecksumMismatches; got != 2 {
+		t.Errorf("got %d, want %d", got, 2)
+	}
+
+	corruptFile(t, dc.pathkey("c")+resCacheSuffix, "hello")
+	if err := dc.StartScrub(0); err == nil {
+		t.Error("want error")
+	}
+	if err := dc.StartScrub(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	for dc.m.Has("c") {
+		time.Sleep(10 * time.Millisecond)
+	}
+	dc.StopScrub()
+
+	// Checksums are restored by warm up
+	req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/d"}, Body: newBody(nil)}
+	res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("hello")), ContentLength: 5}
+	if err := dc.Store("d", req, res); err != nil {
+		t.Fatal(err)
+	}
+	corruptFile(t, dc.pathkey("d")+resCacheSuffix, "hello")
+	dc2, err := NewDiskCache(root, 1*time.Hour, EnableChecksum(ChecksumSHA256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-dc2.warmUpDone
+	if err := dc2.Verify("d"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("got %v, want %v", err, ErrChecksumMismatch)
+	}
+}
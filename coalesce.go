@@ -0,0 +1,194 @@
+package rcutil
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/2manymws/rc"
+)
+
+// FetchFunc fetches the response to the request from the origin.
+type FetchFunc func(req *http.Request) (*http.Response, error)
+
+// Coalescer coalesces the fetches of concurrent cache misses of the same key, so that only one caller
+// fetches the response from the origin and stores it in the cache while the others wait for it and load the stored response.
+// The waiters fetch the response directly if the response is not stored or it is not stored within the timeout.
+type Coalescer struct {
+	cache   Cache
+	ttlFunc TTLFunc
+	timeout time.Duration
+	mu      sync.Mutex
+	flights map[string]chan struct{}
+
+	fetches   uint64
+	waiters   uint64
+	waiting   int64
+	shared    uint64
+	timeouts  uint64
+	fallbacks uint64
+}
+
+// CoalescerMetrics is the metrics of Coalescer.
+type CoalescerMetrics struct {
+	// Fetches is the number of fetches on behalf of the callers of the same key.
+	Fetches uint64
+	// Waiters is the number of callers that waited for the fetch of another caller.
+	Waiters uint64
+	// Waiting is the number of callers waiting now.
+	Waiting uint64
+	// Shared is the number of waiters that loaded the response stored by another caller.
+	Shared uint64
+	// Timeouts is the number of waiters that gave up waiting.
+	Timeouts uint64
+	// Fallbacks is the number of fetches that are not coalesced, because of timeouts or responses that are not stored.
+	Fallbacks uint64
+}
+
+// NewCoalescer returns a new Coalescer that stores responses in c.
+// ttlFunc decides whether and how long the fetched responses are stored, e.g. RFC9111TTL.
+// timeout is the maximum time that callers wait for the fetch of another caller, and must be positive.
+func NewCoalescer(c Cache, ttlFunc TTLFunc, timeout time.Duration) (*Coalescer, error) {
+	if c == nil {
+		return nil, fmt.Errorf("cache must be set")
+	}
+	if ttlFunc == nil {
+		return nil, fmt.Errorf("ttlFunc must be set")
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("timeout must be positive")
+	}
+	return &Coalescer{
+		cache:   c,
+		ttlFunc: ttlFunc,
+		timeout: timeout,
+		flights: make(map[string]chan struct{}),
+	}, nil
+}
+
+// Do returns the response of key loaded from the cache. On a cache miss, it fetches the response by fetch and stores it
+// in the cache if no other caller is fetching the response of key, or waits for the other caller otherwise.
+// If the fetched response can not be stored after its body is read, it is fetched again.
+// If it is rejected before its body is read, e.g. with ErrNotAdmitted, it is returned as it is.
+// It stops waiting and returns the error of the context if the context of the request is done.
+func (co *Coalescer) Do(key string, req *http.Request, fetch FetchFunc) (*http.Response, error) {
+	res, err := co.load(key)
+	if err == nil || !isCacheMiss(err) {
+		return res, err
+	}
+	co.mu.Lock()
+	done, ok := co.flights[key]
+	if !ok {
+		done = make(chan struct{})
+		co.flights[key] = done
+	}
+	co.mu.Unlock()
+	if !ok {
+		return co.fetch(key, req, fetch, done)
+	}
+	return co.wait(key, req, fetch, done)
+}
+
+// Metrics returns the metrics of the coalescer.
+func (co *Coalescer) Metrics() CoalescerMetrics {
+	return CoalescerMetrics{
+		Fetches:   atomic.LoadUint64(&co.fetches),
+		Waiters:   atomic.LoadUint64(&co.waiters),
+		Waiting:   uint64(atomic.LoadInt64(&co.waiting)),
+		Shared:    atomic.LoadUint64(&co.shared),
+		Timeouts:  atomic.LoadUint64(&co.timeouts),
+		Fallbacks: atomic.LoadUint64(&co.fallbacks),
+	}
+}
+
+// fetch fetches the response and stores it in the cache, and then wakes up the waiters.
+func (co *Coalescer) fetch(key string, req *http.Request, fetch FetchFunc, done chan struct{}) (*http.Response, error) {
+	defer func() {
+		co.mu.Lock()
+		delete(co.flights, key)
+		co.mu.Unlock()
+		close(done)
+	}()
+	atomic.AddUint64(&co.fetches, 1)
+	res, err := fetch(req)
+	if err != nil {
+		return nil, err
+	}
+	ttl, ok := co.ttlFunc(req, res, time.Now())
+	if !ok {
+		return res, nil
+	}
+	body := &readTrackingBody{ReadCloser: res.Body}
+	stored := *res
+	stored.Body = body
+	if err := co.cache.StoreWithTTL(key, req, &stored, ttl); err != nil {
+		if !body.read {
+			// The fetched response is returned as it is, because the body is not read, e.g. it is not admitted
+			return res, nil
+		}
+		_ = res.Body.Close() //nostyle:handlerrors
+		return co.fallback(req, fetch)
+	}
+	// The body has been read into the cache
+	_ = res.Body.Close() //nostyle:handlerrors
+	res, err = co.load(key)
+	if err != nil {
+		return co.fallback(req, fetch)
+	}
+	return res, nil
+}
+
+// wait waits for the fetch of another caller and loads the stored response.
+func (co *Coalescer) wait(key string, req *http.Request, fetch FetchFunc, done chan struct{}) (*http.Response, error) {
+	atomic.AddUint64(&co.waiters, 1)
+	atomic.AddInt64(&co.waiting, 1)
+	timer := time.NewTimer(co.timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		atomic.AddInt64(&co.waiting, -1)
+	case <-timer.C:
+		atomic.AddInt64(&co.waiting, -1)
+		atomic.AddUint64(&co.timeouts, 1)
+		return co.fallback(req, fetch)
+	case <-req.Context().Done():
+		atomic.AddInt64(&co.waiting, -1)
+		return nil, req.Context().Err()
+	}
+	res, err := co.load(key)
+	if err != nil {
+		// Not stored
+		return co.fallback(req, fetch)
+	}
+	atomic.AddUint64(&co.shared, 1)
+	return res, nil
+}
+
+func (co *Coalescer) fallback(req *http.Request, fetch FetchFunc) (*http.Response, error) {
+	atomic.AddUint64(&co.fallbacks, 1)
+	return fetch(req)
+}
+
+func (co *Coalescer) load(key string) (*http.Response, error) {
+	_, res, err := co.cache.Load(key)
+	return res, err
+}
+
+// readTrackingBody is a body that records whether it has been read.
+type readTrackingBody struct {
+	io.ReadCloser
+	read bool
+}
+
+func (b *readTrackingBody) Read(p []byte) (int, error) {
+	b.read = true
+	return b.ReadCloser.Read(p)
+}
+
+func isCacheMiss(err error) bool {
+	return errors.Is(err, rc.ErrCacheNotFound) || errors.Is(err, rc.ErrCacheExpired)
+}
@@ -0,0 +1,237 @@
+package rcutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCoalescer(t *testing.T) {
+	storable := func(req *http.Request, res *http.Response, now time.Time) (time.Duration, bool) {
+		return 1 * time.Hour, true
+	}
+	notStorable := func(req *http.Request, res *http.Response, now time.Time) (time.Duration, bool) {
+		return 0, false
+	}
+	tests := []struct {
+		name        string
+		ttlFunc     TTLFunc
+		timeout     time.Duration
+		wantFetches int64
+		want        CoalescerMetrics
+	}{
+		{"shared", storable, 1 * time.Minute, 1, CoalescerMetrics{Fetches: 1, Waiters: 4, Shared: 4}},
+		{"not stored", notStorable, 1 * time.Minute, 5, CoalescerMetrics{Fetches: 1, Waiters: 4, Fallbacks: 4}},
+		{"timeout", storable, 10 * time.Millisecond, 5, CoalescerMetrics{Fetches: 1, Waiters: 4, Timeouts: 4, Fallbacks: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, DisableWarmUp())
+			if err != nil {
+				t.Fatal(err)
+			}
+			co, err := NewCoalescer(dc, tt.ttlFunc, tt.timeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fetches int64
+			release := make(chan struct{})
+			fetch := func(req *http.Request) (*http.Response, error) {
+				if atomic.AddInt64(&fetches, 1) == 1 {
+					// The first fetch is slow
+					<-release
+				}
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("hello"))}, nil
+			}
+
+			const concurrency = 5
+			var wg sync.WaitGroup
+			for i := 0; i < concurrency; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+					res, err := co.Do("key", req, fetch)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if got := readBody(res.Body); got != "hello" {
+						t.Errorf("got %q, want %q", got, "hello")
+					}
+				}()
+			}
+			for co.Metrics().Waiters+co.Metrics().Timeouts < concurrency-1 {
+				time.Sleep(1 * time.Millisecond)
+			}
+			if tt.want.Timeouts > 0 {
+				for atomic.LoadInt64(&fetches) < tt.wantFetches {
+					time.Sleep(1 * time.Millisecond)
+				}
+			}
+			close(release)
+			wg.Wait()
+
+			if got := atomic.LoadInt64(&fetches); got != tt.wantFetches {
+				t.Errorf("got %d fetches, want %d", got, tt.wantFetches)
+			}
+			if diff := cmp.Diff(tt.want, co.Metrics()); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestCoalescerHit(t *testing.T) {
+	dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+	if err := dc.Store("key", req, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("cached"))}); err != nil {
+		t.Fatal(err)
+	}
+	co, err := NewCoalescer(dc, RFC9111TTL, 1*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := co.Do("key", req, func(req *http.Request) (*http.Response, error) {
+		t.Error("fetched on a cache hit")
+		return nil, errors.New("unexpected fetch")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readBody(res.Body); got != "cached" {
+		t.Errorf("got %q, want %q", got, "cached")
+	}
+}
+
+// closeRecordingBody records whether it has been closed.
+type closeRecordingBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *closeRecordingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestCoalescerStoreFailure(t *testing.T) {
+	tests := []struct {
+		name          string
+		opts          []DiskCacheOption
+		wantFetches   int
+		wantFallbacks uint64
+	}{
+		{"rejected before the body is read", []DiskCacheOption{EnableDoorkeeper(2, 100)}, 1, 0},
+		{"rejected after the body is read", []DiskCacheOption{MaxObjectBytes(1)}, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, append([]DiskCacheOption{DisableWarmUp()}, tt.opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			co, err := NewCoalescer(dc, func(req *http.Request, res *http.Response, now time.Time) (time.Duration, bool) {
+				return 1 * time.Hour, true
+			}, 1*time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var bodies []*closeRecordingBody
+			fetch := func(req *http.Request) (*http.Response, error) {
+				b := &closeRecordingBody{Reader: strings.NewReader("hello")}
+				bodies = append(bodies, b)
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, ContentLength: -1, Body: b}, nil
+			}
+			req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+			res, err := co.Do("key", req, fetch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readBody(res.Body); got != "hello" {
+				t.Errorf("got %q, want %q", got, "hello")
+			}
+			if got := len(bodies); got != tt.wantFetches {
+				t.Fatalf("got %d fetches, want %d", got, tt.wantFetches)
+			}
+			for i, b := range bodies {
+				// Only the body of the returned response is left to the caller
+				if want := b != res.Body; b.closed != want {
+					t.Errorf("got closed %v of the body of fetch %d, want %v", b.closed, i, want)
+				}
+			}
+			if got := co.Metrics().Fallbacks; got != tt.wantFallbacks {
+				t.Errorf("got %d fallbacks, want %d", got, tt.wantFallbacks)
+			}
+		})
+	}
+}
+
+func TestCoalescerContext(t *testing.T) {
+	dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	co, err := NewCoalescer(dc, RFC9111TTL, 1*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+		_, _ = co.Do("key", req, func(req *http.Request) (*http.Response, error) {
+			close(fetching)
+			<-release
+			return nil, errors.New("origin error")
+		})
+	}()
+	<-fetching
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := (&http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}}).WithContext(ctx)
+	if _, err := co.Do("key", req, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	close(release)
+	if got := co.Metrics().Waiting; got != 0 {
+		t.Errorf("got %d, want %d", got, 0)
+	}
+}
+
+func TestNewCoalescerInvalid(t *testing.T) {
+	dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		cache   Cache
+		ttlFunc TTLFunc
+		timeout time.Duration
+	}{
+		{"no cache", nil, RFC9111TTL, 1 * time.Minute},
+		{"no ttlFunc", dc, nil, 1 * time.Minute},
+		{"zero timeout", dc, RFC9111TTL, 0},
+		{"negative timeout", dc, RFC9111TTL, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewCoalescer(tt.cache, tt.ttlFunc, tt.timeout); err == nil {
+				t.Error("want error")
+			}
+		})
+	}
+}
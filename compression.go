@@ -0,0 +1,278 @@
+package rcutil
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/2manymws/rc"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is a content coding used to compress stored response bodies.
+type Codec interface {
+	// Encoding returns the content-coding name of the codec as used in Content-Encoding (e.g. "gzip").
+	Encoding() string
+	// NewWriter returns a writer that compresses to w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// NewReader returns a reader that decompresses from r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+type gzipCodec struct {
+	level int
+}
+
+// NewGzipCodec returns a Codec of gzip with the default compression level.
+func NewGzipCodec() Codec {
+	return gzipCodec{level: gzip.DefaultCompression}
+}
+
+func (gzipCodec) Encoding() string {
+	return "gzip"
+}
+
+func (g gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, g.level)
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type zstdCodec struct{}
+
+// NewZstdCodec returns a Codec of zstd with the default compression level.
+func NewZstdCodec() Codec {
+	return zstdCodec{}
+}
+
+func (zstdCodec) Encoding() string {
+	return "zstd"
+}
+
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+// compressibleTypes are the media types other than text/* that are compressed.
+var compressibleTypes = map[string]struct{}{
+	"application/javascript": {},
+	"application/json":       {},
+	"application/xml":        {},
+	"application/xhtml+xml":  {},
+	"image/svg+xml":          {},
+}
+
+// compressible reports whether the body of the response should be compressed when it is stored.
+func (c *DiskCache) compressible(res *http.Response) bool {
+	if c.codec == nil || res.Body == nil || res.Body == http.NoBody {
+		return false
+	}
+	switch res.StatusCode {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified:
+		return false
+	}
+	if res.Header.Get("Content-Encoding") != "" || parseCacheControl(res.Header).has("no-transform") {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	_, ok := compressibleTypes[mediaType]
+	return ok
+}
+
+// writeTempRes writes the response to a temporary file.
+// If the response is compressible, the body is compressed first so that the stored response has its Content-Length.
+func (c *DiskCache) writeTempRes(key string, tmp *tempFiles, res *http.Response) (uint64, error) {
+	res = c.redaction.redactResponse(res)
+	aad := c.entryAAD(key, resCacheSuffix)
+	if !c.compressible(res) {
+		return c.writeTempEntryFile(&tmp.res, &tmp.resChecksum, aad, func(w io.Writer) error {
+			return EncodeRes(res, w)
+		})
+	}
+	var body string
+	defer func() {
+		if body != "" {
+			_ = os.Remove(body) //nostyle:handlerrors
+		}
+	}()
+	var decodedLength int64
+	// The compressed body is also encrypted so that it is never written in plaintext
+	encodedLength, err := c.writeTempEntryFile(&body, nil, aad, func(w io.Writer) (err error) {
+		defer func() {
+			err = errors.Join(err, res.Body.Close())
+		}()
+		cw, err := c.codec.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		decodedLength, err = io.Copy(cw, res.Body)
+		return errors.Join(err, cw.Close())
+	})
+	if err != nil {
+		return 0, err
+	}
+	f, err := c.openEntryFile(context.Background(), body, aad)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	encoded := *res
+	encoded.Header = res.Header.Clone()
+	encoded.Header.Set("Content-Encoding", c.codec.Encoding())
+	encoded.Header.Set("Content-Length", strconv.FormatUint(encodedLength, 10))
+	encoded.ContentLength = int64(encodedLength)
+	encoded.TransferEncoding = nil
+	encoded.Body = f
+	n, err := c.writeTempEntryFile(&tmp.res, &tmp.resChecksum, aad, func(w io.Writer) error {
+		return EncodeRes(&encoded, w)
+	})
+	if err != nil {
+		return 0, err
+	}
+	tmp.encoding = c.codec.Encoding()
+	tmp.encodedLength = int64(encodedLength)
+	tmp.decodedLength = decodedLength
+	return n, nil
+}
+
+// decodeBody replaces the body of the response compressed by the cache with the decompressed one.
+func (c *DiskCache) decodeBody(res *http.Response, ci *cacheItem) error {
+	codec, ok := c.codecs[ci.encoding]
+	if !ok {
+		return fmt.Errorf("unknown encoding of the stored body: %s", ci.encoding)
+	}
+	body := res.Body
+	r, err := codec.NewReader(body)
+	if err != nil {
+		return err
+	}
+	res.Body = closer{Reader: r, Closer: closeFunc(func() error {
+		return errors.Join(r.Close(), body.Close())
+	})}
+	res.Header.Del("Content-Encoding")
+	res.Header.Set("Content-Length", strconv.FormatInt(ci.decodedLength, 10))
+	res.ContentLength = ci.decodedLength
+	return nil
+}
+
+// LoadNegotiated loads the response from the cache for the request.
+// If the body is stored compressed and the Accept-Encoding of the request allows its encoding,
+// the response is returned as it is stored with the strong ETag suffixed by the encoding,
+// so that it is not confused with the decompressed representation, e.g. by If-Range.
+// Otherwise the body is decompressed as in Load.
+func (c *DiskCache) LoadNegotiated(key string, req *http.Request) (*http.Request, *http.Response, error) {
+	return c.LoadNegotiatedContext(context.Background(), key, req)
+}
+
+// LoadNegotiatedContext loads the response from the cache for the request like LoadNegotiated.
+// ctx applies as in LoadContext.
+func (c *DiskCache) LoadNegotiatedContext(ctx context.Context, key string, req *http.Request) (_ *http.Request, _ *http.Response, err error) {
+	if err := c.rlockKey(ctx, key); err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		err = errors.Join(err, c.keyMu.RUnlockKey(key))
+	}()
+	now := time.Now()
+	i := c.getItem(key, now)
+	if i == nil {
+		return nil, nil, rc.ErrCacheNotFound
+	}
+	if isStale(i, now) {
+		return nil, nil, rc.ErrCacheExpired
+	}
+	ci := i.Value()
+	creq, res, err := loadContext(ctx, ci, c.loadFiles)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ci.encoding == "" {
+		return creq, res, nil
+	}
+	if spec, err := VarySpec(res); err == nil && !slices.Contains(spec, "Accept-Encoding") {
+		res.Header.Add("Vary", "Accept-Encoding")
+	}
+	if acceptsEncoding(req, ci.encoding) {
+		if etag := res.Header.Get("ETag"); etag != "" {
+			res.Header.Set("ETag", encodedETag(etag, ci.encoding))
+		}
+		return creq, res, nil
+	}
+	if err := c.decodeBody(res, ci); err != nil {
+		return nil, nil, errors.Join(err, res.Body.Close(), creq.Body.Close())
+	}
+	return creq, res, nil
+}
+
+// encodedETag returns the strong ETag of the representation compressed with encoding.
+// A weak ETag is returned as it is, because the representations are semantically equivalent.
+func encodedETag(etag, encoding string) string {
+	if len(etag) < 2 || !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return etag[:len(etag)-1] + "-" + encoding + `"`
+}
+
+// acceptsEncoding reports whether the Accept-Encoding of the request allows the encoding.
+// See https://httpwg.org/specs/rfc9110.html#field.accept-encoding
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	wildcard := false
+	for _, v := range req.Header.Values("Accept-Encoding") {
+		for _, e := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(e, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding == "x-gzip" {
+				coding = "gzip"
+			}
+			ok := qvalue(params) > 0
+			switch coding {
+			case encoding:
+				return ok
+			case "*":
+				wildcard = ok
+			}
+		}
+	}
+	return wildcard
+}
+
+// qvalue returns the weight of the parameters of the Accept-* field value.
+func qvalue(params string) float64 {
+	for _, p := range strings.Split(params, ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok || strings.ToLower(strings.TrimSpace(k)) != "q" {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0
+		}
+		return q
+	}
+	return 1
+}
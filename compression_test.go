@@ -0,0 +1,221 @@
+package rcutil
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiskCacheCompression(t *testing.T) {
+	body := strings.Repeat("hello world\n", 1000)
+	tests := []struct {
+		name         string
+		codec        Codec
+		contentType  string
+		cacheControl string
+		wantEncoding string
+	}{
+		{"gzip", NewGzipCodec(), "text/plain; charset=utf-8", "", "gzip"},
+		{"zstd", NewZstdCodec(), "application/json", "", "zstd"},
+		{"not compressible", NewGzipCodec(), "image/png", "", ""},
+		{"no-transform", NewGzipCodec(), "text/html", "max-age=60, no-transform", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dc, err := NewDiskCache(root, 1*time.Hour, EnableCompression(tt.codec), DisableWarmUp())
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := "test"
+			req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+			res := &http.Response{
+				Proto:         "HTTP/1.1",
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{"Content-Type": {tt.contentType}, "Cache-Control": {tt.cacheControl}, "Etag": {`"v1"`}},
+				Body:          newBody([]byte(body)),
+				ContentLength: int64(len(body)),
+			}
+			if err := dc.Store(key, req, res); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := dc.Info(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Encoding != tt.wantEncoding {
+				t.Errorf("got %q, want %q", info.Encoding, tt.wantEncoding)
+			}
+			if info.ContentLength != int64(len(body)) {
+				t.Errorf("got %d, want %d", info.ContentLength, len(body))
+			}
+			m := dc.Metrics()
+			if tt.wantEncoding == "" && m.TotalBytes != m.LogicalBytes {
+				t.Errorf("got %d, want %d", m.TotalBytes, m.LogicalBytes)
+			}
+			if tt.wantEncoding != "" && m.TotalBytes >= m.LogicalBytes {
+				t.Errorf("TotalBytes %d should be less than LogicalBytes %d", m.TotalBytes, m.LogicalBytes)
+			}
+
+			// Load always returns the decompressed body
+			_, got, err := dc.Load(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := got.Header.Get("Content-Encoding"); got != "" {
+				t.Errorf("got %q, want no Content-Encoding", got)
+			}
+			if got := got.Header.Get("Content-Length"); got != strconv.Itoa(len(body)) {
+				t.Errorf("got %q, want %q", got, strconv.Itoa(len(body)))
+			}
+			if got := readBody(got.Body); got != body {
+				t.Errorf("got %d bytes, want %d bytes", len(got), len(body))
+			}
+
+			for _, acceptEncoding := range []string{"", "identity", "gzip;q=0, zstd;q=0", "br, gzip, zstd"} {
+				creq := &http.Request{Header: http.Header{"Accept-Encoding": {acceptEncoding}}}
+				_, got, err := dc.LoadNegotiated(key, creq)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := ""
+				if tt.wantEncoding != "" && acceptsEncoding(creq, tt.wantEncoding) {
+					want = tt.wantEncoding
+				}
+				if got := got.Header.Get("Content-Encoding"); got != want {
+					t.Errorf("Accept-Encoding %q: got %q, want %q", acceptEncoding, got, want)
+				}
+				if got.ContentLength != int64(len(body)) && want == "" {
+					t.Errorf("Accept-Encoding %q: got %d, want %d", acceptEncoding, got.ContentLength, len(body))
+				}
+				wantETag := `"v1"`
+				if want != "" {
+					wantETag = `"v1-` + want + `"`
+				}
+				if got := got.Header.Get("ETag"); got != wantETag {
+					t.Errorf("Accept-Encoding %q: got %s, want %s", acceptEncoding, got, wantETag)
+				}
+				var r io.ReadCloser = got.Body
+				if want != "" {
+					// The ranges of the decompressed representation are not served from the compressed one
+					rreq := &http.Request{Method: http.MethodGet, Header: http.Header{"Range": {"bytes=0-9"}, "If-Range": {`"v1"`}}}
+					rres, err := ServeRange(rreq, got)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if rres.StatusCode != http.StatusOK {
+						t.Errorf("Accept-Encoding %q: got %d, want %d", acceptEncoding, rres.StatusCode, http.StatusOK)
+					}
+					if _, ok := got.Body.(*FileBody); !ok {
+						t.Errorf("got %T, want *FileBody", got.Body)
+					}
+					r, err = tt.codec.NewReader(got.Body)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				if got := readBody(r); got != body {
+					t.Errorf("Accept-Encoding %q: got %d bytes, want %d bytes", acceptEncoding, len(got), len(body))
+				}
+				if err := got.Body.Close(); err != nil {
+					t.Error(err)
+				}
+			}
+
+			// Warm up restores the logical bytes
+			dc2, err := NewDiskCache(root, 1*time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			<-dc2.warmUpDone
+			if got := dc2.Metrics(); got.TotalBytes != m.TotalBytes || got.LogicalBytes != m.LogicalBytes {
+				t.Errorf("got (%d, %d), want (%d, %d)", got.TotalBytes, got.LogicalBytes, m.TotalBytes, m.LogicalBytes)
+			}
+			_, got, err = dc2.Load(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readBody(got.Body); got != body {
+				t.Errorf("got %d bytes, want %d bytes", len(got), len(body))
+			}
+		})
+	}
+}
+
+func TestDiskCacheLoadNegotiatedVary(t *testing.T) {
+	body := strings.Repeat("hello world\n", 1000)
+	tests := []struct {
+		name string
+		vary []string
+		want []string
+	}{
+		{"no Vary", nil, []string{"Accept-Encoding"}},
+		{"other field", []string{"Accept-Language"}, []string{"Accept-Language", "Accept-Encoding"}},
+		{"already listed", []string{"accept-language, accept-encoding"}, []string{"accept-language, accept-encoding"}},
+		{"Vary: *", []string{"*"}, []string{"*"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, EnableCompression(NewGzipCodec()), DisableWarmUp())
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+			res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"text/plain"}}, Body: newBody([]byte(body)), ContentLength: int64(len(body))}
+			if tt.vary != nil {
+				res.Header["Vary"] = tt.vary
+			}
+			if err := dc.Store("key", req, res); err != nil {
+				t.Fatal(err)
+			}
+			for _, acceptEncoding := range []string{"identity", "gzip"} {
+				_, got, err := dc.LoadNegotiated("key", &http.Request{Header: http.Header{"Accept-Encoding": {acceptEncoding}}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(tt.want, got.Header.Values("Vary")); diff != "" {
+					t.Errorf("Accept-Encoding %q: %s", acceptEncoding, diff)
+				}
+				if err := got.Body.Close(); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+		want           bool
+	}{
+		{"", "gzip", false},
+		{"gzip", "gzip", true},
+		{"GZIP", "gzip", true},
+		{"x-gzip", "gzip", true},
+		{"deflate, gzip;q=1.0, *;q=0.5", "gzip", true},
+		{"gzip;q=0", "gzip", false},
+		{"*", "zstd", true},
+		{"*;q=0", "zstd", false},
+		{"zstd;q=0, *", "zstd", false},
+		{"br, deflate", "zstd", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			req := &http.Request{Header: http.Header{"Accept-Encoding": {tt.acceptEncoding}}}
+			if got := acceptsEncoding(req, tt.encoding); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package rcutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/2manymws/rc"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// StoreContext stores the response in the cache with the default TTL like Store.
+// It returns the error of ctx if ctx is done while it waits for the lock of the key or reads the bodies,
+// and the temporary files written so far are removed.
+func (c *DiskCache) StoreContext(ctx context.Context, key string, req *http.Request, res *http.Response) error {
+	return c.StoreWithTTLContext(ctx, key, req, res, ttlcache.DefaultTTL)
+}
+
+// StoreWithTTLContext stores the response in the cache with the specified TTL like StoreWithTTL.
+// It returns the error of ctx if ctx is done while it waits for the lock of the key or reads the bodies,
+// and the temporary files written so far are removed.
+// Once the files start to be renamed into place, the entry is stored even if ctx is done.
+func (c *DiskCache) StoreWithTTLContext(ctx context.Context, key string, req *http.Request, res *http.Response, ttl time.Duration) error {
+	if err := c.store(ctx, key, req, res, ttl, &entryMeta{}); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+	return nil
+}
+
+// LoadContext loads the response from the cache like Load.
+// It returns the error of ctx if ctx is done while it waits for the lock of the key or opens the cache files,
+// including the verification of their checksums.
+// The body of the response is read by the caller, so ctx does not apply to it.
+func (c *DiskCache) LoadContext(ctx context.Context, key string) (_ *http.Request, _ *http.Response, err error) {
+	if err := c.rlockKey(ctx, key); err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		err = errors.Join(err, c.keyMu.RUnlockKey(key))
+	}()
+	now := time.Now()
+	i := c.getItem(key, now)
+	if i == nil {
+		return nil, nil, rc.ErrCacheNotFound
+	}
+	if isStale(i, now) {
+		return nil, nil, rc.ErrCacheExpired
+	}
+	return loadContext(ctx, i.Value(), c.loadItem)
+}
+
+// loadContext loads the cache item with load.
+// It returns the error of ctx instead of the error of load, or instead of the loaded response if ctx is done by then.
+func loadContext(ctx context.Context, ci *cacheItem, load func(context.Context, *cacheItem) (*http.Request, *http.Response, error)) (*http.Request, *http.Response, error) {
+	req, res, err := load(ctx, ci)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, nil, ctxErr
+		}
+		return nil, nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, errors.Join(err, res.Body.Close(), req.Body.Close())
+	}
+	return req, res, nil
+}
+
+// lockKey takes the lock of key, or returns the error of ctx if ctx is done before the lock is taken.
+func (c *DiskCache) lockKey(ctx context.Context, key string) error {
+	return lockKeyContext(ctx, key, c.keyMu.LockKey, c.keyMu.UnlockKey)
+}
+
+// rlockKey takes the read lock of key, or returns the error of ctx if ctx is done before the lock is taken.
+func (c *DiskCache) rlockKey(ctx context.Context, key string) error {
+	return lockKeyContext(ctx, key, c.keyMu.RLockKey, c.keyMu.RUnlockKey)
+}
+
+func lockKeyContext(ctx context.Context, key string, lock func(string), unlock func(string) error) error {
+	if ctx.Done() == nil {
+		// Never canceled
+		lock(key)
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	locked := make(chan struct{})
+	go func() {
+		lock(key)
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		// The lock is released as soon as it is taken
+		go func() {
+			<-locked
+			_ = unlock(key) //nostyle:handlerrors
+		}()
+		return ctx.Err()
+	}
+}
+
+// contextReader returns the reader that fails the read with the error of ctx once ctx is done.
+func contextReader(ctx context.Context, r io.Reader) io.Reader {
+	if ctx.Done() == nil {
+		return r
+	}
+	return &contextBody{ctx: ctx, ReadCloser: io.NopCloser(r)}
+}
+
+// withContextBodies returns the request and response whose bodies fail the read with the error of ctx once ctx is done.
+func withContextBodies(ctx context.Context, req *http.Request, res *http.Response) (*http.Request, *http.Response) {
+	if ctx.Done() == nil {
+		return req, res
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		r := *req
+		r.Body = &contextBody{ctx: ctx, ReadCloser: req.Body}
+		req = &r
+	}
+	if res.Body != nil && res.Body != http.NoBody {
+		r := *res
+		r.Body = &contextBody{ctx: ctx, ReadCloser: res.Body}
+		res = &r
+	}
+	return req, res
+}
+
+// contextBody is a body that fails the read with the error of ctx once ctx is done.
+type contextBody struct {
+	ctx context.Context //nostyle:contexts
+	io.ReadCloser
+}
+
+func (b *contextBody) Read(p []byte) (int, error) {
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return b.ReadCloser.Read(p)
+}
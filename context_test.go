@@ -0,0 +1,309 @@
+package rcutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2manymws/rc"
+)
+
+// cancelingReader cancels the context after the first read.
+type cancelingReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (r *cancelingReader) Read(p []byte) (int, error) {
+	defer r.cancel()
+	return r.r.Read(p[:1])
+}
+
+func TestDiskCacheStoreContext(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  func(t *testing.T, dc *DiskCache) (context.Context, io.ReadCloser)
+		want error
+	}{
+		{"canceled", func(t *testing.T, dc *DiskCache) (context.Context, io.ReadCloser) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx, newBody([]byte("hello"))
+		}, context.Canceled},
+		{"canceled while the body is read", func(t *testing.T, dc *DiskCache) (context.Context, io.ReadCloser) {
+			ctx, cancel := context.WithCancel(context.Background())
+			return ctx, io.NopCloser(&cancelingReader{r: strings.NewReader("hello"), cancel: cancel})
+		}, context.Canceled},
+		{"deadline exceeded while the lock is waited for", func(t *testing.T, dc *DiskCache) (context.Context, io.ReadCloser) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			t.Cleanup(cancel)
+			// The lock of the key is held until the deadline
+			dc.keyMu.LockKey("key")
+			go func() {
+				<-ctx.Done()
+				_ = dc.keyMu.UnlockKey("key")
+			}()
+			return ctx, newBody([]byte("hello"))
+		}, context.DeadlineExceeded},
+		{"not canceled", func(t *testing.T, dc *DiskCache) (context.Context, io.ReadCloser) {
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(cancel)
+			return ctx, newBody([]byte("hello"))
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dc, err := NewDiskCache(root, 1*time.Hour, DisableWarmUp())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, body := tt.ctx(t, dc)
+			req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+			res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: body}
+			if err := dc.StoreContext(ctx, "key", req, res); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			entries, err := os.ReadDir(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if strings.HasPrefix(e.Name(), tmpFilePrefix) {
+					t.Errorf("temporary file is left: %s", e.Name())
+				}
+			}
+			if tt.want == nil {
+				return
+			}
+			if _, _, err := dc.LoadContext(context.Background(), "key"); !errors.Is(err, rc.ErrCacheNotFound) {
+				t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+			}
+		})
+	}
+}
+
+func TestDiskCacheLoadContext(t *testing.T) {
+	dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+	res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("hello"))}
+	if err := dc.Store("key", req, res); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, got, err := dc.LoadContext(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(got.Body); body != "hello" {
+		t.Errorf("got %q, want %q", body, "hello")
+	}
+	cancel()
+	if _, _, err := dc.LoadContext(ctx, "key"); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+
+	// The lock of the key is held by a store
+	dc.keyMu.LockKey("key")
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := dc.LoadContext(ctx, "key"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := dc.keyMu.UnlockKey("key"); err != nil {
+		t.Fatal(err)
+	}
+	// The lock taken after the deadline is released
+	if err := dc.Store("key", req, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("world"))}); err != nil {
+		t.Fatal(err)
+	}
+	_, got, err = dc.Load("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(got.Body); body != "world" {
+		t.Errorf("got %q, want %q", body, "world")
+	}
+}
+
+func TestDiskCacheLoadContextVariants(t *testing.T) {
+	dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	newReq := func() *http.Request {
+		return &http.Request{Method: http.MethodGet, Header: http.Header{"Accept": {"text/html"}}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+	}
+	newRes := func() *http.Response {
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Vary": {"Accept"}}, Body: newBody([]byte("hello"))}
+	}
+	if err := dc.Store("key", newReq(), newRes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.StoreVary("primary", newReq(), newRes()); err != nil {
+		t.Fatal(err)
+	}
+	load := func(_ *http.Request, res *http.Response, err error) error {
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+	tests := []struct {
+		name string
+		key  string
+		fn   func(ctx context.Context) error
+	}{
+		{"LoadVaryContext", variantKey("primary", VarySeed(newReq(), []string{"Accept"})), func(ctx context.Context) error {
+			return load(dc.LoadVaryContext(ctx, "primary", newReq()))
+		}},
+		{"LoadStaleContext", "key", func(ctx context.Context) error {
+			req, res, _, err := dc.LoadStaleContext(ctx, "key", StaleIfError)
+			return load(req, res, err)
+		}},
+		{"LoadNegotiatedContext", "key", func(ctx context.Context) error {
+			return load(dc.LoadNegotiatedContext(ctx, "key", newReq()))
+		}},
+		{"LoadExpiredContext", "key", func(ctx context.Context) error {
+			return load(dc.LoadExpiredContext(ctx, "key"))
+		}},
+		{"RevalidateContext", "key", func(ctx context.Context) error {
+			return dc.RevalidateContext(ctx, "key", &http.Response{StatusCode: http.StatusNotModified, Header: http.Header{}}, time.Hour)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The lock of the key is held by a store
+			dc.keyMu.LockKey(tt.key)
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			if err := tt.fn(ctx); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+			}
+			if err := dc.keyMu.UnlockKey(tt.key); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.fn(context.Background()); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestDiskCacheStoreContextWhileReserving(t *testing.T) {
+	tests := []struct {
+		name string
+		// lock holds the lock of a key so that the store waits for it in reserve
+		lock func(t *testing.T, dc *DiskCache) (unlock func())
+	}{
+		{"the victim is locked", func(t *testing.T, dc *DiskCache) func() {
+			dc.keyMu.LockKey("example.coma")
+			return func() {
+				_ = dc.keyMu.UnlockKey("example.coma")
+			}
+		}},
+		{"the space is reserved by another store", func(t *testing.T, dc *DiskCache) func() {
+			dc.keyMu.LockKey("example.comc")
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				// "a" is evicted and the space is reserved until the lock is released
+				if err := storeHost(t, dc, "example.com", "c"); err != nil {
+					t.Error(err)
+				}
+			}()
+			for {
+				dc.mu.Lock()
+				reserved := dc.reservedBytes
+				dc.mu.Unlock()
+				if reserved > 0 {
+					break
+				}
+				time.Sleep(1 * time.Millisecond)
+			}
+			return func() {
+				_ = dc.keyMu.UnlockKey("example.comc")
+				<-done
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, UseQuotaGroups(groupByHost), GroupQuota("example.com", Quota{MaxKeys: 1}), DisableWarmUp())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := storeHost(t, dc, "example.com", "a"); err != nil {
+				t.Fatal(err)
+			}
+			unlock := tt.lock(t, dc)
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			req := &http.Request{Method: http.MethodGet, Host: "example.com", Header: http.Header{}, URL: &url.URL{Path: "b"}, Body: newBody(nil)}
+			res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("hello"))}
+			if err := dc.StoreContext(ctx, "example.comb", req, res); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+			}
+			unlock()
+
+			// The space is available after the lock is released
+			if err := storeHost(t, dc, "example.com", "b"); err != nil {
+				t.Fatal(err)
+			}
+			if got := dc.Metrics().Groups["example.com"].KeyCount; got != 1 {
+				t.Errorf("got %d, want %d", got, 1)
+			}
+		})
+	}
+}
+
+func TestDiskCacheLoadContextWhileVerifying(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  DiskCacheOption
+	}{
+		{"checksum", EnableChecksum(ChecksumCRC32C)},
+		{"encryption", EnableEncryption(testKey1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, tt.opt, DisableWarmUp())
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+			res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("hello"))}
+			if err := dc.Store("key", req, res); err != nil {
+				t.Fatal(err)
+			}
+			dc.mu.Lock()
+			ci := dc.entries["key"]
+			dc.mu.Unlock()
+
+			// Canceled after the lock of the key is taken
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if _, _, err := dc.loadItem(ctx, ci); !errors.Is(err, context.Canceled) {
+				t.Errorf("got %v, want %v", err, context.Canceled)
+			}
+			// The interrupted entry is not deleted
+			_, got, err := dc.Load("key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body := readBody(got.Body); body != "hello" {
+				t.Errorf("got %q, want %q", body, "hello")
+			}
+		})
+	}
+}
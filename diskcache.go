@@ -1,14 +1,15 @@
 package rcutil
 
 import (
-	"container/list"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -25,6 +26,8 @@ const (
 	NoLimitKeys = 0
 	// NoLimitTotalBytes is a special value that means no limit on the total number of bytes.
 	NoLimitTotalBytes = 0
+	// NoLimitObjectBytes is a special value that means no limit on the size of a response body.
+	NoLimitObjectBytes = 0
 	// NoLimitTTL is a special value that means no limit on the TTL.
 	NoLimitTTL = ttlcache.NoTTL
 	// DefaultCacheDirLen is the default length of the cache directory name.
@@ -34,73 +37,84 @@ const (
 
 	reqCacheSuffix = ".request"
 	resCacheSuffix = ".response"
-)
-
-type deque struct {
-	mu  sync.Mutex
-	m   map[string]*list.Element
-	lru *list.List
-}
-
-func newDeque() *deque {
-	return &deque{
-		m:   make(map[string]*list.Element),
-		lru: list.New(),
-	}
-}
 
-func (d *deque) pushFront(key string) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	if e, ok := d.m[key]; ok {
-		d.lru.MoveToFront(e)
-		return
-	}
-	e := d.lru.PushFront(key)
-	d.m[key] = e
-}
+	tmpFilePrefix  = ".rcutil-"
+	tmpFilePattern = tmpFilePrefix + "*.tmp"
+)
 
-func (d *deque) back() string {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	if d.lru.Len() == 0 {
-		return ""
-	}
-	return d.lru.Back().Value.(string)
-}
+// FsyncPolicy is a policy for flushing cache files to stable storage.
+type FsyncPolicy int
 
-func (d *deque) remove(key string) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	e, ok := d.m[key]
-	if !ok {
-		return
-	}
-	d.lru.Remove(e)
-	delete(d.m, key)
-}
+const (
+	// FsyncNone does not flush cache files (default).
+	FsyncNone FsyncPolicy = iota
+	// FsyncFiles flushes the request and response files before they are renamed into place.
+	FsyncFiles
+	// FsyncFilesAndDir flushes the request and response files and the directory that contains them.
+	FsyncFilesAndDir
+)
 
 // DiskCache is a disk cache implementation.
 type DiskCache struct {
 	cacheRoot            string
 	maxKeys              uint64
 	maxTotalBytes        uint64
+	maxObjectBytes       uint64
+	minObjectBytes       uint64
+	admissionFilter      AdmissionFilter
+	doorkeeper           *countingBloomFilter
+	doorkeeperRequests   int
+	quotaGroupFunc       QuotaGroupFunc
+	defaultQuota         Quota
 	disableAutoCleanup   bool
 	disableWarmUp        bool
 	enableAutoAdjust     bool
 	adjustTotalBytes     uint64
 	enableTouchOnHit     bool
+	staleRetention       time.Duration
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+	fsyncPolicy          FsyncPolicy
+	defaultTTL           time.Duration
+	keyHasher            KeyHasher
+	codec                Codec
+	codecs               map[string]Codec
+	keyring              *keyring
+	redaction            RedactionPolicy
+	checksum             ChecksumAlgorithm
+	checksumMismatches   uint64
+	softPurges           uint64
+	hardPurges           uint64
 	m                    *ttlcache.Cache[string, *cacheItem]
-	d                    *deque
-	totalBytes           uint64
+	// entries are the items whose files and bytes are accounted. It is guarded by mu.
+	entries       map[string]*cacheItem
+	policy        EvictionPolicy
+	policyMu      sync.Mutex
+	varies        *varyIndex
+	totalBytes    uint64
+	reservedBytes uint64
+	reserveCond   *sync.Cond
+	// removing is the number of entries whose files are being removed.
+	removing int
+	// groups are the quota groups. It is guarded by mu.
+	groups map[string]*quotaGroup
+	// purgeIndex is the index of entries for purging. It is guarded by mu.
+	purgeIndex           *purgeIndex
+	logicalBytes         uint64
 	cacheDirLen          int
 	mu                   sync.Mutex
 	keyMu                *keyrwmutex.KeyRWMutex
-	adjustMu             sync.Mutex
 	adjustStopCtx        context.Context //nostyle:contexts
 	adjustStopCancelFunc context.CancelFunc
+	evictCh              chan struct{}
 	warmUpStopCtx        context.Context //nostyle:contexts
 	warmUpStopCancelFunc context.CancelFunc
+	warmUpDone           chan struct{}
+	scrubMu              sync.Mutex
+	scrubStopCancelFunc  context.CancelFunc
+	// autoCleanupRunning is whether the goroutine of automatic cache cleanup is running. It is guarded by autoCleanupMu.
+	autoCleanupRunning bool
+	autoCleanupMu      sync.Mutex
 }
 
 // DiskCacheOption is an option for DiskCache.
@@ -115,6 +129,8 @@ func MaxKeys(n uint64) DiskCacheOption {
 }
 
 // MaxTotalBytes sets the maximum number of bytes that can be stored in the cache.
+// Space is reserved before an entry is committed, so the total bytes of the entries never exceed it.
+// Only the temporary files of the entries being written are not counted.
 func MaxTotalBytes(n uint64) DiskCacheOption {
 	return func(c *DiskCache) error {
 		c.maxTotalBytes = n
@@ -122,6 +138,53 @@ func MaxTotalBytes(n uint64) DiskCacheOption {
 	}
 }
 
+// MaxObjectBytes sets the maximum size of a response body that can be stored in the cache.
+// Larger responses are rejected with ErrNotAdmitted. A body of unknown length is rejected as soon as it exceeds the size.
+func MaxObjectBytes(n uint64) DiskCacheOption {
+	return func(c *DiskCache) error {
+		c.maxObjectBytes = n
+		return nil
+	}
+}
+
+// MinObjectBytes sets the minimum size of a response body that can be stored in the cache.
+// Smaller responses are rejected with ErrNotAdmitted.
+func MinObjectBytes(n uint64) DiskCacheOption {
+	return func(c *DiskCache) error {
+		c.minObjectBytes = n
+		return nil
+	}
+}
+
+// EnableDoorkeeper enables storing the response of a key only on the nth Store of the key,
+// so that one-hit wonders such as crawler traffic do not churn the cache.
+// Earlier stores are rejected with ErrNotAdmitted.
+// The stores are counted by a counting Bloom filter sized for expectedKeys, which forgets keys over time.
+func EnableDoorkeeper(n, expectedKeys int) DiskCacheOption {
+	return func(c *DiskCache) error {
+		if n < 1 || n > 255 {
+			return fmt.Errorf("invalid number of requests: %d", n)
+		}
+		if expectedKeys < 1 {
+			return fmt.Errorf("invalid number of expected keys: %d", expectedKeys)
+		}
+		c.doorkeeper = newCountingBloomFilter(expectedKeys)
+		c.doorkeeperRequests = n
+		return nil
+	}
+}
+
+// UseAdmissionFilter sets the AdmissionFilter. Rejected responses are not stored and ErrNotAdmitted is returned.
+func UseAdmissionFilter(f AdmissionFilter) DiskCacheOption {
+	return func(c *DiskCache) error {
+		if f == nil {
+			return fmt.Errorf("admission filter must not be nil")
+		}
+		c.admissionFilter = f
+		return nil
+	}
+}
+
 // DisableAutoCleanup disables the automatic cache cleanup.
 func DisableAutoCleanup() DiskCacheOption {
 	return func(c *DiskCache) error {
@@ -138,7 +201,9 @@ func DisableWarmUp() DiskCacheOption {
 	}
 }
 
-// EnableAutoAdjust enables auto-adjustment to delete the oldest cache when the total cache size limit (maxTotalBytes) is reached.
+// EnableAutoAdjust enables auto-adjustment to delete the caches chosen by the EvictionPolicy when the total cache size limit (maxTotalBytes) is reached.
+// The caches are deleted synchronously until the new entry fits, and the rest are deleted in the background
+// until 80% of maxTotalBytes is reached.
 func EnableAutoAdjust() DiskCacheOption {
 	return func(c *DiskCache) error {
 		if c.maxTotalBytes == NoLimitTotalBytes {
@@ -150,7 +215,7 @@ func EnableAutoAdjust() DiskCacheOption {
 	}
 }
 
-// EnableAutoAdjustWithPercentage enables auto-adjustment to delete the oldest cache when the total cache size limit (maxTotalBytes) is reached.
+// EnableAutoAdjustWithPercentage enables auto-adjustment like EnableAutoAdjust with the percentage other than 80%.
 // percentage: Delete until what percentage of the total byte size is reached.
 func EnableAutoAdjustWithPercentage(percentage uint64) DiskCacheOption {
 	return func(c *DiskCache) error {
@@ -174,17 +239,225 @@ func EnableTouchOnHit() DiskCacheOption {
 	}
 }
 
+// EnableKeepStale enables keeping expired caches as stale for the grace period instead of deleting them at once.
+// Stale caches can be loaded by LoadExpired and revalidated by Revalidate.
+func EnableKeepStale(grace time.Duration) DiskCacheOption {
+	return func(c *DiskCache) error {
+		if grace < 0 {
+			return fmt.Errorf("grace period must be positive")
+		}
+		c.staleRetention = grace
+		return nil
+	}
+}
+
+// EnableStaleWhileRevalidate enables serving expired caches by LoadStale with StaleWhileRevalidate for the window.
+// The stale-while-revalidate directive of the stored response takes precedence over the window.
+func EnableStaleWhileRevalidate(window time.Duration) DiskCacheOption {
+	return func(c *DiskCache) error {
+		if window < 0 {
+			return fmt.Errorf("window must be positive")
+		}
+		c.staleWhileRevalidate = window
+		return nil
+	}
+}
+
+// EnableStaleIfError enables serving expired caches by LoadStale with StaleIfError for the window.
+// The stale-if-error directive of the stored response takes precedence over the window.
+func EnableStaleIfError(window time.Duration) DiskCacheOption {
+	return func(c *DiskCache) error {
+		if window < 0 {
+			return fmt.Errorf("window must be positive")
+		}
+		c.staleIfError = window
+		return nil
+	}
+}
+
+// UseFsyncPolicy sets the policy for flushing cache files to stable storage.
+func UseFsyncPolicy(p FsyncPolicy) DiskCacheOption {
+	return func(c *DiskCache) error {
+		if p < FsyncNone || p > FsyncFilesAndDir {
+			return fmt.Errorf("invalid fsync policy: %d", p)
+		}
+		c.fsyncPolicy = p
+		return nil
+	}
+}
+
+// UseKeyHasher sets the KeyHasher that converts cache keys into path-safe strings.
+// The default is SHA256KeyHasher.
+func UseKeyHasher(h KeyHasher) DiskCacheOption {
+	return func(c *DiskCache) error {
+		if h == nil {
+			return fmt.Errorf("key hasher must not be nil")
+		}
+		c.keyHasher = h
+		return nil
+	}
+}
+
+// UseRedactionPolicy sets the RedactionPolicy for header fields that are not written to the cache files.
+// The default is DefaultRedactionPolicy. Use NoRedactionPolicy to store all header fields.
+func UseRedactionPolicy(p RedactionPolicy) DiskCacheOption {
+	return func(c *DiskCache) error {
+		c.redaction = p
+		return nil
+	}
+}
+
+// UseEvictionPolicy sets the EvictionPolicy. The default is NewLRUPolicy.
+func UseEvictionPolicy(p EvictionPolicy) DiskCacheOption {
+	return func(c *DiskCache) error {
+		if p == nil {
+			return fmt.Errorf("eviction policy must not be nil")
+		}
+		c.policy = p
+		return nil
+	}
+}
+
+// UseQuotaGroups divides the entries into quota groups by fn, e.g. by req.Host, so that a group that exceeds its quota
+// evicts its own entries chosen by the EvictionPolicy of the group instead of the entries of other groups.
+// The limits of the whole cache are still respected. The group is recorded in the metadata of the entry.
+func UseQuotaGroups(fn QuotaGroupFunc) DiskCacheOption {
+	return func(c *DiskCache) error {
+		if fn == nil {
+			return fmt.Errorf("quota group func must not be nil")
+		}
+		c.quotaGroupFunc = fn
+		return nil
+	}
+}
+
+// GroupQuota sets the quota of the group.
+func GroupQuota(group string, q Quota) DiskCacheOption {
+	return func(c *DiskCache) error {
+		if group == "" {
+			return fmt.Errorf("group must not be empty")
+		}
+		c.groups[group] = newQuotaGroup(group, q, true)
+		return nil
+	}
+}
+
+// DefaultGroupQuota sets the quota of the groups whose quotas are not set by GroupQuota. By default, there is no limit.
+func DefaultGroupQuota(q Quota) DiskCacheOption {
+	return func(c *DiskCache) error {
+		c.defaultQuota = q
+		return nil
+	}
+}
+
+// EnableChecksum enables computing the checksums of the request and response files with the algorithm when they are stored.
+// The checksum of the response file is verified while the body is read, and the read fails with ErrChecksumMismatch
+// at the end of the body if it does not match. Corrupted entries are deleted.
+// Bodies of entries with checksums are not *FileBody, because they are verified while they are read.
+// Entries encrypted by EnableEncryption are authenticated on Load instead, but Verify and Scrub verify their checksums.
+func EnableChecksum(a ChecksumAlgorithm) DiskCacheOption {
+	return func(c *DiskCache) error {
+		if a.newHash() == nil {
+			return fmt.Errorf("invalid checksum algorithm: %d", a)
+		}
+		c.checksum = a
+		return nil
+	}
+}
+
+// EnableCompression enables compressing the bodies of text-like responses with the codec when they are stored.
+// Load returns the decompressed body, and LoadNegotiated returns the compressed body as it is if the client accepts it.
+// Entries compressed with gzip or zstd can be loaded even if compression is disabled.
+func EnableCompression(codec Codec) DiskCacheOption {
+	return func(c *DiskCache) error {
+		if codec == nil {
+			return fmt.Errorf("codec must not be nil")
+		}
+		c.codec = codec
+		c.codecs[codec.Encoding()] = codec
+		return nil
+	}
+}
+
+// EnableEncryption enables encrypting the request and response files with AES-GCM.
+// Files are encrypted with current, and files encrypted with previous keys can still be loaded.
+// Files that fail to be authenticated are treated as cache misses.
+// Files are authenticated segment by segment as they are read, so a body whose segment fails to be authenticated
+// fails the read with ErrDecryptionFailed, and the entry is deleted.
+// Bodies of encrypted entries are not *FileBody, because they are decrypted while they are read.
+// Use Reencrypt to re-encrypt the existing cache files with current.
+func EnableEncryption(current EncryptionKey, previous ...EncryptionKey) DiskCacheOption {
+	return func(c *DiskCache) error {
+		kr, err := newKeyring(current, previous...)
+		if err != nil {
+			return err
+		}
+		c.keyring = kr
+		return nil
+	}
+}
+
 // Metrics returns the metrics of the cache.
 type Metrics struct {
 	ttlcache.Metrics
+	// TotalBytes is the number of bytes stored on disk.
 	TotalBytes uint64
-	KeyCount   uint64
+	// LogicalBytes is the number of bytes stored as if the bodies were not compressed.
+	LogicalBytes uint64
+	KeyCount     uint64
+	// ChecksumMismatches is the number of entries deleted because their checksums did not match.
+	ChecksumMismatches uint64
+	// SoftPurges is the number of entries marked as stale by SoftPurge and its variants.
+	SoftPurges uint64
+	// HardPurges is the number of entries deleted by Delete and the Purge methods.
+	HardPurges uint64
+	// Groups is the metrics of each quota group. Groups without entries are omitted unless their quotas are set by GroupQuota.
+	Groups map[string]GroupMetrics
+}
+
+// EntryInfo is the information of a cache entry.
+type EntryInfo struct {
+	Key string
+	// Bytes is the size of the entry on disk.
+	Bytes    uint64
+	StoredAt time.Time
+	// ExpiresAt is the time the entry expires. It is zero if the entry has no TTL.
+	ExpiresAt time.Time
+	// ContentLength is the length of the response body. It is -1 if the length is unknown.
+	ContentLength int64
+	// Encoding is the content coding that the body is compressed with by the cache.
+	Encoding string
 }
 
 type cacheItem struct {
-	key     string
-	pathkey string
-	bytes   uint64
+	key      string
+	pathkey  string
+	bytes    uint64
+	storedAt time.Time
+	primary  string
+	// retention is how long the item is kept after it has expired.
+	retention time.Duration
+	// staleWhileRevalidate and staleIfError are the windows in which the item can be served stale.
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+	// header is the response header fields updated by revalidation.
+	header http.Header
+	// bodyOffset and contentLength are the position of the body in the response file.
+	bodyOffset    int64
+	contentLength int64
+	// encoding is the content coding that the cache compressed the body with.
+	encoding      string
+	decodedLength int64
+	logicalBytes  uint64
+	// reqChecksum and resChecksum are the checksums of the request and response files.
+	reqChecksum string
+	resChecksum string
+	// group is the quota group of the item. It is nil if the item belongs to no group.
+	group *quotaGroup
+	// tags, host and path are the keys of the item in the purge index.
+	tags []string
+	host string
+	path string
 }
 
 // NewDiskCache returns a new DiskCache.
@@ -203,26 +476,37 @@ func NewDiskCache(cacheRoot string, defaultTTL time.Duration, opts ...DiskCacheO
 		cacheRoot:            cacheRoot,
 		maxKeys:              NoLimitKeys,
 		maxTotalBytes:        NoLimitTotalBytes,
+		defaultTTL:           defaultTTL,
+		keyHasher:            SHA256KeyHasher,
+		redaction:            DefaultRedactionPolicy(),
+		codecs:               map[string]Codec{"gzip": NewGzipCodec(), "zstd": NewZstdCodec()},
 		cacheDirLen:          DefaultCacheDirLen,
 		keyMu:                keyrwmutex.New(0),
-		d:                    newDeque(),
+		policy:               NewLRUPolicy(),
+		entries:              make(map[string]*cacheItem),
+		groups:               make(map[string]*quotaGroup),
+		purgeIndex:           newPurgeIndex(),
+		evictCh:              make(chan struct{}, 1),
+		varies:               newVaryIndex(),
 		adjustStopCtx:        adjustStopCtx,
 		adjustStopCancelFunc: adjustStopCancelFunc,
 		warmUpStopCtx:        warmUpStopCtx,
 		warmUpStopCancelFunc: warmUpStopCancelFunc,
+		warmUpDone:           make(chan struct{}),
 	}
+	c.reserveCond = sync.NewCond(&c.mu)
 	for _, opt := range opts {
 		if err := opt(c); err != nil {
 			return nil, err
 		}
 	}
+	if err := c.removeTempFiles(); err != nil {
+		return nil, err
+	}
 
 	mopts := []ttlcache.Option[string, *cacheItem]{
 		ttlcache.WithTTL[string, *cacheItem](defaultTTL),
 	}
-	if c.maxKeys > 0 {
-		mopts = append(mopts, ttlcache.WithCapacity[string, *cacheItem](c.maxKeys))
-	}
 	if !c.enableTouchOnHit {
 		mopts = append(mopts, ttlcache.WithDisableTouchOnHit[string, *cacheItem]())
 	}
@@ -234,11 +518,17 @@ func NewDiskCache(cacheRoot string, defaultTTL time.Duration, opts ...DiskCacheO
 	if !c.disableAutoCleanup {
 		c.StartAutoCleanup()
 	}
+	if c.enableAutoAdjust {
+		go c.runEvictor()
+	}
 
 	if !c.disableWarmUp {
 		go func() {
+			defer close(c.warmUpDone)
 			_ = c.warmUpCaches() //nostyle:handlerrors
 		}()
+	} else {
+		close(c.warmUpDone)
 	}
 
 	return c, nil
@@ -247,21 +537,42 @@ func NewDiskCache(cacheRoot string, defaultTTL time.Duration, opts ...DiskCacheO
 // StopAll stops all the goroutines of the cache.
 func (c *DiskCache) StopAll() {
 	c.StopWarmUp()
-	c.StartAutoCleanup()
+	c.StopAutoCleanup()
 	c.StopAdjust()
+	c.StopScrub()
+}
+
+// Close stops all the goroutines of the cache and waits for the warm up to finish.
+// The entries are kept on disk, so that they are loaded by the next DiskCache of the same cache root.
+func (c *DiskCache) Close() error {
+	c.StopAll()
+	<-c.warmUpDone
+	return nil
 }
 
 // StartAutoCleanup starts the goroutine of automatic cache cleanup
 func (c *DiskCache) StartAutoCleanup() {
+	c.autoCleanupMu.Lock()
+	defer c.autoCleanupMu.Unlock()
+	if c.autoCleanupRunning {
+		return
+	}
+	c.autoCleanupRunning = true
 	go c.m.Start()
 }
 
 // StopAutoCleanup stops the auto cleanup cache.
 func (c *DiskCache) StopAutoCleanup() {
+	c.autoCleanupMu.Lock()
+	defer c.autoCleanupMu.Unlock()
+	if !c.autoCleanupRunning {
+		return
+	}
+	c.autoCleanupRunning = false
 	c.m.Stop()
 }
 
-// StopAdjust
+// StopAdjust stops the auto-adjustment. After that, Store returns ErrCacheFull if the cache is full.
 func (c *DiskCache) StopAdjust() {
 	c.adjustStopCancelFunc()
 }
@@ -283,119 +594,411 @@ func (c *DiskCache) Store(key string, req *http.Request, res *http.Response) err
 
 // StoreWithTTL stores the response in the cache with the specified TTL.
 // If you want to store the response with no TTL, use NoLimitTTL.
-func (c *DiskCache) StoreWithTTL(key string, req *http.Request, res *http.Response, ttl time.Duration) (err error) {
-	c.keyMu.LockKey(key)
+// The request and response are written to temporary files first and renamed into place
+// only after both are fully written, so an interrupted store never leaves a partial entry.
+func (c *DiskCache) StoreWithTTL(key string, req *http.Request, res *http.Response, ttl time.Duration) error {
+	return c.store(context.Background(), key, req, res, ttl, &entryMeta{})
+}
+
+// store stores the response in the cache with the specified TTL and metadata.
+// It stops reading the bodies and waiting for the lock of the key when ctx is done.
+func (c *DiskCache) store(ctx context.Context, key string, req *http.Request, res *http.Response, ttl time.Duration, meta *entryMeta) error {
+	now := time.Now()
+	if err := c.admit(key, req, res); err != nil {
+		return err
+	}
+	req, res = withContextBodies(ctx, req, res)
+	meta.Group = c.groupName(key, req)
+	meta.setPurgeIndex(req, res)
+	res, admitSize := c.admitBody(res)
+	tmp, err := c.writeTempFiles(key, req, res)
+	if err != nil {
+		return err
+	}
+	if err := admitSize(); err != nil {
+		return errors.Join(err, tmp.remove())
+	}
+	return c.commit(ctx, key, tmp, res, ttl, meta, now)
+}
+
+// commit writes the metadata of the entry and renames the temporary files into place.
+// The temporary files are removed if the entry can not be committed.
+func (c *DiskCache) commit(ctx context.Context, key string, tmp *tempFiles, res *http.Response, ttl time.Duration, meta *entryMeta, now time.Time) (err error) {
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, tmp.remove())
+		}
+	}()
+	meta.Key = key
+	meta.StaleWhileRevalidate, meta.StaleIfError = c.staleWindows(res)
+	meta.StoredAt = now
+	meta.ExpiresAt = c.expiresAt(now, ttl)
+	meta.Bytes = tmp.bytes
+	meta.LogicalBytes = tmp.bytes
+	meta.RequestChecksum, meta.ResponseChecksum = tmp.reqChecksum, tmp.resChecksum
+	if tmp.encoding != "" {
+		meta.Encoding = tmp.encoding
+		meta.DecodedLength = tmp.decodedLength
+		meta.LogicalBytes = tmp.bytes - uint64(tmp.encodedLength) + uint64(tmp.decodedLength)
+	}
+	if c.keyring == nil {
+		// The body of an encrypted file can not be read directly
+		if offset, length, ok := bodyIndex(tmp.res); ok {
+			meta.BodyOffset, meta.ContentLength = offset, length
+		}
+	}
+	p := c.pathkey(key)
+	if err := c.writeTempMeta(tmp, p, meta); err != nil {
+		return err
+	}
+
+	// Reserve the space before taking the lock of the key, because the eviction takes the locks of the victims
+	r, err := c.reserve(ctx, key, meta.Group, tmp.bytes)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if r != nil {
+			c.mu.Lock()
+			c.release(r)
+			c.mu.Unlock()
+		}
+	}()
+
+	if err := c.lockKey(ctx, key); err != nil {
+		return err
+	}
 	defer func() {
 		err = errors.Join(err, c.keyMu.UnlockKey(key))
 	}()
-	p := filepath.Join(c.cacheRoot, KeyToPath(key, c.cacheDirLen))
-	dir := filepath.Dir(p)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+
+	ci := &cacheItem{
+		key:       key,
+		pathkey:   p,
+		bytes:     tmp.bytes,
+		storedAt:  now,
+		primary:   meta.Primary,
+		retention: c.retention(meta),
+
+		staleWhileRevalidate: meta.StaleWhileRevalidate,
+		staleIfError:         meta.StaleIfError,
+
+		bodyOffset:    meta.BodyOffset,
+		contentLength: meta.ContentLength,
+		encoding:      meta.Encoding,
+		decodedLength: meta.DecodedLength,
+		logicalBytes:  meta.LogicalBytes,
+		reqChecksum:   meta.RequestChecksum,
+		resChecksum:   meta.ResponseChecksum,
+
+		tags: meta.Tags,
+		host: meta.Host,
+		path: meta.Path,
+	}
+	if r != nil {
+		ci.group = r.group
+	}
+
+	if err := c.commitTempFiles(tmp, p); err != nil {
 		return err
 	}
-	eg := &errgroup.Group{}
-	wb := atomic.Uint64{}
-	eg.Go(func() error {
-		// Store request
-		f, err := os.Create(p + reqCacheSuffix)
-		if err != nil {
-			return err
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evictForNewKey(key)
+	c.setItem(ci, cacheTTL(now, meta.ExpiresAt, ci.retention))
+	c.release(r)
+	r = nil
+	c.policyAdd(ci)
+	if meta.Primary != "" {
+		for _, k := range c.varies.add(meta.Primary, meta.Vary, key) {
+			c.m.Delete(k)
 		}
-		defer f.Close()
-		wc := &WriteCounter{Writer: f}
-		if err := EncodeReq(req, wc); err != nil {
-			return err
+	}
+	return nil
+}
+
+// setItem sets the item and accounts its bytes in place of the item that it replaces.
+// The files of the replaced item are removed if they are at another path, e.g. stored with another KeyHasher.
+// c.mu and the lock of the key must be held.
+func (c *DiskCache) setItem(ci *cacheItem, ttl time.Duration) {
+	old, replaced := c.entries[ci.key]
+	if replaced {
+		c.purgeIndex.remove(old)
+	}
+	c.entries[ci.key] = ci
+	c.purgeIndex.add(ci)
+	c.totalBytes += ci.bytes
+	c.logicalBytes += ci.logicalBytes
+	if g := ci.group; g != nil {
+		g.keys++
+		g.totalBytes += ci.bytes
+		g.logicalBytes += ci.logicalBytes
+	}
+	if replaced {
+		// Released after the item is added, so that the group is not dropped in between
+		c.releaseBytes(old)
+		if old.pathkey != ci.pathkey {
+			c.removeFiles(old.pathkey)
 		}
-		wb.Add(wc.Bytes)
-		return nil
-	})
-	eg.Go(func() error {
-		// Store response
-		f, err := os.Create(p + resCacheSuffix)
-		if err != nil {
-			return err
+	}
+	c.m.Set(ci.key, ci, ttl)
+}
+
+// releaseBytes subtracts the bytes of the item. c.mu must be held.
+func (c *DiskCache) releaseBytes(ci *cacheItem) {
+	c.totalBytes = subBytes(c.totalBytes, ci.bytes)
+	c.logicalBytes = subBytes(c.logicalBytes, ci.logicalBytes)
+	if g := ci.group; g != nil {
+		g.keys--
+		g.totalBytes = subBytes(g.totalBytes, ci.bytes)
+		g.logicalBytes = subBytes(g.logicalBytes, ci.logicalBytes)
+		c.dropGroup(g)
+	}
+}
+
+// subBytes returns a - b, or 0 if b is greater than a.
+func subBytes(a, b uint64) uint64 {
+	if a < b {
+		return 0
+	}
+	return a - b
+}
+
+// pathkey returns the path of the entry files without suffix.
+func (c *DiskCache) pathkey(key string) string {
+	return filepath.Join(c.cacheRoot, KeyToPath(c.keyHasher(key), c.cacheDirLen))
+}
+
+// tempFiles is a set of fully written entry files that have not been renamed into place yet.
+type tempFiles struct {
+	req   string
+	res   string
+	meta  string
+	bytes uint64
+	// encoding is the content coding that the body is compressed with by the cache.
+	encoding      string
+	encodedLength int64
+	decodedLength int64
+	reqChecksum   string
+	resChecksum   string
+}
+
+func (t *tempFiles) remove() error {
+	var err error
+	for _, p := range []string{t.req, t.res, t.meta} {
+		if p == "" {
+			continue
 		}
-		defer f.Close()
-		wc := &WriteCounter{Writer: f}
-		if err := EncodeRes(res, wc); err != nil {
-			return err
+		if rerr := os.Remove(p); rerr != nil && !errors.Is(rerr, fs.ErrNotExist) {
+			err = errors.Join(err, rerr)
 		}
-		wb.Add(wc.Bytes)
-		return nil
-	})
+	}
+	return err
+}
 
-	if err := eg.Wait(); err != nil {
+// writeTempFiles encodes the request and response into temporary files in the cache root.
+func (c *DiskCache) writeTempFiles(key string, req *http.Request, res *http.Response) (_ *tempFiles, err error) {
+	tmp := &tempFiles{}
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, tmp.remove())
+		}
+	}()
+	var reqBytes, resBytes uint64
+	eg := &errgroup.Group{}
+	eg.Go(func() (err error) {
+		// Store request
+		reqBytes, err = c.writeTempEntryFile(&tmp.req, &tmp.reqChecksum, c.entryAAD(key, reqCacheSuffix), func(w io.Writer) error {
+			return EncodeReq(c.redaction.redactRequest(req, res), w)
+		})
 		return err
+	})
+	eg.Go(func() (err error) {
+		// Store response
+		resBytes, err = c.writeTempRes(key, tmp, res)
+		return err
+	})
+	if err := eg.Wait(); err != nil {
+		return nil, err
 	}
+	tmp.bytes = reqBytes + resBytes
+	return tmp, nil
+}
 
-	ci := &cacheItem{
-		key:     key,
-		pathkey: p,
-		bytes:   wb.Load(),
+// writeTempFile creates a temporary file in the cache root, sets its path to p and writes to it with encode.
+// If sum is not nil and checksums are enabled, the checksum of the file is set to sum.
+func (c *DiskCache) writeTempFile(p, sum *string, encode func(w io.Writer) error) (uint64, error) {
+	f, err := os.CreateTemp(c.cacheRoot, tmpFilePattern)
+	if err != nil {
+		return 0, err
+	}
+	*p = f.Name()
+	wc := &WriteCounter{Writer: f}
+	if sum != nil {
+		wc.Hash = c.checksum.newHash()
 	}
+	if err := encode(wc); err != nil {
+		return 0, errors.Join(err, f.Close())
+	}
+	if wc.Hash != nil {
+		*sum = formatChecksum(c.checksum, wc.Hash)
+	}
+	return wc.Bytes, c.closeFile(f)
+}
 
-	if c.maxTotalBytes != NoLimitTotalBytes {
-		c.mu.Lock()
-		current := c.totalBytes + wb.Load()
-		c.mu.Unlock()
-		switch {
-		case current < c.maxTotalBytes:
-		case c.enableAutoAdjust:
-			select {
-			case <-c.adjustStopCtx.Done():
-				// cache is full
-				if err := os.Remove(p + reqCacheSuffix); err != nil {
-					return err
-				}
-				if err := os.Remove(p + resCacheSuffix); err != nil {
-					return err
-				}
-				return fmt.Errorf("%w (%d bytes >= %d bytes)", ErrCacheFull, current, c.maxTotalBytes)
-			default:
-				go c.removeCachesUntilAdjustTotalBytes()
-			}
-		default:
-			// cache is full
-			if err := os.Remove(p + reqCacheSuffix); err != nil {
-				return err
-			}
-			if err := os.Remove(p + resCacheSuffix); err != nil {
-				return err
-			}
-			return fmt.Errorf("%w (%d bytes >= %d bytes)", ErrCacheFull, current, c.maxTotalBytes)
+// commitTempFiles renames the temporary files into place.
+// The metadata file is the commit record: the metadata of the replaced entry is removed first
+// and the new one is renamed last, so an entry with metadata is complete.
+func (c *DiskCache) commitTempFiles(tmp *tempFiles, pathkey string) error {
+	dir := filepath.Dir(pathkey)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(pathkey + metaCacheSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Rename(tmp.req, pathkey+reqCacheSuffix); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.res, pathkey+resCacheSuffix); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.meta, pathkey+metaCacheSuffix); err != nil {
+		return err
+	}
+	if c.fsyncPolicy == FsyncFilesAndDir {
+		return syncDir(dir)
+	}
+	return nil
+}
+
+func (c *DiskCache) closeFile(f *os.File) error {
+	if c.fsyncPolicy != FsyncNone {
+		if err := f.Sync(); err != nil {
+			return errors.Join(err, f.Close())
 		}
 	}
+	return f.Close()
+}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.m.Set(key, ci, ttl)
-	c.totalBytes += wb.Load()
-	c.d.pushFront(key)
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		return errors.Join(err, d.Close())
+	}
+	return d.Close()
+}
+
+// removeTempFiles removes temporary files left behind by interrupted stores.
+func (c *DiskCache) removeTempFiles() error {
+	entries, err := os.ReadDir(c.cacheRoot)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if !strings.HasPrefix(e.Name(), tmpFilePrefix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.cacheRoot, e.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
 	return nil
 }
 
 // Load loads the response from the cache.
-func (c *DiskCache) Load(key string) (_ *http.Request, _ *http.Response, err error) {
+// If the cache has expired, it returns rc.ErrCacheExpired.
+// If the position of the body in the response file is known, the body of the response is a *FileBody.
+func (c *DiskCache) Load(key string) (*http.Request, *http.Response, error) {
+	return c.LoadContext(context.Background(), key)
+}
+
+// getItem returns the item of key. With EnableTouchOnHit, it extends the expiration of the item only if the item
+// is fresh at now, because the TTL of the item includes the retention after expiration and an item kept stale
+// must not become fresh again.
+func (c *DiskCache) getItem(key string, now time.Time) *ttlcache.Item[string, *cacheItem] {
+	i := c.m.Get(key, ttlcache.WithDisableTouchOnHit[string, *cacheItem]())
+	if i != nil && c.enableTouchOnHit && !isStale(i, now) {
+		c.m.Touch(key)
+	}
+	return i
+}
+
+// Info returns the information of the cache entry without reading the cache files.
+func (c *DiskCache) Info(key string) (_ EntryInfo, err error) {
 	c.keyMu.RLockKey(key)
 	defer func() {
 		err = errors.Join(err, c.keyMu.RUnlockKey(key))
 	}()
-	i := c.m.Get(key)
+	i := c.m.Get(key, ttlcache.WithDisableTouchOnHit[string, *cacheItem]())
 	if i == nil {
-		return nil, nil, rc.ErrCacheNotFound
-	}
-	if i.IsExpired() {
-		return nil, nil, rc.ErrCacheExpired
+		return EntryInfo{}, rc.ErrCacheNotFound
 	}
 	ci := i.Value()
+	info := EntryInfo{
+		Key:           key,
+		Bytes:         ci.bytes,
+		StoredAt:      ci.storedAt,
+		ContentLength: -1,
+		Encoding:      ci.encoding,
+	}
+	if !i.ExpiresAt().IsZero() {
+		info.ExpiresAt = i.ExpiresAt().Add(-ci.retention)
+	}
+	switch {
+	case ci.encoding != "":
+		info.ContentLength = ci.decodedLength
+	case ci.bodyOffset > 0:
+		info.ContentLength = ci.contentLength
+	}
+	return info, nil
+}
+
+// loadItem loads the request and response of the cache item.
+// The body compressed by the cache is decompressed.
+func (c *DiskCache) loadItem(ctx context.Context, ci *cacheItem) (*http.Request, *http.Response, error) {
+	req, res, err := c.loadFiles(ctx, ci)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ci.encoding != "" {
+		if err := c.decodeBody(res, ci); err != nil {
+			return nil, nil, errors.Join(err, res.Body.Close(), req.Body.Close())
+		}
+	}
+	return req, res, nil
+}
+
+// loadFiles loads the request and response of the cache item as they are stored.
+// It fails with the error of ctx if ctx is done while it verifies the checksums or opens the files.
+func (c *DiskCache) loadFiles(ctx context.Context, ci *cacheItem) (*http.Request, *http.Response, error) {
+	touchMeta(ci.pathkey, time.Now())
+	c.policyAccess(ci)
+	if ci.group != nil {
+		atomic.AddUint64(&ci.group.hits, 1)
+	}
 
 	var (
 		req *http.Request
 		res *http.Response
 	)
+	// Encrypted files are authenticated as they are read instead
+	verify := c.checksum != ChecksumNone && c.keyring == nil
 	eg := &errgroup.Group{}
 	eg.Go(func() error {
-		f, err := os.Open(ci.pathkey + reqCacheSuffix)
+		if verify && ci.reqChecksum != "" {
+			if err := verifyFile(ctx, ci.pathkey+reqCacheSuffix, ci.reqChecksum); err != nil {
+				return err
+			}
+		}
+		f, err := c.openEntryFile(ctx, ci.pathkey+reqCacheSuffix, c.entryAAD(ci.key, reqCacheSuffix))
 		if err != nil {
 			return err
 		}
@@ -408,12 +1011,33 @@ func (c *DiskCache) Load(key string) (_ *http.Request, _ *http.Response, err err
 	})
 
 	eg.Go(func() error {
-		f, err := os.Open(ci.pathkey + resCacheSuffix)
+		f, err := c.openEntryFile(ctx, ci.pathkey+resCacheSuffix, c.entryAAD(ci.key, resCacheSuffix))
 		if err != nil {
 			return err
 		}
 		// Do not defer f.Close()
-		res, err = DecodeRes(f)
+		if verify && ci.resChecksum != "" {
+			cr, err := newChecksumReader(f, ci.resChecksum)
+			if err != nil {
+				return errors.Join(err, f.Close())
+			}
+			res, err = DecodeRes(cr)
+			if err != nil {
+				return errors.Join(err, f.Close())
+			}
+			res.Body = &checksumBody{
+				ReadCloser: res.Body,
+				cr:         cr,
+				f:          f,
+				onMismatch: func() { c.deleteCorrupted(ci) },
+			}
+			return nil
+		}
+		if of, ok := f.(*os.File); ok && ci.bodyOffset > 0 {
+			res, err = decodeResWithIndex(of, ci.bodyOffset, ci.contentLength)
+		} else {
+			res, err = DecodeRes(f)
+		}
 		if err != nil {
 			return errors.Join(err, f.Close())
 		}
@@ -421,7 +1045,14 @@ func (c *DiskCache) Load(key string) (_ *http.Request, _ *http.Response, err err
 	})
 
 	if err := eg.Wait(); err != nil {
-		c.Delete(key)
+		switch {
+		case ctx.Err() != nil:
+			// Interrupted, so the files are not known to be broken
+		case errors.Is(err, ErrChecksumMismatch):
+			c.deleteCorrupted(ci)
+		default:
+			c.m.Delete(ci.key)
+		}
 		if res != nil {
 			err = errors.Join(err, res.Body.Close())
 		}
@@ -430,12 +1061,23 @@ func (c *DiskCache) Load(key string) (_ *http.Request, _ *http.Response, err err
 		}
 		return nil, nil, errors.Join(err, rc.ErrCacheNotFound)
 	}
+	if c.keyring != nil {
+		// The rest of the files are authenticated as the bodies are read
+		req.Body = &authBody{ReadCloser: req.Body, onFailure: func() { c.deleteCorrupted(ci) }}
+		res.Body = &authBody{ReadCloser: res.Body, onFailure: func() { c.deleteCorrupted(ci) }}
+	}
+	for k, v := range ci.header {
+		res.Header[k] = v
+	}
 
 	return req, res, nil
 }
 
 // Delete deletes the cache.
 func (c *DiskCache) Delete(key string) {
+	if c.m.Has(key) {
+		atomic.AddUint64(&c.hardPurges, 1)
+	}
 	c.m.Delete(key)
 }
 
@@ -445,18 +1087,41 @@ func (c *DiskCache) Metrics() Metrics {
 	defer c.mu.Unlock()
 	m := c.m.Metrics()
 	return Metrics{
-		Metrics:    m,
-		TotalBytes: c.totalBytes,
-		KeyCount:   uint64(len(c.m.Keys())),
+		Metrics:      m,
+		TotalBytes:   c.totalBytes,
+		LogicalBytes: c.logicalBytes,
+		KeyCount:     uint64(len(c.m.Keys())),
+
+		ChecksumMismatches: atomic.LoadUint64(&c.checksumMismatches),
+		SoftPurges:         atomic.LoadUint64(&c.softPurges),
+		HardPurges:         atomic.LoadUint64(&c.hardPurges),
+		Groups:             c.groupMetrics(),
 	}
 }
 
 // warmUpCaches warm up the cache
+// Expiration times and the LRU order are restored from the metadata of each entry.
+// Entries that expired while the cache was not running are removed,
+// as are entries whose metadata is missing or does not match their files.
 func (c *DiskCache) warmUpCaches() error {
-	return filepath.WalkDir(c.cacheRoot, func(path string, info fs.DirEntry, err error) error {
+	type warmUpItem struct {
+		ci         *cacheItem
+		ttl        time.Duration
+		lastAccess time.Time
+		vary       []string
+		group      string
+	}
+	var items []warmUpItem
+	now := time.Now()
+	if err := filepath.WalkDir(c.cacheRoot, func(path string, info fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
+		select {
+		case <-c.warmUpStopCtx.Done():
+			return filepath.SkipAll
+		default:
+		}
 		if info.IsDir() {
 			return nil
 		}
@@ -464,116 +1129,172 @@ func (c *DiskCache) warmUpCaches() error {
 			return nil
 		}
 		// Use response cache to warm up
-		rel, err := filepath.Rel(c.cacheRoot, path)
-		if err != nil {
-			return err
-		}
 		resi, err := info.Info()
 		if err != nil {
 			return err
 		}
 		pathkey := strings.TrimSuffix(path, resCacheSuffix)
-		key := PathToKey(strings.TrimSuffix(rel, resCacheSuffix))
 
 		// request cache
 		reqpath := pathkey + reqCacheSuffix
 		reqi, err := os.Stat(reqpath)
 		if err != nil {
-			return err
+			// Incomplete entry
+			return nil
 		}
-		size := uint64(reqi.Size() + resi.Size())
-		c.mu.Lock()
-		defer c.mu.Unlock()
-		c.totalBytes += size
-		_ = c.m.Set(key, &cacheItem{ //nostyle:funcfmt
-			key:     key,
+		ci := &cacheItem{
 			pathkey: pathkey,
-			bytes:   size,
-		}, ttlcache.DefaultTTL)
-		select {
-		case <-c.warmUpStopCtx.Done():
-			return filepath.SkipAll
+		}
+		wi := warmUpItem{ci: ci}
+		metai, err := os.Stat(pathkey + metaCacheSuffix)
+		if err != nil {
+			// Incomplete entry whose metadata has not been committed
+			c.removeFiles(pathkey)
+			return nil
+		}
+		meta, lastAccess, err := c.readMeta(pathkey)
+		switch {
+		case err == nil:
+			ci.retention = c.retention(meta)
+			if meta.expired(now.Add(-ci.retention)) || !meta.matches(reqi, resi, metai) {
+				c.removeFiles(pathkey)
+				return nil
+			}
+			ci.key = meta.Key
+			ci.bytes = meta.Bytes
+			ci.storedAt = meta.StoredAt
+			ci.primary = meta.Primary
+			ci.header = meta.Header
+			ci.staleWhileRevalidate = meta.StaleWhileRevalidate
+			ci.staleIfError = meta.StaleIfError
+			ci.bodyOffset = meta.BodyOffset
+			ci.contentLength = meta.ContentLength
+			ci.encoding = meta.Encoding
+			ci.decodedLength = meta.DecodedLength
+			ci.logicalBytes = meta.LogicalBytes
+			ci.reqChecksum = meta.RequestChecksum
+			ci.resChecksum = meta.ResponseChecksum
+			wi.group = meta.Group
+			ci.tags = meta.Tags
+			// Normalized again for the metadata stored before hosts were normalized
+			ci.host = normalizeHost(meta.Host)
+			ci.path = meta.Path
+			if ci.logicalBytes == 0 {
+				// Stored before LogicalBytes was recorded
+				ci.logicalBytes = ci.bytes
+			}
+			wi.vary = meta.Vary
+			wi.ttl = cacheTTL(now, meta.ExpiresAt, ci.retention)
+			wi.lastAccess = lastAccess
 		default:
+			// Broken metadata
+			c.removeFiles(pathkey)
+			return nil
 		}
+		items = append(items, wi)
 		return nil
-	})
-}
-
-func (c *DiskCache) removeCachesUntilAdjustTotalBytes() {
-	if !c.adjustMu.TryLock() {
-		return
+	}); err != nil {
+		return err
 	}
-	defer c.adjustMu.Unlock()
-	for {
+
+	// Register the least recently used entries first
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].lastAccess.Before(items[j].lastAccess)
+	})
+	for _, wi := range items {
 		select {
-		case <-c.adjustStopCtx.Done():
-			return
+		case <-c.warmUpStopCtx.Done():
+			return nil
 		default:
 		}
-		key := c.d.back()
-		i := c.m.Get(key)
-		if i == nil {
-			continue
-		}
-		ci := i.Value()
-		c.removeCache(ci)
-		c.Delete(key)
-		time.Sleep(1 * time.Millisecond)
 		c.mu.Lock()
-		if c.totalBytes < c.adjustTotalBytes {
+		if _, ok := c.entries[wi.ci.key]; ok {
+			// Stored while warming up
 			c.mu.Unlock()
-			return
+			continue
+		}
+		c.evictForNewKey(wi.ci.key)
+		wi.ci.group = c.group(wi.group)
+		c.setItem(wi.ci, wi.ttl)
+		c.policyAdd(wi.ci)
+		if wi.ci.primary != "" {
+			for _, k := range c.varies.add(wi.ci.primary, wi.vary, wi.ci.key) {
+				c.m.Delete(k)
+			}
 		}
 		c.mu.Unlock()
 	}
+	c.trimGroups()
+	c.mu.Lock()
+	over := c.maxTotalBytes != NoLimitTotalBytes && c.totalBytes > c.maxTotalBytes
+	c.mu.Unlock()
+	if over {
+		// Entries beyond the limit are evicted in the background
+		c.signalEvictor()
+	}
+	return nil
 }
 
+// removeCache is called when the item is deleted from c.m.
 func (c *DiskCache) removeCache(ci *cacheItem) {
+	c.keyMu.LockKey(ci.key)
 	defer func() {
-		c.d.remove(ci.key)
+		_ = c.keyMu.UnlockKey(ci.key) //nostyle:handlerrors
 	}()
-	_ = os.Remove(ci.pathkey + reqCacheSuffix) //nostyle:handlerrors
-	_ = os.Remove(ci.pathkey + resCacheSuffix) //nostyle:handlerrors
-	_ = c.recursiveRemoveDir(ci.pathkey)       //nostyle:handlerrors
+	c.removeEntry(ci)
+}
+
+// removeEntry removes the files of the item and releases its bytes.
+// It does nothing if the item has already been removed or replaced by a new item, whose files are in place.
+// The lock of the key must be held.
+func (c *DiskCache) removeEntry(ci *cacheItem) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.totalBytes < ci.bytes {
-		c.totalBytes = 0
-	} else {
-		c.totalBytes -= ci.bytes
+	if c.entries[ci.key] != ci {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.entries, ci.key)
+	c.purgeIndex.remove(ci)
+	c.removing++
+	c.mu.Unlock()
+	c.policyRemove(ci)
+	if ci.primary != "" {
+		c.varies.remove(ci.primary, ci.key)
 	}
+	c.removeFiles(ci.pathkey)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removing--
+	c.releaseBytes(ci)
+	c.reserveCond.Broadcast()
 }
 
+// removeFiles removes the files of the entry.
+func (c *DiskCache) removeFiles(pathkey string) {
+	_ = os.Remove(pathkey + resCacheSuffix)         //nostyle:handlerrors
+	_ = os.Remove(pathkey + metaCacheSuffix)        //nostyle:handlerrors
+	_ = os.Remove(pathkey + reqCacheSuffix)         //nostyle:handlerrors
+	_ = c.recursiveRemoveDir(filepath.Dir(pathkey)) //nostyle:handlerrors
+}
+
+// recursiveRemoveDir removes dir and its parents up to the cache root as long as they are empty.
 func (c *DiskCache) recursiveRemoveDir(dir string) error {
 	if c.cacheRoot == dir {
 		return nil
 	}
-	parent := filepath.Dir(dir)
-	entries, err := os.ReadDir(parent)
+	entries, err := os.ReadDir(dir)
 	if err != nil {
 		return err
 	}
-	dirs := 0
-	for _, e := range entries {
-		if e.IsDir() {
-			dirs++
-			if dirs > 1 {
-				// There are directories beside it, so delete only itself.
-				if err := os.RemoveAll(dir); err != nil {
-					return err
-				}
-				return nil
-			}
-		}
-	}
-	if parent == c.cacheRoot {
-		if err := os.RemoveAll(dir); err != nil {
-			return err
-		}
+	if len(entries) > 0 {
+		// There are entries in it, so keep it.
 		return nil
 	}
+	if err := os.Remove(dir); err != nil {
+		return err
+	}
 
-	return c.recursiveRemoveDir(parent)
+	return c.recursiveRemoveDir(filepath.Dir(dir))
 }
 
 func isWritable(dir string) (bool, error) {
@@ -3,10 +3,13 @@ package rcutil
 import (
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -120,24 +123,30 @@ func TestDiskCacheMaxTotalBytes(t *testing.T) {
 	if err := os.MkdirAll(cacheRoot, 0755); err != nil {
 		t.Fatal(err)
 	}
-	maxTotalBytes := uint64(209)
+	maxTotalBytes := uint64(400)
 	dc, err := NewDiskCache(cacheRoot, 24*time.Hour, MaxTotalBytes(maxTotalBytes), DisableWarmUp())
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	key := "test1"
-	req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody([]byte("req"))}
-	res := &http.Response{
-		Status:     http.StatusText(http.StatusOK),
-		StatusCode: http.StatusOK,
-		Header:     http.Header{"X-Test": []string{"test"}},
-		Body:       newBody([]byte("hello")),
+	store := func(key string) error {
+		req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody([]byte("req"))}
+		res := &http.Response{
+			Status:     http.StatusText(http.StatusOK),
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"X-Test": []string{"test"}},
+			Body:       newBody([]byte("hello")),
+		}
+		return dc.Store(key, req, res)
 	}
-	if err := dc.Store(key, req, res); err != nil {
+	if err := store("test1"); err != nil {
 		t.Fatal(err)
 	}
-	if err := dc.Store(key, req, res); !errors.Is(err, ErrCacheFull) {
+	// The entry is replaced in place
+	if err := store("test1"); err != nil {
+		t.Error(err)
+	}
+	if err := store("test2"); !errors.Is(err, ErrCacheFull) {
 		t.Error(err)
 	}
 }
@@ -190,10 +199,74 @@ func TestAutoAdjust(t *testing.T) {
 			if dc.maxTotalBytes > maxTotalBytes {
 				t.Errorf("maxTotalBytes: got %d, want %d", dc.maxTotalBytes, maxTotalBytes)
 			}
+			if got := dc.Metrics().TotalBytes; got > maxTotalBytes {
+				t.Errorf("TotalBytes: got %d, want <= %d", got, maxTotalBytes)
+			}
+			// The files are removed before their bytes are released
+			var onDisk uint64
+			if err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return err
+				}
+				fi, err := d.Info()
+				if err != nil {
+					return err
+				}
+				onDisk += uint64(fi.Size())
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if onDisk > maxTotalBytes {
+				t.Errorf("bytes on disk: got %d, want <= %d", onDisk, maxTotalBytes)
+			}
 		})
 	}
 }
 
+func TestDiskCacheDeleteAndStore(t *testing.T) {
+	dc, err := NewDiskCache(t.TempDir(), 24*time.Hour, MaxTotalBytes(1000), DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := func(body string) {
+		req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+		res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte(body))}
+		if err := dc.Store("test", req, res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// TotalBytes is the size of the files of the entry
+	wantBytes := func() uint64 {
+		t.Helper()
+		bytes, err := entryBytes(dc.pathkey("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes
+	}
+	store("hello")
+	// Replacing the entry does not count its bytes twice
+	store("world")
+	if got, want := dc.Metrics().TotalBytes, wantBytes(); got != want {
+		t.Errorf("TotalBytes: got %d, want %d", got, want)
+	}
+	// The files of the entry stored right after Delete are not removed by the eviction of the deleted entry
+	dc.Delete("test")
+	store("again")
+	time.Sleep(100 * time.Millisecond)
+	_, res, err := dc.Load("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readBody(res.Body); got != "again" {
+		t.Errorf("got %q, want %q", got, "again")
+	}
+	if got, want := dc.Metrics().TotalBytes, wantBytes(); got != want {
+		t.Errorf("TotalBytes: got %d, want %d", got, want)
+	}
+}
+
 func TestDiskCacheWarmUp(t *testing.T) {
 	root := t.TempDir()
 	key := "test"
@@ -279,6 +352,252 @@ func TestDiskCacheWarmUp(t *testing.T) {
 	})
 }
 
+func TestDiskCacheWarmUpRestoresMetadata(t *testing.T) {
+	root := t.TempDir()
+	newReqRes := func() (*http.Request, *http.Response) {
+		req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody([]byte("req"))}
+		res := &http.Response{
+			Status:     http.StatusText(http.StatusOK),
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"X-Test": []string{"test"}},
+			Body:       newBody([]byte("hello")),
+		}
+		return req, res
+	}
+	dc0, err := NewDiskCache(root, 24*time.Hour, DisableWarmUp(), DisableAutoCleanup())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttls := map[string]time.Duration{
+		"a":       time.Hour,
+		"b":       2 * time.Hour,
+		"c":       NoLimitTTL,
+		"expired": 10 * time.Millisecond,
+	}
+	for _, key := range []string{"a", "b", "c", "expired"} {
+		req, res := newReqRes()
+		if err := dc0.StoreWithTTL(key, req, res, ttls[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Access order: b, c, a
+	base := time.Now()
+	for i, key := range []string{"b", "c", "a"} {
+		touchMeta(dc0.m.Get(key).Value().pathkey, base.Add(time.Duration(i)*time.Second))
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(root, KeyToPath(SHA256KeyHasher("expired"), DefaultCacheDirLen)+resCacheSuffix)); err != nil {
+		t.Fatal(err)
+	}
+
+	dc1, err := NewDiskCache(root, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-dc1.warmUpDone
+
+	if got := dc1.m.Len(); got != 3 {
+		t.Errorf("got %d keys, want 3", got)
+	}
+	if _, _, err := dc1.Load("expired"); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+	if _, err := os.Stat(filepath.Join(root, KeyToPath(SHA256KeyHasher("expired"), DefaultCacheDirLen)+resCacheSuffix)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expired entry should be removed: %v", err)
+	}
+	for key, ttl := range ttls {
+		if key == "expired" {
+			continue
+		}
+		i := dc1.m.Get(key)
+		if i == nil {
+			t.Errorf("%s is not restored", key)
+			continue
+		}
+		if ttl == NoLimitTTL {
+			if !i.ExpiresAt().IsZero() {
+				t.Errorf("%s: got expiration %v, want none", key, i.ExpiresAt())
+			}
+			continue
+		}
+		want := base.Add(ttl)
+		if d := i.ExpiresAt().Sub(want); d > time.Second || d < -time.Second {
+			t.Errorf("%s: got expiration %v, want %v", key, i.ExpiresAt(), want)
+		}
+	}
+	if got, _ := dc1.policy.Victim(); got != "b" {
+		t.Errorf("got least recently used key %q, want %q", got, "b")
+	}
+}
+
+func TestDiskCacheWarmUpDropsIncompleteEntries(t *testing.T) {
+	appendTo := func(p string) error {
+		f, err := os.OpenFile(p, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write([]byte("replaced")); err != nil {
+			return errors.Join(err, f.Close())
+		}
+		return f.Close()
+	}
+	tests := []struct {
+		name    string
+		mutate  func(pathkey string) error
+		wantHit bool
+	}{
+		{"complete", func(string) error { return nil }, true},
+		{"metadata is missing", func(pathkey string) error { return os.Remove(pathkey + metaCacheSuffix) }, false},
+		{"response is replaced", func(pathkey string) error { return appendTo(pathkey + resCacheSuffix) }, false},
+		{"request is replaced", func(pathkey string) error { return appendTo(pathkey + reqCacheSuffix) }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dc0, err := NewDiskCache(root, 24*time.Hour, DisableWarmUp(), DisableAutoCleanup())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := storeHost(t, dc0, "example.com", "/foo"); err != nil {
+				t.Fatal(err)
+			}
+			pathkey := dc0.pathkey("example.com/foo")
+			if err := tt.mutate(pathkey); err != nil {
+				t.Fatal(err)
+			}
+
+			dc1, err := NewDiskCache(root, 24*time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			<-dc1.warmUpDone
+			_, res, err := dc1.Load("example.com/foo")
+			if !tt.wantHit {
+				if !errors.Is(err, rc.ErrCacheNotFound) {
+					t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+				}
+				if _, err := os.Stat(pathkey + resCacheSuffix); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("incomplete entry should be removed: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+		})
+	}
+}
+
+func TestDiskCacheArbitraryKeys(t *testing.T) {
+	keys := []string{
+		"abcd",
+		"ab/cd",
+		"a/b/c/d",
+		"../../etc/passwd",
+		"get|example.com|/foo|a=1&b=2",
+		"",
+	}
+	tests := []struct {
+		name      string
+		keyHasher KeyHasher
+	}{
+		{"SHA256KeyHasher", SHA256KeyHasher},
+		{"custom", func(key string) string {
+			return fmt.Sprintf("k%x", key)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dc0, err := NewDiskCache(root, 24*time.Hour, UseKeyHasher(tt.keyHasher), DisableWarmUp())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range keys {
+				req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody([]byte("req"))}
+				res := &http.Response{
+					Status:     http.StatusText(http.StatusOK),
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"X-Key": []string{key}},
+					Body:       newBody([]byte("hello")),
+				}
+				if err := dc0.Store(key, req, res); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dc1, err := NewDiskCache(root, 24*time.Hour, UseKeyHasher(tt.keyHasher))
+			if err != nil {
+				t.Fatal(err)
+			}
+			<-dc1.warmUpDone
+			for _, key := range keys {
+				_, res, err := dc1.Load(key)
+				if err != nil {
+					t.Errorf("%q: %v", key, err)
+					continue
+				}
+				if got := res.Header.Get("X-Key"); got != key {
+					t.Errorf("got %q, want %q", got, key)
+				}
+				if err := res.Body.Close(); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDiskCacheReplaceAtAnotherPath(t *testing.T) {
+	root := t.TempDir()
+	dc0, err := NewDiskCache(root, 24*time.Hour, DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+	if err := dc0.Store("key", req, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("old"))}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The entry is warmed up at the path of the previous KeyHasher
+	dc1, err := NewDiskCache(root, 24*time.Hour, UseKeyHasher(func(key string) string {
+		return fmt.Sprintf("k%x", key)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-dc1.warmUpDone
+	if err := dc1.Store("key", req, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("new"))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dc0.pathkey("key") + resCacheSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the replaced file is left: %v", err)
+	}
+	fi, err := os.Stat(dc1.pathkey("key") + resCacheSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqi, err := os.Stat(dc1.pathkey("key") + reqCacheSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metai, err := os.Stat(dc1.pathkey("key") + metaCacheSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dc1.Metrics().TotalBytes, uint64(fi.Size()+reqi.Size()+metai.Size()); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	_, res, err := dc1.Load("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readBody(res.Body); got != "new" {
+		t.Errorf("got %q, want %q", got, "new")
+	}
+}
+
 func TestDiskCacheStopAll(t *testing.T) {
 	root := t.TempDir()
 	cacheRoot := filepath.Join(root, "cache")
@@ -290,6 +609,100 @@ func TestDiskCacheStopAll(t *testing.T) {
 		t.Fatal(err)
 	}
 	dc.StopAll()
+	dc.StopAll()
+}
+
+func TestDiskCacheClose(t *testing.T) {
+	for _, opts := range [][]DiskCacheOption{nil, {DisableAutoCleanup()}} {
+		dc, err := NewDiskCache(t.TempDir(), 24*time.Hour, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dc.Close(); err != nil {
+			t.Error(err)
+		}
+		if err := dc.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDiskCacheStoreInterrupted(t *testing.T) {
+	tests := []struct {
+		name        string
+		fsyncPolicy FsyncPolicy
+	}{
+		{"FsyncNone", FsyncNone},
+		{"FsyncFiles", FsyncFiles},
+		{"FsyncFilesAndDir", FsyncFilesAndDir},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dc, err := NewDiskCache(root, 24*time.Hour, UseFsyncPolicy(tt.fsyncPolicy), DisableWarmUp())
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := "test"
+			req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody([]byte("req"))}
+			res := &http.Response{
+				Status:     http.StatusText(http.StatusOK),
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"X-Test": []string{"test"}},
+				Body:       newBody([]byte("hello")),
+			}
+			if err := dc.Store(key, req, res); err != nil {
+				t.Fatal(err)
+			}
+			before := dc.Metrics().TotalBytes
+
+			// The response body breaks off in the middle of the write.
+			req2 := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody([]byte("req"))}
+			res2 := &http.Response{
+				Status:     http.StatusText(http.StatusOK),
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"X-Test": []string{"test"}},
+				Body:       io.NopCloser(&failingReader{r: strings.NewReader("hello world"), n: 5}),
+			}
+			if err := dc.Store(key, req2, res2); !errors.Is(err, errInterrupted) {
+				t.Errorf("got %v, want %v", err, errInterrupted)
+			}
+
+			_, got, err := dc.Load(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff("hello", readBody(got.Body)); diff != "" {
+				t.Error(diff)
+			}
+			if got := dc.Metrics().TotalBytes; got != before {
+				t.Errorf("got %d, want %d", got, before)
+			}
+			entries, err := os.ReadDir(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if strings.HasPrefix(e.Name(), tmpFilePrefix) {
+					t.Errorf("temporary file remains: %s", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestDiskCacheRemoveTempFiles(t *testing.T) {
+	root := t.TempDir()
+	orphan := filepath.Join(root, tmpFilePrefix+"orphan.tmp")
+	if err := os.WriteFile(orphan, []byte("HTTP/1.1 200 OK\r\nContent-Le"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDiskCache(root, 24*time.Hour, DisableWarmUp()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(orphan); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("orphaned temporary file should be removed: %v", err)
+	}
 }
 
 func TestRecursiveRemoveDir(t *testing.T) {
@@ -378,3 +791,23 @@ func TestRecursiveRemoveDir(t *testing.T) {
 		})
 	}
 }
+
+var errInterrupted = errors.New("interrupted")
+
+// failingReader returns errInterrupted after reading n bytes.
+type failingReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, errInterrupted
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
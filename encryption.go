@@ -0,0 +1,466 @@
+package rcutil
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+)
+
+const (
+	// encryptedMagic is the first bytes of an encrypted cache file. It never starts an HTTP message.
+	encryptedMagic = "\x00RCE"
+	// encryptionSegmentSize is the size of the plaintext sealed at a time.
+	encryptionSegmentSize = 64 * 1024
+	noncePrefixSize       = 7
+)
+
+// EncryptionKey is a key to encrypt cache files with AES-GCM.
+// Key must be 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256.
+// ID is written to the header of each file to select the key to decrypt it with.
+type EncryptionKey struct {
+	ID  string
+	Key []byte
+}
+
+type keyring struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+func newKeyring(current EncryptionKey, previous ...EncryptionKey) (*keyring, error) {
+	kr := &keyring{
+		current: current.ID,
+		aeads:   map[string]cipher.AEAD{},
+	}
+	for _, k := range append([]EncryptionKey{current}, previous...) {
+		if k.ID == "" || len(k.ID) > 255 {
+			return nil, fmt.Errorf("invalid encryption key ID: %q", k.ID)
+		}
+		if _, ok := kr.aeads[k.ID]; ok {
+			return nil, fmt.Errorf("duplicate encryption key ID: %q", k.ID)
+		}
+		block, err := aes.NewCipher(k.Key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		kr.aeads[k.ID] = aead
+	}
+	return kr, nil
+}
+
+// entryAAD returns the additional data that binds the cache file to its entry.
+func (c *DiskCache) entryAAD(key, suffix string) []byte {
+	return []byte(c.keyHasher(key) + suffix)
+}
+
+// metaAAD returns the additional data that binds the metadata file to its path in the cache root.
+// The key can not be used, because the metadata is read to know the key of the entry on warm-up.
+func (c *DiskCache) metaAAD(pathkey string) []byte {
+	if rel, err := filepath.Rel(c.cacheRoot, pathkey); err == nil {
+		pathkey = rel
+	}
+	return []byte(filepath.ToSlash(pathkey) + metaCacheSuffix)
+}
+
+// isEncryptedFile reports whether the file starts with encryptedMagic.
+func isEncryptedFile(p string) bool {
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, len(encryptedMagic))
+	_, err = io.ReadFull(f, magic)
+	return err == nil && string(magic) == encryptedMagic
+}
+
+// writeTempEntryFile is writeTempFile that encrypts the file if encryption is enabled.
+func (c *DiskCache) writeTempEntryFile(p, sum *string, aad []byte, encode func(w io.Writer) error) (uint64, error) {
+	if c.keyring == nil {
+		return c.writeTempFile(p, sum, encode)
+	}
+	return c.writeTempFile(p, sum, func(w io.Writer) error {
+		ew, err := c.keyring.newEncryptWriter(w, aad)
+		if err != nil {
+			return err
+		}
+		if err := encode(ew); err != nil {
+			return err
+		}
+		return ew.Close()
+	})
+}
+
+// openEntryFile opens the cache file.
+// If encryption is enabled, the file is decrypted as it is read in a single pass,
+// and the plaintext of each segment is returned only after the segment is authenticated.
+// A tampered segment fails the read with ErrDecryptionFailed.
+// It fails with the error of ctx if ctx is done before the first segment is authenticated.
+func (c *DiskCache) openEntryFile(ctx context.Context, p string, aad []byte) (io.ReadCloser, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	if c.keyring == nil {
+		return f, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Join(err, f.Close())
+	}
+	r, _, err := c.keyring.newDecryptReader(f, aad)
+	if err != nil {
+		return nil, errors.Join(err, f.Close())
+	}
+	if err := r.fill(); err != nil && !errors.Is(err, io.EOF) {
+		return nil, errors.Join(err, f.Close())
+	}
+	return closer{Reader: r, Closer: f}, nil
+}
+
+// authBody calls onFailure when a segment of the encrypted body fails to be authenticated.
+type authBody struct {
+	io.ReadCloser
+	onFailure func()
+}
+
+func (b *authBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, ErrDecryptionFailed) {
+		b.onFailure()
+	}
+	return n, err
+}
+
+// header returns the header of an encrypted file: magic, key ID length, key ID and nonce prefix.
+func encryptionHeader(keyID string, prefix []byte) []byte {
+	h := make([]byte, 0, len(encryptedMagic)+1+len(keyID)+len(prefix))
+	h = append(h, encryptedMagic...)
+	h = append(h, byte(len(keyID)))
+	h = append(h, keyID...)
+	return append(h, prefix...)
+}
+
+// segmentNonce returns the nonce of the segment: the nonce prefix, the segment counter and the last segment flag.
+// The flag prevents truncation at a segment boundary.
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	aad     []byte
+	buf     []byte
+	counter uint32
+}
+
+func (kr *keyring) newEncryptWriter(w io.Writer, aad []byte) (*encryptWriter, error) {
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header := encryptionHeader(kr.current, prefix)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:      w,
+		aead:   kr.aeads[kr.current],
+		prefix: prefix,
+		aad:    append(header, aad...),
+		buf:    make([]byte, 0, encryptionSegmentSize),
+	}, nil
+}
+
+// Write buffers p and seals full segments.
+// A full segment is sealed only when more data follows, so that the last segment is sealed by Close.
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(w.buf) == encryptionSegmentSize {
+			if err := w.seal(false); err != nil {
+				return 0, err
+			}
+		}
+		l := min(len(p), encryptionSegmentSize-len(w.buf))
+		w.buf = append(w.buf, p[:l]...)
+		p = p[l:]
+	}
+	return n, nil
+}
+
+// Close seals the last segment. It does not close the underlying writer.
+func (w *encryptWriter) Close() error {
+	return w.seal(true)
+}
+
+func (w *encryptWriter) seal(last bool) error {
+	if w.counter == ^uint32(0) {
+		return errors.New("too large to encrypt")
+	}
+	ct := w.aead.Seal(nil, segmentNonce(w.prefix, w.counter, last), w.buf, w.aad)
+	if _, err := w.w.Write(ct); err != nil {
+		return err
+	}
+	w.counter++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+type decryptReader struct {
+	br      *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	aad     []byte
+	seg     []byte
+	buf     []byte
+	counter uint32
+	done    bool
+}
+
+// newDecryptReader returns a reader that decrypts the encrypted file and the key ID of the file.
+func (kr *keyring) newDecryptReader(r io.Reader, aad []byte) (*decryptReader, string, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(encryptedMagic)+1)
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.HasPrefix(magic, []byte(encryptedMagic)) {
+		return nil, "", fmt.Errorf("%w: not encrypted", ErrDecryptionFailed)
+	}
+	rest := make([]byte, int(magic[len(magic)-1])+noncePrefixSize)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return nil, "", fmt.Errorf("%w: broken header", ErrDecryptionFailed)
+	}
+	keyID := string(rest[:len(rest)-noncePrefixSize])
+	aead, ok := kr.aeads[keyID]
+	if !ok {
+		return nil, "", fmt.Errorf("%w: unknown key ID %q", ErrDecryptionFailed, keyID)
+	}
+	prefix := rest[len(rest)-noncePrefixSize:]
+	return &decryptReader{
+		br:     br,
+		aead:   aead,
+		prefix: prefix,
+		aad:    append(encryptionHeader(keyID, prefix), aad...),
+		seg:    make([]byte, encryptionSegmentSize+aead.Overhead()),
+	}, keyID, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if err := r.fill(); err != nil {
+		return 0, err
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// fill authenticates and decrypts the next segment if the plaintext of the current one has been read.
+func (r *decryptReader) fill() error {
+	for len(r.buf) == 0 {
+		if r.done {
+			return io.EOF
+		}
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *decryptReader) open() error {
+	n, err := io.ReadFull(r.br, r.seg)
+	last := false
+	switch {
+	case err == nil:
+		if _, perr := r.br.Peek(1); errors.Is(perr, io.EOF) {
+			last = true
+		} else if perr != nil {
+			return perr
+		}
+	case errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF):
+		last = true
+	default:
+		return err
+	}
+	pt, err := r.aead.Open(r.seg[:0], segmentNonce(r.prefix, r.counter, last), r.seg[:n], r.aad)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDecryptionFailed, err)
+	}
+	r.counter++
+	r.buf = pt
+	r.done = last
+	return nil
+}
+
+// Reencrypt re-encrypts the cache files that are not encrypted with the current key of EnableEncryption,
+// including the files stored before encryption was enabled.
+// Entries that can not be decrypted are deleted.
+func (c *DiskCache) Reencrypt() error {
+	if c.keyring == nil {
+		return errors.New("encryption is not enabled")
+	}
+	var keys []string
+	c.m.Range(func(i *ttlcache.Item[string, *cacheItem]) bool {
+		keys = append(keys, i.Key())
+		return true
+	})
+	var err error
+	for _, key := range keys {
+		if rerr := c.reencryptEntry(key); rerr != nil {
+			c.m.Delete(key)
+			if !errors.Is(rerr, ErrDecryptionFailed) {
+				err = errors.Join(err, rerr)
+			}
+		}
+	}
+	return err
+}
+
+func (c *DiskCache) reencryptEntry(key string) (err error) {
+	c.keyMu.LockKey(key)
+	defer func() {
+		err = errors.Join(err, c.keyMu.UnlockKey(key))
+	}()
+	i := c.m.Get(key, ttlcache.WithDisableTouchOnHit[string, *cacheItem]())
+	if i == nil {
+		return nil
+	}
+	ci := *i.Value()
+	changed := false
+	for _, f := range []struct {
+		suffix string
+		sum    *string
+	}{
+		{reqCacheSuffix, &ci.reqChecksum},
+		{resCacheSuffix, &ci.resChecksum},
+	} {
+		ok, err := c.reencryptFile(ci.pathkey+f.suffix, f.sum, c.entryAAD(key, f.suffix))
+		if err != nil {
+			return err
+		}
+		changed = changed || ok
+	}
+	if !changed {
+		ok, err := c.reencryptFile(ci.pathkey+metaCacheSuffix, nil, c.metaAAD(ci.pathkey))
+		if err != nil || !ok {
+			return err
+		}
+	}
+	// Update the checksums and sizes of the re-encrypted files, which also encrypts the metadata
+	meta, _, err := c.readMeta(ci.pathkey)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	// The sizes of the files change with the key, and the body of an encrypted file can not be read directly
+	bytes, err := entryBytes(ci.pathkey)
+	if err != nil {
+		return err
+	}
+	meta.Bytes, meta.LogicalBytes = bytes, subBytes(ci.logicalBytes+bytes, ci.bytes)
+	meta.BodyOffset, meta.ContentLength = 0, 0
+	meta.RequestChecksum, meta.ResponseChecksum = ci.reqChecksum, ci.resChecksum
+	if err := c.writeMeta(ci.pathkey, meta); err != nil {
+		return err
+	}
+	ci.bytes, ci.logicalBytes = meta.Bytes, meta.LogicalBytes
+	ci.bodyOffset, ci.contentLength = 0, 0
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The bytes of the replaced item are released in place of the new ones
+	c.setItem(&ci, cacheTTL(time.Now(), meta.ExpiresAt, ci.retention))
+	return nil
+}
+
+// entryBytes returns the total size of the files of the entry.
+func entryBytes(pathkey string) (uint64, error) {
+	var bytes uint64
+	for _, suffix := range []string{reqCacheSuffix, resCacheSuffix, metaCacheSuffix} {
+		fi, err := os.Stat(pathkey + suffix)
+		if err != nil {
+			return 0, err
+		}
+		bytes += uint64(fi.Size())
+	}
+	return bytes, nil
+}
+
+// reencryptFile re-encrypts the file with the current key and sets its checksum to sum if sum is not nil.
+// It returns false if the file is already encrypted with the current key.
+func (c *DiskCache) reencryptFile(p string, sum *string, aad []byte) (bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	var r io.Reader = f
+	magic := make([]byte, len(encryptedMagic))
+	if _, err := io.ReadFull(f, magic); err == nil && string(magic) == encryptedMagic {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		dr, keyID, err := c.keyring.newDecryptReader(f, aad)
+		if err != nil {
+			return false, err
+		}
+		if keyID == c.keyring.current {
+			// Only authenticated
+			_, err := io.Copy(io.Discard, dr)
+			return false, err
+		}
+		// Authenticated while it is copied, and the temporary file is removed if it fails
+		r = dr
+	} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	var tmp, newSum string
+	if _, err := c.writeTempEntryFile(&tmp, &newSum, aad, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}); err != nil {
+		if tmp != "" {
+			err = errors.Join(err, os.Remove(tmp))
+		}
+		return false, err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return false, errors.Join(err, os.Remove(tmp))
+	}
+	if sum != nil {
+		*sum = newSum
+	}
+	// Keep the modification time, which is the stored time of entries without metadata
+	return true, os.Chtimes(p, time.Now(), fi.ModTime())
+}
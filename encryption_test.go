@@ -0,0 +1,280 @@
+package rcutil
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2manymws/rc"
+)
+
+var (
+	testKey1 = EncryptionKey{ID: "key1", Key: bytes.Repeat([]byte{1}, 32)}
+	testKey2 = EncryptionKey{ID: "key2", Key: bytes.Repeat([]byte{2}, 16)}
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	kr, err := newKeyring(testKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aad := []byte("aad")
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"small", 10},
+		{"segment", encryptionSegmentSize},
+		{"segment+1", encryptionSegmentSize + 1},
+		{"segments", 3 * encryptionSegmentSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pt := bytes.Repeat([]byte("a"), tt.size)
+			buf := &bytes.Buffer{}
+			ew, err := kr.newEncryptWriter(buf, aad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ew.Write(pt); err != nil {
+				t.Fatal(err)
+			}
+			if err := ew.Close(); err != nil {
+				t.Fatal(err)
+			}
+			ct := buf.Bytes()
+
+			dr, keyID, err := kr.newDecryptReader(bytes.NewReader(ct), aad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keyID != testKey1.ID {
+				t.Errorf("got %q, want %q", keyID, testKey1.ID)
+			}
+			got, err := io.ReadAll(dr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, pt) {
+				t.Errorf("got %d bytes, want %d bytes", len(got), len(pt))
+			}
+
+			tampered := map[string][]byte{
+				"flipped":   append(append([]byte{}, ct[:len(ct)-1]...), ct[len(ct)-1]^1),
+				"truncated": ct[:len(ct)-1],
+				"header":    ct[:len(encryptedMagic)+1+len(testKey1.ID)+noncePrefixSize],
+			}
+			if tt.size > encryptionSegmentSize {
+				// Truncated at a segment boundary
+				last := tt.size - (tt.size-1)/encryptionSegmentSize*encryptionSegmentSize
+				tampered["segment"] = ct[:len(ct)-last-16]
+			}
+			verify := func(b, aad []byte) error {
+				dr, _, err := kr.newDecryptReader(bytes.NewReader(b), aad)
+				if err != nil {
+					return err
+				}
+				_, err = io.Copy(io.Discard, dr)
+				return err
+			}
+			for name, b := range tampered {
+				if err := verify(b, aad); !errors.Is(err, ErrDecryptionFailed) {
+					t.Errorf("%s: got %v, want %v", name, err, ErrDecryptionFailed)
+				}
+			}
+			if err := verify(ct, []byte("other")); !errors.Is(err, ErrDecryptionFailed) {
+				t.Errorf("got %v, want %v", err, ErrDecryptionFailed)
+			}
+		})
+	}
+}
+
+func TestDiskCacheEncryption(t *testing.T) {
+	root := t.TempDir()
+	dc, err := NewDiskCache(root, 1*time.Hour, EnableEncryption(testKey1), DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Repeat("hello", 20000)
+	newReq := func() *http.Request {
+		return &http.Request{Method: http.MethodGet, Header: http.Header{"X-Secret": {"secret"}}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+	}
+	newRes := func() *http.Response {
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"X-Test": {"test"}}, Body: newBody([]byte(body)), ContentLength: int64(len(body))}
+	}
+	for _, key := range []string{"a", "b", "get|a|/x|token=secret"} {
+		if err := dc.Store(key, newReq(), newRes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The metadata is encrypted too, because it includes the key
+	if err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(b, []byte("secret")) {
+			t.Errorf("%s is not encrypted", p)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pathkey := dc.pathkey("a")
+	for _, suffix := range []string{reqCacheSuffix, resCacheSuffix} {
+		b, err := os.ReadFile(pathkey + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(b, []byte("secret")) || bytes.Contains(b, []byte("hello")) {
+			t.Errorf("%s is not encrypted", suffix)
+		}
+	}
+
+	req, res, err := dc.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("X-Secret"); got != "secret" {
+		t.Errorf("got %q, want %q", got, "secret")
+	}
+	if got := readBody(res.Body); got != body {
+		t.Errorf("got %d bytes, want %d bytes", len(got), len(body))
+	}
+
+	// Files swapped between entries are not authenticated
+	b, err := os.ReadFile(dc.pathkey("b") + resCacheSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pathkey+resCacheSuffix, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := dc.Load("a"); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+
+	// Tampered files are treated as misses
+	b[len(b)/2] ^= 1
+	if err := os.WriteFile(dc.pathkey("b")+resCacheSuffix, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := dc.Load("b"); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+
+	// A body tampered after the first segment fails the read, and the entry is deleted
+	key := "get|a|/x|token=secret"
+	b, err = os.ReadFile(dc.pathkey(key) + resCacheSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 1
+	if err := os.WriteFile(dc.pathkey(key)+resCacheSuffix, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, res, err = dc.Load(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(res.Body); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("got %v, want %v", err, ErrDecryptionFailed)
+	}
+	res.Body.Close()
+	if _, _, err := dc.Load(key); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+
+	if _, err := NewDiskCache(root, 1*time.Hour, EnableEncryption(EncryptionKey{ID: "invalid", Key: []byte("short")})); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestDiskCacheReencrypt(t *testing.T) {
+	root := t.TempDir()
+	req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+	newRes := func() *http.Response {
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("hello")), ContentLength: 5}
+	}
+	open := func(t *testing.T, opts ...DiskCacheOption) *DiskCache {
+		t.Helper()
+		dc, err := NewDiskCache(root, 1*time.Hour, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-dc.warmUpDone
+		return dc
+	}
+	load := func(t *testing.T, dc *DiskCache, key string) error {
+		t.Helper()
+		_, res, err := dc.Load(key)
+		if err != nil {
+			return err
+		}
+		if got := readBody(res.Body); got != "hello" {
+			t.Errorf("got %q, want %q", got, "hello")
+		}
+		return nil
+	}
+
+	dc := open(t)
+	if err := dc.Store("plain", req, newRes()); err != nil {
+		t.Fatal(err)
+	}
+	dc = open(t, EnableEncryption(testKey1))
+	if err := dc.Store("key1", req, newRes()); err != nil {
+		t.Fatal(err)
+	}
+
+	dc = open(t, EnableEncryption(testKey2, testKey1), EnableChecksum(ChecksumCRC32C))
+	if err := load(t, dc, "key1"); err != nil {
+		t.Errorf("files encrypted with the previous key should be loaded: %v", err)
+	}
+	if err := dc.Reencrypt(); err != nil {
+		t.Fatal(err)
+	}
+	var want uint64
+	for _, key := range []string{"plain", "key1"} {
+		bytes, err := entryBytes(dc.pathkey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want += bytes
+	}
+	dc.mu.Lock()
+	got := dc.totalBytes
+	dc.mu.Unlock()
+	if got != want {
+		t.Errorf("got totalBytes %d, want %d", got, want)
+	}
+
+	dc = open(t, EnableEncryption(testKey2), EnableChecksum(ChecksumCRC32C))
+	for _, key := range []string{"plain", "key1"} {
+		// Checksums of the re-encrypted files are updated
+		if err := dc.Verify(key); err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+		if err := load(t, dc, key); err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+		if !isEncryptedFile(dc.pathkey(key) + metaCacheSuffix) {
+			t.Errorf("%s: metadata is not encrypted", key)
+		}
+	}
+
+	if err := open(t).Reencrypt(); err == nil {
+		t.Error("want error")
+	}
+}
@@ -4,3 +4,18 @@ import "errors"
 
 // ErrCacheFull is returned if the cache is full
 var ErrCacheFull error = errors.New("cache full")
+
+// ErrNotAdmitted is returned if the response is rejected by the admission control
+var ErrNotAdmitted error = errors.New("not admitted")
+
+// ErrUncacheableVary is returned if the response has Vary: *
+var ErrUncacheableVary error = errors.New("uncacheable response with Vary: *")
+
+// ErrBodyNotSeekable is returned if the body of the response does not support random access
+var ErrBodyNotSeekable error = errors.New("body is not seekable")
+
+// ErrDecryptionFailed is returned if the cache file can not be decrypted or authenticated
+var ErrDecryptionFailed error = errors.New("failed to decrypt cache file")
+
+// ErrChecksumMismatch is returned if the checksum of the cache file does not match
+var ErrChecksumMismatch error = errors.New("checksum mismatch")
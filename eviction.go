@@ -0,0 +1,661 @@
+package rcutil
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"fmt"
+	"hash/maphash"
+)
+
+// EvictionPolicy decides which entry is evicted when the cache exceeds MaxKeys or MaxTotalBytes.
+// DiskCache serializes the calls, so implementations do not have to be goroutine-safe.
+type EvictionPolicy interface {
+	// Add records that the entry of key has been stored. bytes is the size of the entry on disk.
+	// The key may already exist when the entry is replaced.
+	Add(key string, bytes uint64)
+	// Access records that the entry of key has been loaded.
+	Access(key string)
+	// Remove forgets the entry of key. The key may not exist.
+	Remove(key string)
+	// Victim returns the key of the entry to be evicted next. It returns false if there are no entries.
+	// It is called only when an entry is about to be evicted, so the policy may update its state.
+	Victim() (string, bool)
+}
+
+// policyAdd adds the item to the eviction policies of the cache and its group.
+func (c *DiskCache) policyAdd(ci *cacheItem) {
+	c.policyMu.Lock()
+	defer c.policyMu.Unlock()
+	c.policy.Add(ci.key, ci.bytes)
+	if ci.group != nil {
+		ci.group.policy.Add(ci.key, ci.bytes)
+	}
+}
+
+func (c *DiskCache) policyAccess(ci *cacheItem) {
+	c.policyMu.Lock()
+	defer c.policyMu.Unlock()
+	c.policy.Access(ci.key)
+	if ci.group != nil {
+		ci.group.policy.Access(ci.key)
+	}
+}
+
+func (c *DiskCache) policyRemove(ci *cacheItem) {
+	c.policyMu.Lock()
+	defer c.policyMu.Unlock()
+	c.policy.Remove(ci.key)
+	if ci.group != nil {
+		ci.group.policy.Remove(ci.key)
+	}
+}
+
+// evict removes the victim of the eviction policy of the group, or of the cache if g is nil, from the policy and returns it.
+// The victim is removed from the other policy when its entry is removed.
+func (c *DiskCache) evict(g *quotaGroup) (string, bool) {
+	c.policyMu.Lock()
+	defer c.policyMu.Unlock()
+	p := c.policy
+	if g != nil {
+		p = g.policy
+	}
+	key, ok := p.Victim()
+	if ok {
+		p.Remove(key)
+	}
+	return key, ok
+}
+
+// evictForNewKey evicts entries until key can be added without exceeding maxKeys.
+// c.mu must be held.
+func (c *DiskCache) evictForNewKey(key string) {
+	if c.maxKeys == NoLimitKeys || c.m.Has(key) {
+		return
+	}
+	for uint64(c.m.Len()) >= c.maxKeys {
+		victim, ok := c.evict(nil)
+		if !ok {
+			return
+		}
+		c.m.Delete(victim)
+	}
+}
+
+// reservation is the space reserved for an entry to be committed.
+type reservation struct {
+	group *quotaGroup
+	bytes uint64
+}
+
+// reserve reserves n bytes for the entry of key to be committed in the group, so that the total bytes never exceed
+// maxTotalBytes and the group never exceeds its quota. The entry that it replaces is not counted.
+// If the entry does not fit in the group, it evicts entries of the group synchronously until the entry fits.
+// If the entry does not fit in the cache and auto-adjust is enabled, it evicts entries synchronously until the entry fits
+// and lets the evictor evict the rest down to adjustTotalBytes. Otherwise, it returns ErrCacheFull.
+// It returns nil if there is nothing to reserve, or the error of ctx if ctx is done while it evicts or waits.
+// It must not be called with the lock of any key held, because the eviction takes the locks of the victims.
+func (c *DiskCache) reserve(ctx context.Context, key, group string, n uint64) (_ *reservation, err error) {
+	if c.maxTotalBytes == NoLimitTotalBytes && c.quotaGroupFunc == nil {
+		return nil, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var g *quotaGroup
+	defer func() {
+		if err != nil && g != nil {
+			c.dropGroup(g)
+		}
+	}()
+	for {
+		old := c.entries[key]
+		// The group is looked up every time, because an empty group may be dropped while waiting
+		g = c.group(group)
+		if g != nil && g.full(old, n) {
+			if g.quota.MaxTotalBytes != NoLimitTotalBytes && n > g.quota.MaxTotalBytes {
+				// group is full
+				return nil, fmt.Errorf("%w (%d bytes > %d bytes of group %q)", ErrCacheFull, n, g.quota.MaxTotalBytes, group)
+			}
+			ok, err := c.evictOrWait(ctx, g)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				// group is full
+				return nil, fmt.Errorf("%w (group %q)", ErrCacheFull, group)
+			}
+			continue
+		}
+		if c.maxTotalBytes != NoLimitTotalBytes {
+			used := c.totalBytes + c.reservedBytes
+			var replaced uint64
+			if old != nil {
+				replaced = old.bytes
+			}
+			if used+n > c.maxTotalBytes+replaced {
+				if !c.enableAutoAdjust || n > c.maxTotalBytes || c.adjustStopCtx.Err() != nil {
+					// cache is full
+					return nil, fmt.Errorf("%w (%d bytes > %d bytes)", ErrCacheFull, used+n, c.maxTotalBytes)
+				}
+				c.signalEvictor()
+				ok, err := c.evictOrWait(ctx, nil)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					// cache is full
+					return nil, fmt.Errorf("%w (%d bytes > %d bytes)", ErrCacheFull, used+n, c.maxTotalBytes)
+				}
+				continue
+			}
+		}
+		c.reservedBytes += n
+		if g != nil {
+			g.reservedKeys++
+			g.reservedBytes += n
+		}
+		return &reservation{group: g, bytes: n}, nil
+	}
+}
+
+// evictOrWait evicts an entry of the group, or of the cache if g is nil. If there are no entries to evict, it waits for
+// the entries being committed to be evictable or the entries being evicted to be removed.
+// It returns false if there is nothing to wait for, or the error of ctx if ctx is done. c.mu must be held.
+func (c *DiskCache) evictOrWait(ctx context.Context, g *quotaGroup) (bool, error) {
+	c.mu.Unlock()
+	evicted, err := c.evictOne(ctx, g)
+	c.mu.Lock()
+	if err != nil {
+		return false, err
+	}
+	if evicted {
+		return true, nil
+	}
+	if g != nil {
+		if g.keys == 0 && g.reservedKeys == 0 && c.removing == 0 {
+			return false, nil
+		}
+	} else if len(c.entries) == 0 && c.reservedBytes == 0 && c.removing == 0 {
+		return false, nil
+	}
+	if err := c.waitReserve(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// waitReserve waits for reserveCond to be broadcast, or returns the error of ctx if ctx is done. c.mu must be held.
+func (c *DiskCache) waitReserve(ctx context.Context) error {
+	if ctx.Done() != nil {
+		// Wake up the waiters to let them see ctx is done
+		stop := context.AfterFunc(ctx, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.reserveCond.Broadcast()
+		})
+		defer stop()
+	}
+	c.reserveCond.Wait()
+	return ctx.Err()
+}
+
+// release releases the space reserved by reserve. c.mu must be held.
+func (c *DiskCache) release(r *reservation) {
+	if r == nil {
+		return
+	}
+	c.reservedBytes -= r.bytes
+	if g := r.group; g != nil {
+		g.reservedKeys--
+		g.reservedBytes -= r.bytes
+		c.dropGroup(g)
+	}
+	c.reserveCond.Broadcast()
+}
+
+// evictOne evicts the victim of the eviction policy of the group, or of the cache if g is nil.
+// It returns false if there are no entries to evict, or the error of ctx if ctx is done while it waits for the lock of the victim.
+// It must not be called with the lock of any key held.
+func (c *DiskCache) evictOne(ctx context.Context, g *quotaGroup) (bool, error) {
+	key, ok := c.evict(g)
+	if !ok {
+		return false, nil
+	}
+	if err := c.lockKey(ctx, key); err != nil {
+		// The victim has been removed from the policy, so it is evicted in the background
+		go func() {
+			c.keyMu.LockKey(key)
+			c.evictKey(key, g)
+			_ = c.keyMu.UnlockKey(key) //nostyle:handlerrors
+		}()
+		return false, err
+	}
+	defer func() {
+		_ = c.keyMu.UnlockKey(key) //nostyle:handlerrors
+	}()
+	c.evictKey(key, g)
+	return true, nil
+}
+
+// evictKey evicts the entry of key. The lock of the key must be held.
+func (c *DiskCache) evictKey(key string, g *quotaGroup) {
+	c.mu.Lock()
+	ci, ok := c.entries[key]
+	if ok && g != nil {
+		g.evictions++
+	}
+	c.mu.Unlock()
+	if ok {
+		c.m.Delete(key)
+		c.removeEntry(ci)
+	}
+}
+
+// signalEvictor wakes up the evictor if auto-adjust is enabled.
+func (c *DiskCache) signalEvictor() {
+	if !c.enableAutoAdjust {
+		return
+	}
+	select {
+	case c.evictCh <- struct{}{}:
+	default:
+	}
+}
+
+// runEvictor evicts entries until the total bytes fall to adjustTotalBytes (the low watermark)
+// each time it is signaled, until StopAdjust is called.
+func (c *DiskCache) runEvictor() {
+	for {
+		select {
+		case <-c.adjustStopCtx.Done():
+			return
+		case <-c.evictCh:
+		}
+		for {
+			if c.adjustStopCtx.Err() != nil {
+				return
+			}
+			c.mu.Lock()
+			done := c.totalBytes+c.reservedBytes <= c.adjustTotalBytes
+			c.mu.Unlock()
+			if done {
+				break
+			}
+			if evicted, _ := c.evictOne(context.Background(), nil); !evicted {
+				break
+			}
+		}
+	}
+}
+
+type lruPolicy struct {
+	m   map[string]*list.Element
+	lru *list.List
+}
+
+// NewLRUPolicy returns an EvictionPolicy that evicts the least recently stored or loaded entry.
+func NewLRUPolicy() EvictionPolicy {
+	return &lruPolicy{
+		m:   make(map[string]*list.Element),
+		lru: list.New(),
+	}
+}
+
+func (p *lruPolicy) Add(key string, _ uint64) {
+	if e, ok := p.m[key]; ok {
+		p.lru.MoveToFront(e)
+		return
+	}
+	p.m[key] = p.lru.PushFront(key)
+}
+
+func (p *lruPolicy) Access(key string) {
+	if e, ok := p.m[key]; ok {
+		p.lru.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy) Remove(key string) {
+	e, ok := p.m[key]
+	if !ok {
+		return
+	}
+	p.lru.Remove(e)
+	delete(p.m, key)
+}
+
+func (p *lruPolicy) Victim() (string, bool) {
+	e := p.lru.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
+
+// priorityEntry is an entry of priorityQueue.
+type priorityEntry struct {
+	key      string
+	bytes    uint64
+	hits     uint64
+	priority float64
+	// seq breaks ties of priority in the order of the last access.
+	seq   uint64
+	index int
+}
+
+// priorityQueue is a min-heap of entries ordered by priority and seq.
+type priorityQueue []*priorityEntry
+
+func (q priorityQueue) Len() int { return len(q) }
+
+func (q priorityQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority < q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q priorityQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *priorityQueue) Push(x any) {
+	e := x.(*priorityEntry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *priorityQueue) Pop() any {
+	old := *q
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return e
+}
+
+// priorityPolicy evicts the entry with the lowest priority.
+type priorityPolicy struct {
+	m map[string]*priorityEntry
+	q priorityQueue
+	// seq is incremented on each Add and Access.
+	seq uint64
+	// inflation is added to priorities by GreedyDual-Size.
+	inflation float64
+	priority  func(p *priorityPolicy, e *priorityEntry) float64
+	onVictim  func(p *priorityPolicy, e *priorityEntry)
+}
+
+// NewLFUPolicy returns an EvictionPolicy that evicts the least frequently loaded entry.
+// Ties are broken by evicting the least recently used entry.
+func NewLFUPolicy() EvictionPolicy {
+	return &priorityPolicy{
+		m: make(map[string]*priorityEntry),
+		priority: func(_ *priorityPolicy, e *priorityEntry) float64 {
+			return float64(e.hits)
+		},
+	}
+}
+
+// NewGreedyDualSizePolicy returns an EvictionPolicy of GreedyDual-Size.
+// The priority of an entry is L + 1/size, where L is the priority of the last evicted entry,
+// so it evicts large entries first and entries that have not been loaded for a while over time.
+// It favors the hit ratio over the byte hit ratio.
+func NewGreedyDualSizePolicy() EvictionPolicy {
+	return &priorityPolicy{
+		m: make(map[string]*priorityEntry),
+		priority: func(p *priorityPolicy, e *priorityEntry) float64 {
+			return p.inflation + 1/float64(max(e.bytes, 1))
+		},
+		onVictim: func(p *priorityPolicy, e *priorityEntry) {
+			p.inflation = e.priority
+		},
+	}
+}
+
+func (p *priorityPolicy) Add(key string, bytes uint64) {
+	p.seq++
+	if e, ok := p.m[key]; ok {
+		e.bytes = bytes
+		e.hits++
+		e.seq = p.seq
+		e.priority = p.priority(p, e)
+		heap.Fix(&p.q, e.index)
+		return
+	}
+	e := &priorityEntry{key: key, bytes: bytes, seq: p.seq}
+	e.priority = p.priority(p, e)
+	p.m[key] = e
+	heap.Push(&p.q, e)
+}
+
+func (p *priorityPolicy) Access(key string) {
+	e, ok := p.m[key]
+	if !ok {
+		return
+	}
+	p.seq++
+	e.hits++
+	e.seq = p.seq
+	e.priority = p.priority(p, e)
+	heap.Fix(&p.q, e.index)
+}
+
+func (p *priorityPolicy) Remove(key string) {
+	e, ok := p.m[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&p.q, e.index)
+	delete(p.m, key)
+}
+
+func (p *priorityPolicy) Victim() (string, bool) {
+	if len(p.q) == 0 {
+		return "", false
+	}
+	e := p.q[0]
+	if p.onVictim != nil {
+		p.onVictim(p, e)
+	}
+	return e.key, true
+}
+
+type tinyLFUSegment int
+
+const (
+	tinyLFUWindow tinyLFUSegment = iota
+	tinyLFUProbation
+	tinyLFUProtected
+)
+
+type tinyLFUEntry struct {
+	key     string
+	segment tinyLFUSegment
+	// candidate is true while the entry moved from the window has not been compared with a victim yet.
+	candidate bool
+}
+
+// tinyLFUPolicy is W-TinyLFU.
+// New entries enter the window LRU, and entries that overflow the window become candidates in the probation segment of the main SLRU.
+// On eviction, a candidate is compared with the victim of the main SLRU by the estimated frequency and the less frequent one is evicted.
+type tinyLFUPolicy struct {
+	m         map[string]*list.Element
+	window    *list.List
+	probation *list.List
+	protected *list.List
+	sketch    *countMinSketch
+}
+
+// NewTinyLFUPolicy returns an EvictionPolicy of W-TinyLFU.
+// It admits a new entry only if it is estimated to be loaded more frequently than the entry it replaces,
+// so it keeps frequently loaded entries against scans.
+// expectedKeys is the expected number of keys in the cache, which sizes the frequency sketch.
+func NewTinyLFUPolicy(expectedKeys int) EvictionPolicy {
+	return &tinyLFUPolicy{
+		m:         make(map[string]*list.Element),
+		window:    list.New(),
+		probation: list.New(),
+		protected: list.New(),
+		sketch:    newCountMinSketch(expectedKeys),
+	}
+}
+
+func (p *tinyLFUPolicy) Add(key string, _ uint64) {
+	if _, ok := p.m[key]; ok {
+		p.Access(key)
+		return
+	}
+	p.sketch.increment(key)
+	p.m[key] = p.window.PushFront(&tinyLFUEntry{key: key})
+	// The window is 1% of the entries
+	for p.window.Len() > max(len(p.m)/100, 1) {
+		e := p.window.Back()
+		te := e.Value.(*tinyLFUEntry)
+		p.window.Remove(e)
+		te.segment = tinyLFUProbation
+		te.candidate = true
+		p.m[te.key] = p.probation.PushFront(te)
+	}
+}
+
+func (p *tinyLFUPolicy) Access(key string) {
+	e, ok := p.m[key]
+	if !ok {
+		return
+	}
+	p.sketch.increment(key)
+	te := e.Value.(*tinyLFUEntry)
+	switch te.segment {
+	case tinyLFUWindow:
+		p.window.MoveToFront(e)
+	case tinyLFUProtected:
+		p.protected.MoveToFront(e)
+	case tinyLFUProbation:
+		p.probation.Remove(e)
+		te.segment = tinyLFUProtected
+		te.candidate = false
+		p.m[key] = p.protected.PushFront(te)
+		// The protected segment is 80% of the main SLRU
+		for p.protected.Len() > max((p.probation.Len()+p.protected.Len())*4/5, 1) {
+			e := p.protected.Back()
+			te := e.Value.(*tinyLFUEntry)
+			p.protected.Remove(e)
+			te.segment = tinyLFUProbation
+			p.m[te.key] = p.probation.PushFront(te)
+		}
+	}
+}
+
+func (p *tinyLFUPolicy) Remove(key string) {
+	e, ok := p.m[key]
+	if !ok {
+		return
+	}
+	p.segment(e.Value.(*tinyLFUEntry).segment).Remove(e)
+	delete(p.m, key)
+}
+
+func (p *tinyLFUPolicy) Victim() (string, bool) {
+	var victim *list.Element
+	for _, l := range []*list.List{p.probation, p.protected, p.window} {
+		if victim = l.Back(); victim != nil {
+			break
+		}
+	}
+	if victim == nil {
+		return "", false
+	}
+	vte := victim.Value.(*tinyLFUEntry)
+	cand := p.probation.Front()
+	if cand == nil || cand == victim || !cand.Value.(*tinyLFUEntry).candidate {
+		return vte.key, true
+	}
+	cte := cand.Value.(*tinyLFUEntry)
+	if p.sketch.estimate(cte.key) > p.sketch.estimate(vte.key) {
+		// Admit the candidate
+		cte.candidate = false
+		return vte.key, true
+	}
+	return cte.key, true
+}
+
+func (p *tinyLFUPolicy) segment(s tinyLFUSegment) *list.List {
+	switch s {
+	case tinyLFUProbation:
+		return p.probation
+	case tinyLFUProtected:
+		return p.protected
+	default:
+		return p.window
+	}
+}
+
+const (
+	sketchDepth      = 4
+	sketchMaxCounter = 15
+)
+
+// countMinSketch estimates the frequencies of keys with 4-bit saturating counters.
+// The counters are halved periodically so that the frequencies age.
+type countMinSketch struct {
+	rows    [sketchDepth][]uint8
+	mask    uint64
+	seed    maphash.Seed
+	adds    int
+	resetAt int
+}
+
+func newCountMinSketch(n int) *countMinSketch {
+	// 4 counters per key in each row keep the collisions with keys not in the cache low
+	width := 16
+	for width < 4*n {
+		width <<= 1
+	}
+	s := &countMinSketch{
+		mask:    uint64(width - 1),
+		seed:    maphash.MakeSeed(),
+		resetAt: 10 * width,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *countMinSketch) indexes(key string) [sketchDepth]uint64 {
+	h := maphash.String(s.seed, key)
+	h1, h2 := h, h>>32|1
+	var idx [sketchDepth]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return idx
+}
+
+func (s *countMinSketch) increment(key string) {
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < sketchMaxCounter {
+			s.rows[i][j]++
+		}
+	}
+	s.adds++
+	if s.adds >= s.resetAt {
+		for _, row := range s.rows {
+			for j := range row {
+				row[j] >>= 1
+			}
+		}
+		s.adds /= 2
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	est := uint8(sketchMaxCounter)
+	for i, j := range s.indexes(key) {
+		est = min(est, s.rows[i][j])
+	}
+	return est
+}
@@ -0,0 +1,272 @@
+package rcutil
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2manymws/rc"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEvictionPolicies(t *testing.T) {
+	type op struct {
+		add    string
+		bytes  uint64
+		access string
+		remove string
+		evict  bool
+	}
+	tests := []struct {
+		name    string
+		policy  EvictionPolicy
+		ops     []op
+		victims []string
+	}{
+		{
+			"lru",
+			NewLRUPolicy(),
+			[]op{{add: "a"}, {add: "b"}, {add: "c"}, {access: "a"}},
+			[]string{"b", "c", "a"},
+		},
+		{
+			"lru replaced",
+			NewLRUPolicy(),
+			[]op{{add: "a"}, {add: "b"}, {add: "a"}, {remove: "b"}},
+			[]string{"a"},
+		},
+		{
+			"lfu",
+			NewLFUPolicy(),
+			[]op{{add: "a"}, {add: "b"}, {add: "c"}, {access: "a"}, {access: "a"}, {access: "c"}},
+			[]string{"b", "c", "a"},
+		},
+		{
+			"greedy dual size",
+			NewGreedyDualSizePolicy(),
+			[]op{{add: "a", bytes: 100}, {add: "b", bytes: 10}, {add: "c", bytes: 1000}},
+			[]string{"c", "a", "b"},
+		},
+		{
+			"greedy dual size ages entries",
+			NewGreedyDualSizePolicy(),
+			// After b is evicted, d of the same size as a outlives a
+			[]op{{add: "a", bytes: 100}, {add: "b", bytes: 1000}, {add: "c", bytes: 10}, {evict: true}, {add: "d", bytes: 100}},
+			[]string{"b", "a", "d", "c"},
+		},
+		{
+			"tinylfu",
+			NewTinyLFUPolicy(100),
+			// c is a candidate that is not more frequent than the victim b, and a is protected
+			[]op{{add: "a"}, {add: "b"}, {add: "c"}, {access: "a"}, {access: "a"}, {add: "d"}},
+			[]string{"c", "b", "a", "d"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			evict := func() bool {
+				key, ok := tt.policy.Victim()
+				if !ok {
+					return false
+				}
+				got = append(got, key)
+				tt.policy.Remove(key)
+				return true
+			}
+			for _, o := range tt.ops {
+				switch {
+				case o.add != "":
+					tt.policy.Add(o.add, o.bytes)
+				case o.access != "":
+					tt.policy.Access(o.access)
+				case o.remove != "":
+					tt.policy.Remove(o.remove)
+				case o.evict:
+					evict()
+				}
+			}
+			for evict() {
+			}
+			if diff := cmp.Diff(tt.victims, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestTinyLFUPolicyAdmission(t *testing.T) {
+	p := NewTinyLFUPolicy(100)
+	for i := 0; i < 100; i++ {
+		p.Add(fmt.Sprintf("hot%d", i), 0)
+		for j := 0; j < 5; j++ {
+			p.Access(fmt.Sprintf("hot%d", i))
+		}
+	}
+	// A scan of cold keys evicts cold keys except the hot key in the window and a few hot keys
+	// whose frequencies are overestimated for cold keys by collisions in the sketch, while LRU evicts all of them
+	evicted := 0
+	for i := 0; i < 1000; i++ {
+		p.Add(fmt.Sprintf("cold%d", i), 0)
+		key, ok := p.Victim()
+		if !ok {
+			t.Fatal("no victim")
+		}
+		p.Remove(key)
+		if strings.HasPrefix(key, "hot") {
+			evicted++
+		}
+	}
+	if evicted >= 10 {
+		t.Errorf("%d hot keys are evicted by a scan", evicted)
+	}
+}
+
+func TestDiskCacheEvictionPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []DiskCacheOption
+		loads  []string
+		wantNF string
+	}{
+		{"default lru", nil, []string{"a"}, "b"},
+		{"lfu", []DiskCacheOption{UseEvictionPolicy(NewLFUPolicy())}, []string{"b", "b", "a"}, "a"},
+		{"lfu breaks ties by recency", []DiskCacheOption{UseEvictionPolicy(NewLFUPolicy())}, []string{"b", "a"}, "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]DiskCacheOption{MaxKeys(2), DisableWarmUp()}, tt.opts...)
+			dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := func(key string) {
+				req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/" + key}, Body: newBody(nil)}
+				res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("hello"))}
+				if err := dc.Store(key, req, res); err != nil {
+					t.Fatal(err)
+				}
+			}
+			store("a")
+			store("b")
+			for _, key := range tt.loads {
+				_, res, err := dc.Load(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_ = readBody(res.Body)
+			}
+			store("c")
+			for _, key := range []string{"a", "b", "c"} {
+				_, res, err := dc.Load(key)
+				if key == tt.wantNF {
+					if !errors.Is(err, rc.ErrCacheNotFound) {
+						t.Errorf("%s: got %v, want %v", key, err, rc.ErrCacheNotFound)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("%s: %v", key, err)
+					continue
+				}
+				_ = readBody(res.Body)
+			}
+		})
+	}
+
+	if _, err := NewDiskCache(t.TempDir(), 1*time.Hour, UseEvictionPolicy(nil)); err == nil {
+		t.Error("want error")
+	}
+}
+
+type traceRequest struct {
+	key   string
+	bytes uint64
+}
+
+// zipfTrace returns a trace of requests whose keys follow a Zipf distribution.
+// If scan is true, one-time keys are requested in every other 10000 requests.
+func zipfTrace(n int, scan bool) []traceRequest {
+	r := rand.New(rand.NewSource(1))
+	z := rand.NewZipf(r, 1.1, 1, 9999)
+	trace := make([]traceRequest, 0, n)
+	for i := 0; i < n; i++ {
+		if scan && i/10000%2 == 1 {
+			trace = append(trace, traceRequest{key: fmt.Sprintf("scan%d", i), bytes: 4096})
+			continue
+		}
+		k := z.Uint64()
+		// Sizes are from 1KiB to 64KiB and fixed for each key
+		trace = append(trace, traceRequest{key: fmt.Sprintf("key%d", k), bytes: 1024 << (k * 2654435761 % 7)})
+	}
+	return trace
+}
+
+// replay replays the trace against the policy with the capacity in bytes and returns the hit ratio.
+func replay(p EvictionPolicy, trace []traceRequest, capacity uint64) float64 {
+	cached := map[string]uint64{}
+	var used uint64
+	hits := 0
+	for _, r := range trace {
+		if _, ok := cached[r.key]; ok {
+			hits++
+			p.Access(r.key)
+			continue
+		}
+		cached[r.key] = r.bytes
+		used += r.bytes
+		p.Add(r.key, r.bytes)
+		for used > capacity {
+			key, ok := p.Victim()
+			if !ok {
+				break
+			}
+			p.Remove(key)
+			used -= cached[key]
+			delete(cached, key)
+		}
+	}
+	return float64(hits) / float64(len(trace))
+}
+
+var evictionPolicies = []struct {
+	name      string
+	newPolicy func() EvictionPolicy
+}{
+	{"lru", NewLRUPolicy},
+	{"lfu", NewLFUPolicy},
+	{"greedy_dual_size", NewGreedyDualSizePolicy},
+	{"tinylfu", func() EvictionPolicy { return NewTinyLFUPolicy(1000) }},
+}
+
+func TestEvictionPolicyHitRatio(t *testing.T) {
+	trace := zipfTrace(100000, true)
+	ratios := map[string]float64{}
+	for _, ep := range evictionPolicies {
+		ratios[ep.name] = replay(ep.newPolicy(), trace, 16<<20)
+	}
+	t.Log(ratios)
+	if ratios["tinylfu"] <= ratios["lru"] {
+		t.Errorf("tinylfu (%f) should beat lru (%f) on a trace with scans", ratios["tinylfu"], ratios["lru"])
+	}
+}
+
+func BenchmarkEvictionPolicyHitRatio(b *testing.B) {
+	for _, scan := range []bool{false, true} {
+		trace := zipfTrace(100000, scan)
+		for _, ep := range evictionPolicies {
+			b.Run(fmt.Sprintf("%s/scan=%v", ep.name, scan), func(b *testing.B) {
+				var ratio float64
+				for i := 0; i < b.N; i++ {
+					ratio = replay(ep.newPolicy(), trace, 16<<20)
+				}
+				b.ReportMetric(ratio*100, "hit%")
+			})
+		}
+	}
+}
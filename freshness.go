@@ -0,0 +1,225 @@
+package rcutil
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// heuristicFraction is the fraction of the time since Last-Modified used as heuristic freshness lifetime.
+	heuristicFraction = 10
+	// maxHeuristicLifetime is the upper limit of heuristic freshness lifetime.
+	maxHeuristicLifetime = 24 * time.Hour
+	// maxDeltaSeconds is the value that a greater delta-seconds is considered to be.
+	// See https://httpwg.org/specs/rfc9111.html#delta-seconds
+	maxDeltaSeconds = 1 << 31
+)
+
+// CachePolicy is the result of evaluating the caching semantics of a response as a shared cache.
+// See https://httpwg.org/specs/rfc9111.html
+type CachePolicy struct {
+	// Storable reports whether the response can be stored and served from the cache.
+	// It is false for responses that are stale as soon as they are stored (e.g. no-cache),
+	// because they can not be served without revalidation.
+	Storable bool
+	// Lifetime is the freshness lifetime of the response.
+	Lifetime time.Duration
+	// Age is the current age of the response.
+	Age time.Duration
+	// TTL is the remaining freshness lifetime of the response.
+	// If Storable is true, it can be passed to DiskCache.StoreWithTTL as it is.
+	TTL time.Duration
+	// Heuristic reports whether Lifetime was calculated heuristically from Last-Modified.
+	Heuristic bool
+	// MustRevalidate reports whether the response must not be served stale.
+	MustRevalidate bool
+	// Reason describes why the response is or is not storable.
+	Reason string
+}
+
+// heuristicallyCacheableStatusCodes are status codes that are defined as heuristically cacheable.
+// See https://httpwg.org/specs/rfc9110.html#rfc.section.15.1
+var heuristicallyCacheableStatusCodes = map[int]struct{}{
+	http.StatusOK:                   {},
+	http.StatusNonAuthoritativeInfo: {},
+	http.StatusNoContent:            {},
+	http.StatusMultipleChoices:      {},
+	http.StatusMovedPermanently:     {},
+	http.StatusPermanentRedirect:    {},
+	http.StatusNotFound:             {},
+	http.StatusMethodNotAllowed:     {},
+	http.StatusGone:                 {},
+	http.StatusRequestURITooLong:    {},
+	http.StatusNotImplemented:       {},
+}
+
+// EvaluateCachePolicy evaluates whether the response to the request can be stored in a shared cache and for how long.
+// now is the time the response was received.
+func EvaluateCachePolicy(req *http.Request, res *http.Response, now time.Time) CachePolicy {
+	p := CachePolicy{}
+	// https://httpwg.org/specs/rfc9111.html#rfc.section.3
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		p.Reason = "request method is not cacheable"
+		return p
+	}
+	if res.StatusCode < 200 || res.StatusCode == http.StatusPartialContent || res.StatusCode == http.StatusNotModified {
+		p.Reason = "status code is not cacheable"
+		return p
+	}
+	reqcc := parseCacheControl(req.Header)
+	rescc := parseCacheControl(res.Header)
+	if reqcc.has("no-store") || rescc.has("no-store") {
+		p.Reason = "no-store"
+		return p
+	}
+	if rescc.has("private") {
+		p.Reason = "private"
+		return p
+	}
+	// https://httpwg.org/specs/rfc9111.html#rfc.section.3.5
+	if req.Header.Get("Authorization") != "" && !rescc.has("must-revalidate") && !rescc.has("public") && !rescc.has("s-maxage") {
+		p.Reason = "request has Authorization header"
+		return p
+	}
+	if res.Header.Get("Vary") == "*" {
+		p.Reason = "Vary: *"
+		return p
+	}
+	p.MustRevalidate = rescc.has("must-revalidate") || rescc.has("proxy-revalidate") || rescc.has("s-maxage")
+
+	date, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		date = now
+	}
+
+	// https://httpwg.org/specs/rfc9111.html#rfc.section.4.2.1
+	_, heuristic := heuristicallyCacheableStatusCodes[res.StatusCode]
+	switch {
+	case rescc.has("s-maxage"):
+		p.Lifetime = rescc.seconds("s-maxage")
+		p.Reason = "s-maxage"
+	case rescc.has("max-age"):
+		p.Lifetime = rescc.seconds("max-age")
+		p.Reason = "max-age"
+	case res.Header.Get("Expires") != "":
+		expires, err := http.ParseTime(res.Header.Get("Expires"))
+		if err == nil && expires.After(date) {
+			p.Lifetime = expires.Sub(date)
+		}
+		p.Reason = "Expires"
+	case heuristic || rescc.has("public"):
+		lastModified, err := http.ParseTime(res.Header.Get("Last-Modified"))
+		if err != nil {
+			p.Reason = "no explicit expiration time and no Last-Modified"
+			return p
+		}
+		if lastModified.Before(date) {
+			p.Lifetime = min(date.Sub(lastModified)/heuristicFraction, maxHeuristicLifetime)
+		}
+		p.Heuristic = true
+		p.Reason = "heuristic freshness from Last-Modified"
+	default:
+		p.Reason = "status code is not heuristically cacheable and no explicit expiration time"
+		return p
+	}
+
+	// https://httpwg.org/specs/rfc9111.html#rfc.section.4.2.3
+	age := time.Duration(0)
+	if v, ok := parseDeltaSeconds(strings.TrimSpace(res.Header.Get("Age"))); ok {
+		age = v
+	}
+	if apparent := now.Sub(date); apparent > age {
+		age = apparent
+	}
+	p.Age = age
+	p.TTL = p.Lifetime - p.Age
+
+	if rescc.has("no-cache") {
+		p.TTL = 0
+		p.Reason = "no-cache"
+		return p
+	}
+	if p.TTL <= 0 {
+		p.TTL = 0
+		p.Reason += " (stale)"
+		return p
+	}
+	p.Storable = true
+	return p
+}
+
+// cacheControl is parsed Cache-Control directives.
+type cacheControl map[string]string
+
+// parseCacheControl parses Cache-Control header fields.
+// Directive names are case-insensitive and only the first occurrence of each directive is used.
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range splitDirectives(v) {
+			name, value, _ := strings.Cut(d, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if _, ok := cc[name]; ok {
+				continue
+			}
+			cc[name] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the value of the delta-seconds directive.
+// An invalid value is treated as zero.
+func (cc cacheControl) seconds(name string) time.Duration {
+	v, _ := parseDeltaSeconds(cc[name])
+	return v
+}
+
+// parseDeltaSeconds parses the delta-seconds value. A value greater than maxDeltaSeconds is considered to be
+// maxDeltaSeconds, so that the duration does not overflow. It returns false if the value is invalid.
+func parseDeltaSeconds(s string) (time.Duration, bool) {
+	v, err := strconv.ParseInt(s, 10, 64)
+	switch {
+	case errors.Is(err, strconv.ErrRange) && v > 0:
+		v = maxDeltaSeconds
+	case err != nil || v < 0:
+		return 0, false
+	}
+	return time.Duration(min(v, maxDeltaSeconds)) * time.Second, true
+}
+
+// splitDirectives splits a Cache-Control header value by commas outside quoted strings.
+func splitDirectives(v string) []string {
+	var (
+		ds     []string
+		quoted bool
+		start  int
+	)
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '"':
+			quoted = !quoted
+		case '\\':
+			if quoted {
+				i++
+			}
+		case ',':
+			if !quoted {
+				ds = append(ds, v[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(ds, v[start:])
+}
@@ -0,0 +1,246 @@
+package rcutil
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEvaluateCachePolicy(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	date := now.Format(http.TimeFormat)
+	tests := []struct {
+		name      string
+		method    string
+		reqHeader http.Header
+		status    int
+		resHeader http.Header
+		want      CachePolicy
+	}{
+		{
+			"max-age",
+			http.MethodGet,
+			http.Header{},
+			http.StatusOK,
+			http.Header{"Cache-Control": {"max-age=60"}, "Date": {date}},
+			CachePolicy{Storable: true, Lifetime: 60 * time.Second, TTL: 60 * time.Second, Reason: "max-age"},
+		},
+		{
+			"s-maxage takes precedence over max-age",
+			http.MethodGet,
+			http.Header{},
+			http.StatusOK,
+			http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}, "Date": {date}},
+			CachePolicy{Storable: true, Lifetime: 120 * time.Second, TTL: 120 * time.Second, MustRevalidate: true, Reason: "s-maxage"},
+		},
+		{
+			"max-age greater than 2^31 seconds",
+			http.MethodGet,
+			http.Header{},
+			http.StatusOK,
+			http.Header{"Cache-Control": {"max-age=99999999999"}, "Date": {date}},
+			CachePolicy{Storable: true, Lifetime: maxDeltaSeconds * time.Second, TTL: maxDeltaSeconds * time.Second, Reason: "max-age"},
+		},
+		{
+			"max-age greater than int64",
+			http.MethodGet,
+			http.Header{},
+			http.StatusOK,
+			http.Header{"Cache-Control": {"max-age=99999999999999999999"}, "Date": {date}},
+			CachePolicy{Storable: true, Lifetime: maxDeltaSeconds * time.Second, TTL: maxDeltaSeconds * time.Second, Reason: "max-age"},
+		},
+		{
+			"Age greater than 2^31 seconds",
+			http.MethodGet,
+			http.Header{},
+			http.StatusOK,
+			http.Header{"Cache-Control": {"max-age=60"}, "Date": {date}, "Age": {"99999999999"}},
+			CachePolicy{Lifetime: 60 * time.Second, Age: maxDeltaSeconds * time.Second, Reason: "max-age (stale)"},
+		},
+		{
+			"Age reduces TTL",
+			http.MethodGet,
+			http.Header{},
+			http.StatusOK,
+			http.Header{"Cache-Control": {"max-age=60"}, "Date": {date}, "Age": {"20"}},
+			CachePolicy{Storable: true, Lifetime: 60 * time.Second, Age: 20 * time.Second, TTL: 40 * time.Second, Reason: "max-age"},
+		},
+		{
+			"apparent age from Date",
+			http.MethodGet,
+			http.Header{},
+			http.StatusOK,
+			http.Header{"Cache-Control": {"max-age=60"}, "Date": {now.Add(-30 * time.Second).Format(http.TimeFormat)}},
+			CachePolicy{Storable: true, Lifetime: 60 * time.Second, Age: 30 * time.Second, TTL: 30 * time.Second, Reason: "max-age"},
+		},
+		{
+			"Expires",
+			http.MethodGet,
+			http.Header{},
+			http.StatusOK,
+			http.Header{"Expires": {now.Add(time.Hour).Format(http.TimeFormat)}, "Date": {date}},
+			CachePolicy{Storable: true, Lifetime: time.Hour, TTL: time.Hour, Reason: "Expires"},
+		},
+		{
+			"invalid Expires",
+			http.MethodGet,
+			http.Header{},
+			http.StatusOK,
+			http.Header{"Expires": {"0"}, "Date": {date}},
+			CachePolicy{Reason: "Expires (stale)"},
+		},
+		{
+			"heuristic freshness",
+			http.MethodGet,
+			http.Header{},
+			http.StatusOK,
+			http.Header{"Last-Modified": {now.Add(-10 * time.Hour).Format(http.TimeFormat)}, "Date": {date}},
+			CachePolicy{Storable: true, Lifetime: time.Hour, TTL: time.Hour, Heuristic: true, Reason: "heuristic freshness from Last-Modified"},
+		},
+		{
+			"heuristic freshness is capped",
+			http.MethodGet,
+			http.Header{},
+			http.StatusOK,
+			http.Header{"Last-Modified": {now.Add(-1000 * time.Hour).Format(http.TimeFormat)}, "Date": {date}},
+			CachePolicy{Storable: true, Lifetime: maxHeuristicLifetime, TTL: maxHeuristicLifetime, Heuristic: true, Reason: "heuristic freshness from Last-Modified"},
+		},
+		{
+			"no validators",
+			http.MethodGet,
+			http.Header{},
+			http.StatusOK,
+			http.Header{"Date": {date}},
+			CachePolicy{Reason: "no explicit expiration time and no Last-Modified"},
+		},
+		{
+			"status code is not heuristically cacheable",
+			http.MethodGet,
+			http.Header{},
+			http.StatusInternalServerError,
+			http.Header{"Last-Modified": {now.Add(-10 * time.Hour).Format(http.TimeFormat)}, "Date": {date}},
+			CachePolicy{Reason: "status code is not heuristically cacheable and no explicit expiration time"},
+		},
+		{
+			"status code with explicit expiration time",
+			http.MethodGet,
+			http.Header{},
+			http.StatusInternalServerError,
+			http.Header{"Cache-Control": {"max-age=10"}, "Date": {date}},
+			CachePolicy{Storable: true, Lifetime: 10 * time.Second, TTL: 10 * time.Second, Reason: "max-age"},
+		},
+		{
+			"partial content",
+			http.MethodGet,
+			http.Header{},
+			http.StatusPartialContent,
+			http.Header{"Cache-Control": {"max-age=60"}},
+			CachePolicy{Reason: "status code is not cacheable"},
+		},
+		{
+			"POST",
+			http.MethodPost,
+			http.Header{},
+			http.StatusOK,
+			http.Header{"Cache-Control": {"max-age=60"}},
+			CachePolicy{Reason: "request method is not cacheable"},
+		},
+		{
+			"no-store",
+			http.MethodGet,
+			http.Header{},
+			http.StatusOK,
+			http.Header{"Cache-Control": {"max-age=60, No-Store"}},
+			CachePolicy{Reason: "no-store"},
+		},
+		{
+			"no-store in request",
+			http.MethodGet,
+			http.Header{"Cache-Control": {"no-store"}},
+			http.StatusOK,
+			http.Header{"Cache-Control": {"max-age=60"}},
+			CachePolicy{Reason: "no-store"},
+		},
+		{
+			"private",
+			http.MethodGet,
+			http.Header{},
+			http.StatusOK,
+			http.Header{"Cache-Control": {`private="Set-Cookie, X-Foo", max-age=60`}},
+			CachePolicy{Reason: "private"},
+		},
+		{
+			"no-cache",
+			http.MethodGet,
+			http.Header{},
+			http.StatusOK,
+			http.Header{"Cache-Control": {"no-cache, max-age=60"}, "Date": {date}},
+			CachePolicy{Lifetime: 60 * time.Second, Reason: "no-cache"},
+		},
+		{
+			"Authorization",
+			http.MethodGet,
+			http.Header{"Authorization": {"Bearer xxx"}},
+			http.StatusOK,
+			http.Header{"Cache-Control": {"max-age=60"}},
+			CachePolicy{Reason: "request has Authorization header"},
+		},
+		{
+			"Authorization and public",
+			http.MethodGet,
+			http.Header{"Authorization": {"Bearer xxx"}},
+			http.StatusOK,
+			http.Header{"Cache-Control": {"public, max-age=60"}, "Date": {date}},
+			CachePolicy{Storable: true, Lifetime: 60 * time.Second, TTL: 60 * time.Second, Reason: "max-age"},
+		},
+		{
+			"must-revalidate",
+			http.MethodGet,
+			http.Header{},
+			http.StatusOK,
+			http.Header{"Cache-Control": {"max-age=60, must-revalidate"}, "Date": {date}},
+			CachePolicy{Storable: true, Lifetime: 60 * time.Second, TTL: 60 * time.Second, MustRevalidate: true, Reason: "max-age"},
+		},
+		{
+			"Vary: *",
+			http.MethodGet,
+			http.Header{},
+			http.StatusOK,
+			http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}},
+			CachePolicy{Reason: "Vary: *"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{Method: tt.method, Header: tt.reqHeader, URL: &url.URL{Path: "/foo"}}
+			res := &http.Response{StatusCode: tt.status, Header: tt.resHeader}
+			got := EvaluateCachePolicy(req, res, now)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   cacheControl
+	}{
+		{nil, cacheControl{}},
+		{[]string{"max-age=60"}, cacheControl{"max-age": "60"}},
+		{[]string{"Max-Age=60, no-cache"}, cacheControl{"max-age": "60", "no-cache": ""}},
+		{[]string{`no-cache="Set-Cookie, X-Foo", public`}, cacheControl{"no-cache": "Set-Cookie, X-Foo", "public": ""}},
+		{[]string{"max-age=60", "max-age=10, s-maxage=5"}, cacheControl{"max-age": "60", "s-maxage": "5"}},
+		{[]string{" , ,max-age=1"}, cacheControl{"max-age": "1"}},
+	}
+	for _, tt := range tests {
+		got := parseCacheControl(http.Header{"Cache-Control": tt.values})
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Error(diff)
+		}
+	}
+}
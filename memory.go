@@ -0,0 +1,253 @@
+package rcutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/2manymws/rc"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// MemoryCache is an in-memory cache bounded by the total bytes of the entries.
+// The bodies are held in memory and the requests and responses are not parsed on Load,
+// so it is intended for small and hot entries, e.g. as the hot tier of TieredCache.
+// The least recently used entries are evicted when the cache is full.
+type MemoryCache struct {
+	maxKeys       uint64
+	maxTotalBytes uint64
+	defaultTTL    time.Duration
+	items         map[string]*memoryItem
+	policy        EvictionPolicy
+	totalBytes    uint64
+	metrics       ttlcache.Metrics
+	mu            sync.Mutex
+}
+
+type memoryItem struct {
+	req       *http.Request
+	reqBody   []byte
+	res       *http.Response
+	resBody   []byte
+	bytes     uint64
+	expiresAt time.Time
+}
+
+// MemoryCacheOption is an option for MemoryCache.
+type MemoryCacheOption func(*MemoryCache)
+
+// MemoryMaxKeys sets the maximum number of keys that can be stored in the MemoryCache.
+func MemoryMaxKeys(n uint64) MemoryCacheOption {
+	return func(c *MemoryCache) {
+		c.maxKeys = n
+	}
+}
+
+// NewMemoryCache returns a new MemoryCache.
+// maxTotalBytes: the maximum number of bytes that can be stored in the cache. If NoLimitTotalBytes is specified, there is no limit.
+// defaultTTL: the default TTL of the cache.
+func NewMemoryCache(maxTotalBytes uint64, defaultTTL time.Duration, opts ...MemoryCacheOption) *MemoryCache {
+	c := &MemoryCache{
+		maxKeys:       NoLimitKeys,
+		maxTotalBytes: maxTotalBytes,
+		defaultTTL:    defaultTTL,
+		items:         make(map[string]*memoryItem),
+		policy:        NewLRUPolicy(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Store stores the response in the cache with the default TTL.
+func (c *MemoryCache) Store(key string, req *http.Request, res *http.Response) error {
+	return c.StoreWithTTL(key, req, res, ttlcache.DefaultTTL)
+}
+
+// StoreWithTTL stores the response in the cache with the specified TTL.
+// If you want to store the response with no TTL, use NoLimitTTL.
+// The bodies of the request and response are read to the end and closed.
+func (c *MemoryCache) StoreWithTTL(key string, req *http.Request, res *http.Response, ttl time.Duration) error {
+	if c.maxTotalBytes != NoLimitTotalBytes && res.ContentLength > int64(c.maxTotalBytes) {
+		// cache is full
+		return fmt.Errorf("%w (%d bytes > %d bytes)", ErrCacheFull, res.ContentLength, c.maxTotalBytes)
+	}
+	reqBody, err := readAllAndClose(req.Body)
+	if err != nil {
+		return err
+	}
+	resBody, err := readAllAndClose(res.Body)
+	if err != nil {
+		return err
+	}
+	return c.set(key, req, reqBody, res, resBody, c.expiresAt(time.Now(), ttl))
+}
+
+// set stores the request and response with the bodies read in advance.
+// The entry never expires if expiresAt is zero.
+func (c *MemoryCache) set(key string, req *http.Request, reqBody []byte, res *http.Response, resBody []byte, expiresAt time.Time) error {
+	i := &memoryItem{
+		req:       req.Clone(context.Background()),
+		reqBody:   reqBody,
+		res:       cloneResponse(res),
+		resBody:   resBody,
+		expiresAt: expiresAt,
+	}
+	i.req.Body = nil
+	i.res.Body = nil
+	i.res.Request = nil
+	i.bytes = i.size()
+	if c.maxTotalBytes != NoLimitTotalBytes && i.bytes > c.maxTotalBytes {
+		// cache is full
+		return fmt.Errorf("%w (%d bytes > %d bytes)", ErrCacheFull, i.bytes, c.maxTotalBytes)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.items[key]; ok {
+		c.totalBytes -= old.bytes
+	}
+	c.items[key] = i
+	c.totalBytes += i.bytes
+	c.policy.Add(key, i.bytes)
+	c.metrics.Insertions++
+	for (c.maxTotalBytes != NoLimitTotalBytes && c.totalBytes > c.maxTotalBytes) ||
+		(c.maxKeys != NoLimitKeys && uint64(len(c.items)) > c.maxKeys) {
+		victim, ok := c.policy.Victim()
+		if !ok {
+			break
+		}
+		c.remove(victim)
+		c.metrics.Evictions++
+	}
+	return nil
+}
+
+// Load loads the response from the cache.
+func (c *MemoryCache) Load(key string) (*http.Request, *http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i, ok := c.items[key]
+	if ok && !i.expiresAt.IsZero() && !time.Now().Before(i.expiresAt) {
+		c.remove(key)
+		c.metrics.Evictions++
+		ok = false
+	}
+	if !ok {
+		c.metrics.Misses++
+		return nil, nil, rc.ErrCacheNotFound
+	}
+	c.metrics.Hits++
+	c.policy.Access(key)
+	return i.request(), i.response(), nil
+}
+
+// Delete deletes the cache.
+func (c *MemoryCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+}
+
+// DeleteExpired deletes expired caches.
+func (c *MemoryCache) DeleteExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for key, i := range c.items {
+		if !i.expiresAt.IsZero() && !now.Before(i.expiresAt) {
+			c.remove(key)
+			c.metrics.Evictions++
+		}
+	}
+}
+
+// Metrics returns the metrics of the cache.
+func (c *MemoryCache) Metrics() Metrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Metrics{
+		Metrics:      c.metrics,
+		TotalBytes:   c.totalBytes,
+		LogicalBytes: c.totalBytes,
+		KeyCount:     uint64(len(c.items)),
+	}
+}
+
+// Close does nothing, as MemoryCache has no goroutines. The entries are dropped with the cache.
+func (c *MemoryCache) Close() error {
+	return nil
+}
+
+// remove removes the item of key. c.mu must be held.
+func (c *MemoryCache) remove(key string) {
+	i, ok := c.items[key]
+	if !ok {
+		return
+	}
+	delete(c.items, key)
+	c.policy.Remove(key)
+	c.totalBytes -= i.bytes
+}
+
+// expiresAt returns the expiration time of an entry stored at now with ttl.
+// The zero time means the entry never expires.
+func (c *MemoryCache) expiresAt(now time.Time, ttl time.Duration) time.Time {
+	if ttl == ttlcache.DefaultTTL {
+		ttl = c.defaultTTL
+	}
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// size returns the approximate number of bytes of the item in memory.
+func (i *memoryItem) size() uint64 {
+	n := len(i.reqBody) + len(i.resBody) + len(i.req.URL.String())
+	for _, h := range []http.Header{i.req.Header, i.res.Header, i.res.Trailer} {
+		for k, vs := range h {
+			for _, v := range vs {
+				n += len(k) + len(v)
+			}
+		}
+	}
+	return uint64(n)
+}
+
+func (i *memoryItem) request() *http.Request {
+	req := i.req.Clone(context.Background())
+	req.Body = io.NopCloser(bytes.NewReader(i.reqBody))
+	req.ContentLength = int64(len(i.reqBody))
+	return req
+}
+
+func (i *memoryItem) response() *http.Response {
+	res := cloneResponse(i.res)
+	res.Body = io.NopCloser(bytes.NewReader(i.resBody))
+	res.ContentLength = int64(len(i.resBody))
+	return res
+}
+
+// cloneResponse returns a copy of the response whose header fields can be modified independently.
+func cloneResponse(res *http.Response) *http.Response {
+	r := *res
+	r.Header = res.Header.Clone()
+	r.Trailer = res.Trailer.Clone()
+	r.TransferEncoding = append([]string(nil), res.TransferEncoding...)
+	return &r
+}
+
+// readAllAndClose reads the body to the end and closes it. A nil body is read as empty.
+func readAllAndClose(body io.ReadCloser) ([]byte, error) {
+	if body == nil || body == http.NoBody {
+		return nil, nil
+	}
+	b, err := io.ReadAll(body)
+	return b, errors.Join(err, body.Close())
+}
@@ -0,0 +1,78 @@
+package rcutil
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2manymws/rc"
+)
+
+func TestMemoryCache(t *testing.T) {
+	c := NewMemoryCache(1000, 1*time.Hour)
+	store := func(key, body string, ttl time.Duration) error {
+		req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/" + key}, Body: newBody(nil)}
+		res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"X-Test": {"test"}}, Body: newBody([]byte(body)), ContentLength: -1}
+		return c.StoreWithTTL(key, req, res, ttl)
+	}
+	load := func(key string) (string, error) {
+		req, res, err := c.Load(key)
+		if err != nil {
+			return "", err
+		}
+		if req.URL.Path != "/"+key {
+			t.Errorf("got %q, want %q", req.URL.Path, "/"+key)
+		}
+		// The loaded response does not share the header with the cache
+		res.Header.Set("X-Test", "modified")
+		return readBody(res.Body), nil
+	}
+
+	if err := store("a", strings.Repeat("a", 400), NoLimitTTL); err != nil {
+		t.Fatal(err)
+	}
+	if err := store("b", strings.Repeat("b", 400), NoLimitTTL); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := load("a"); err != nil || got != strings.Repeat("a", 400) {
+		t.Errorf("got %q, %v", got, err)
+	}
+	_, res, err := c.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Header.Get("X-Test"); got != "test" {
+		t.Errorf("got %q, want %q", got, "test")
+	}
+
+	// The least recently used entry is evicted
+	if err := store("c", strings.Repeat("c", 400), NoLimitTTL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := load("b"); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+	if m := c.Metrics(); m.KeyCount != 2 || m.TotalBytes > 1000 || m.Evictions != 1 {
+		t.Errorf("unexpected metrics: %+v", m)
+	}
+
+	if err := store("large", strings.Repeat("l", 1001), NoLimitTTL); !errors.Is(err, ErrCacheFull) {
+		t.Errorf("got %v, want %v", err, ErrCacheFull)
+	}
+
+	if err := store("expired", "hello", 1*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := load("expired"); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+
+	c.Delete("a")
+	if _, err := load("a"); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+}
@@ -0,0 +1,178 @@
+package rcutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+)
+
+const metaCacheSuffix = ".meta"
+
+// entryMeta is the metadata of a cache entry that is persisted next to the request and response files.
+// The last access time is not part of it; it is kept as the modification time of the metadata file
+// so that a hit does not have to rewrite the file.
+type entryMeta struct {
+	Key       string    `json:"key"`
+	StoredAt  time.Time `json:"stored_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Bytes     uint64    `json:"bytes"`
+	// Primary is the key that the entry is a variant of.
+	Primary string `json:"primary,omitempty"`
+	// Vary is the vary spec of the primary key when the entry was stored.
+	Vary []string `json:"vary,omitempty"`
+	// Group is the quota group of the entry.
+	Group string `json:"group,omitempty"`
+	// Tags, Host and Path are the keys of the entry in the purge index.
+	Tags []string `json:"tags,omitempty"`
+	Host string   `json:"host,omitempty"`
+	Path string   `json:"path,omitempty"`
+	// Header is the response header fields updated by revalidation.
+	Header http.Header `json:"header,omitempty"`
+	// StaleWhileRevalidate and StaleIfError are the windows in which the entry can be served stale.
+	StaleWhileRevalidate time.Duration `json:"stale_while_revalidate,omitempty"`
+	StaleIfError         time.Duration `json:"stale_if_error,omitempty"`
+	// BodyOffset and ContentLength are the position of the body in the response file.
+	// BodyOffset is 0 if the body can not be read directly from the file.
+	BodyOffset    int64 `json:"body_offset,omitempty"`
+	ContentLength int64 `json:"content_length,omitempty"`
+	// Encoding is the content coding that the body is compressed with by the cache, and DecodedLength is the length of the decompressed body.
+	Encoding      string `json:"encoding,omitempty"`
+	DecodedLength int64  `json:"decoded_length,omitempty"`
+	// LogicalBytes is Bytes as if the body were not compressed.
+	LogicalBytes uint64 `json:"logical_bytes,omitempty"`
+	// RequestChecksum and ResponseChecksum are the checksums of the request and response files in the form of "algorithm:hex".
+	RequestChecksum  string `json:"request_checksum,omitempty"`
+	ResponseChecksum string `json:"response_checksum,omitempty"`
+}
+
+// expired reports whether the entry has expired at now.
+func (m *entryMeta) expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt)
+}
+
+// matches reports whether the sizes recorded in the metadata match the request, response and metadata files.
+// They do not match if the files were replaced without the metadata, e.g. by an interrupted commit.
+func (m *entryMeta) matches(reqi, resi, metai fs.FileInfo) bool {
+	if m.Bytes != uint64(reqi.Size()+resi.Size()+metai.Size()) {
+		return false
+	}
+	return m.BodyOffset == 0 || m.BodyOffset+m.ContentLength == resi.Size()
+}
+
+// retention returns how long the entry is kept after it has expired.
+func (c *DiskCache) retention(meta *entryMeta) time.Duration {
+	return max(c.staleRetention, meta.StaleWhileRevalidate, meta.StaleIfError)
+}
+
+// cacheTTL returns the TTL of the item in c.m, which includes the retention period.
+func cacheTTL(now, expiresAt time.Time, retention time.Duration) time.Duration {
+	if expiresAt.IsZero() {
+		return NoLimitTTL
+	}
+	return expiresAt.Sub(now) + retention
+}
+
+// isStale reports whether the item has expired at now.
+func isStale(i *ttlcache.Item[string, *cacheItem], now time.Time) bool {
+	if i.ExpiresAt().IsZero() {
+		return false
+	}
+	return !now.Before(i.ExpiresAt().Add(-i.Value().retention))
+}
+
+// expiresAt returns the expiration time of an entry stored at now with ttl.
+// The zero time means the entry never expires.
+func (c *DiskCache) expiresAt(now time.Time, ttl time.Duration) time.Time {
+	if ttl == ttlcache.DefaultTTL {
+		ttl = c.defaultTTL
+	}
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// writeMeta replaces the metadata of the entry.
+// Bytes and LogicalBytes of meta are updated with the size of the new metadata file in place of the current one.
+func (c *DiskCache) writeMeta(pathkey string, meta *entryMeta) error {
+	fi, err := os.Stat(pathkey + metaCacheSuffix)
+	if err != nil {
+		return err
+	}
+	meta.Bytes = subBytes(meta.Bytes, uint64(fi.Size()))
+	meta.LogicalBytes = subBytes(meta.LogicalBytes, uint64(fi.Size()))
+	tmp := &tempFiles{}
+	if err := c.writeTempMeta(tmp, pathkey, meta); err != nil {
+		return errors.Join(err, tmp.remove())
+	}
+	if err := os.Rename(tmp.meta, pathkey+metaCacheSuffix); err != nil {
+		return errors.Join(err, tmp.remove())
+	}
+	return nil
+}
+
+// writeTempMeta encodes the metadata of the entry at pathkey into a temporary file in the cache root.
+// The file is encrypted if encryption is enabled, because the metadata includes the key.
+// The size of the metadata file is added to Bytes and LogicalBytes of meta and to tmp.bytes,
+// so the file is encoded again until the size that it records is its own.
+func (c *DiskCache) writeTempMeta(tmp *tempFiles, pathkey string, meta *entryMeta) error {
+	bytes, logicalBytes := meta.Bytes, meta.LogicalBytes
+	var n uint64
+	for {
+		meta.Bytes, meta.LogicalBytes = bytes+n, logicalBytes+n
+		if tmp.meta != "" {
+			if err := os.Remove(tmp.meta); err != nil {
+				return err
+			}
+			tmp.meta = ""
+		}
+		written, err := c.writeTempEntryFile(&tmp.meta, nil, c.metaAAD(pathkey), func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(meta)
+		})
+		if err != nil {
+			return err
+		}
+		if written == n {
+			tmp.bytes += n
+			return nil
+		}
+		n = written
+	}
+}
+
+// readMeta reads the metadata of the entry at pathkey and its last access time.
+// Metadata written before encryption was enabled is read as it is until Reencrypt encrypts it.
+func (c *DiskCache) readMeta(pathkey string) (*entryMeta, time.Time, error) {
+	p := pathkey + metaCacheSuffix
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var f io.ReadCloser
+	if c.keyring != nil && isEncryptedFile(p) {
+		f, err = c.openEntryFile(context.Background(), p, c.metaAAD(pathkey))
+	} else {
+		f, err = os.Open(p)
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	meta := &entryMeta{}
+	if err := json.NewDecoder(f).Decode(meta); err != nil {
+		return nil, time.Time{}, err
+	}
+	return meta, fi.ModTime(), nil
+}
+
+// touchMeta records the last access time of the entry.
+func touchMeta(pathkey string, now time.Time) {
+	_ = os.Chtimes(pathkey+metaCacheSuffix, now, now) //nostyle:handlerrors
+}
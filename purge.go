@@ -0,0 +1,285 @@
+package rcutil
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/2manymws/rc"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// ResponseTags returns the tags listed in the Surrogate-Key and Cache-Tag header fields of the response.
+// Surrogate-Key lists tags separated by spaces, and Cache-Tag lists tags separated by commas.
+func ResponseTags(res *http.Response) []string {
+	var tags []string
+	for _, v := range res.Header.Values("Surrogate-Key") {
+		tags = append(tags, strings.Fields(v)...)
+	}
+	for _, v := range res.Header.Values("Cache-Tag") {
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// StoreWithTags stores the response in the cache with the default TTL and the tags for PurgeByTag.
+func (c *DiskCache) StoreWithTags(key string, req *http.Request, res *http.Response, tags ...string) error {
+	return c.StoreWithTTLAndTags(key, req, res, ttlcache.DefaultTTL, tags...)
+}
+
+// StoreWithTTLAndTags stores the response in the cache with the specified TTL and the tags for PurgeByTag.
+// The tags listed in the Surrogate-Key and Cache-Tag header fields of the response are added to the tags.
+func (c *DiskCache) StoreWithTTLAndTags(key string, req *http.Request, res *http.Response, ttl time.Duration, tags ...string) error {
+	return c.store(context.Background(), key, req, res, ttl, &entryMeta{Tags: tags})
+}
+
+// PurgeByTag deletes the entries with the tag and returns the number of them.
+func (c *DiskCache) PurgeByTag(tag string) int {
+	return c.purge(c.keysByTag(tag))
+}
+
+// PurgeByHost deletes the entries whose requests are for the host and returns the number of them.
+// Hosts are compared case-insensitively, and the default ports of HTTP and HTTPS are ignored.
+func (c *DiskCache) PurgeByHost(host string) int {
+	return c.purge(c.keysByPathPrefix(host, ""))
+}
+
+// PurgeByPathPrefix deletes the entries whose request paths start with prefix and returns the number of them.
+// If host is empty, the entries of all hosts are deleted. Hosts are compared like PurgeByHost.
+func (c *DiskCache) PurgeByPathPrefix(host, prefix string) int {
+	return c.purge(c.keysByPathPrefix(host, prefix))
+}
+
+// SoftPurge marks the entry as stale without removing its files, so that it can still be served
+// by LoadStale within its stale windows or loaded by LoadExpired for revalidation, while Load returns rc.ErrCacheExpired.
+// The entry is kept for the stale windows and the grace period of EnableKeepStale, and is deleted if they are zero.
+func (c *DiskCache) SoftPurge(key string) error {
+	return c.softPurge(key, time.Now())
+}
+
+// SoftPurgeByTag marks the entries with the tag as stale like SoftPurge and returns the number of them.
+func (c *DiskCache) SoftPurgeByTag(tag string) int {
+	return c.softPurgeKeys(c.keysByTag(tag))
+}
+
+// SoftPurgeByHost marks the entries whose requests are for the host as stale like SoftPurge and returns the number of them.
+func (c *DiskCache) SoftPurgeByHost(host string) int {
+	return c.softPurgeKeys(c.keysByPathPrefix(host, ""))
+}
+
+// SoftPurgeByPathPrefix marks the entries whose request paths start with prefix as stale like SoftPurge
+// and returns the number of them. If host is empty, the entries of all hosts are marked.
+func (c *DiskCache) SoftPurgeByPathPrefix(host, prefix string) int {
+	return c.softPurgeKeys(c.keysByPathPrefix(host, prefix))
+}
+
+func (c *DiskCache) keysByTag(tag string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.purgeIndex.byTag(tag)
+}
+
+func (c *DiskCache) keysByPathPrefix(host, prefix string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if host != "" {
+		return c.purgeIndex.byPathPrefix(normalizeHost(host), prefix)
+	}
+	var keys []string
+	for h := range c.purgeIndex.hosts {
+		keys = append(keys, c.purgeIndex.byPathPrefix(h, prefix)...)
+	}
+	return keys
+}
+
+func (c *DiskCache) purge(keys []string) int {
+	for _, key := range keys {
+		c.m.Delete(key)
+	}
+	atomic.AddUint64(&c.hardPurges, uint64(len(keys)))
+	return len(keys)
+}
+
+func (c *DiskCache) softPurgeKeys(keys []string) int {
+	now := time.Now()
+	n := 0
+	for _, key := range keys {
+		if err := c.softPurge(key, now); err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *DiskCache) softPurge(key string, now time.Time) (err error) {
+	c.keyMu.LockKey(key)
+	defer func() {
+		err = errors.Join(err, c.keyMu.UnlockKey(key))
+	}()
+	c.mu.Lock()
+	ci, ok := c.entries[key]
+	ok = ok && c.m.Has(key)
+	c.mu.Unlock()
+	if !ok {
+		return rc.ErrCacheNotFound
+	}
+	if ci.retention == 0 {
+		// Nothing is kept after expiration
+		c.m.Delete(key)
+		atomic.AddUint64(&c.hardPurges, 1)
+		return nil
+	}
+	meta, _, err := c.readMeta(ci.pathkey)
+	if err != nil {
+		return errors.Join(err, rc.ErrCacheNotFound)
+	}
+	if meta.expired(now) {
+		// Already stale
+		return nil
+	}
+	meta.ExpiresAt = now
+	if err := c.writeMeta(ci.pathkey, meta); err != nil {
+		return err
+	}
+	nci := *ci
+	nci.bytes, nci.logicalBytes = meta.Bytes, meta.LogicalBytes
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setItem(&nci, cacheTTL(now, now, nci.retention))
+	atomic.AddUint64(&c.softPurges, 1)
+	return nil
+}
+
+// setPurgeIndex records the tags, host and path of the entry in the metadata.
+func (m *entryMeta) setPurgeIndex(req *http.Request, res *http.Response) {
+	tags := slices.Concat(m.Tags, ResponseTags(res))
+	sort.Strings(tags)
+	m.Tags = slices.Compact(tags)
+	host := req.Host
+	if host == "" && req.URL != nil {
+		host = req.URL.Host
+	}
+	m.Host = normalizeHost(host)
+	if req.URL != nil {
+		m.Path = req.URL.Path
+	}
+}
+
+// normalizeHost returns the host in lower case without the default port of HTTP or HTTPS,
+// so that the entries of a host are indexed and looked up by the same name however the host is written.
+func normalizeHost(host string) string {
+	host = strings.ToLower(host)
+	if _, port, err := net.SplitHostPort(host); err == nil && (port == "80" || port == "443") {
+		return strings.TrimSuffix(host, ":"+port)
+	}
+	return host
+}
+
+// purgeIndex is the secondary index of the entries by tags, hosts and paths.
+// It is rebuilt from the metadata of the entries when the cache is warmed up.
+type purgeIndex struct {
+	tags  map[string]map[string]struct{}
+	hosts map[string]*hostIndex
+}
+
+// hostIndex is the index of the entries of a host by paths.
+type hostIndex struct {
+	// paths are the paths of the keys.
+	paths map[string]string
+	// sorted are the keys sorted by their paths. It is sorted lazily when the keys are looked up by a prefix.
+	sorted []string
+	dirty  bool
+}
+
+func newPurgeIndex() *purgeIndex {
+	return &purgeIndex{
+		tags:  make(map[string]map[string]struct{}),
+		hosts: make(map[string]*hostIndex),
+	}
+}
+
+func (x *purgeIndex) add(ci *cacheItem) {
+	for _, tag := range ci.tags {
+		keys, ok := x.tags[tag]
+		if !ok {
+			keys = make(map[string]struct{})
+			x.tags[tag] = keys
+		}
+		keys[ci.key] = struct{}{}
+	}
+	h, ok := x.hosts[ci.host]
+	if !ok {
+		h = &hostIndex{paths: make(map[string]string)}
+		x.hosts[ci.host] = h
+	}
+	h.paths[ci.key] = ci.path
+	h.dirty = true
+}
+
+func (x *purgeIndex) remove(ci *cacheItem) {
+	for _, tag := range ci.tags {
+		delete(x.tags[tag], ci.key)
+		if len(x.tags[tag]) == 0 {
+			delete(x.tags, tag)
+		}
+	}
+	h, ok := x.hosts[ci.host]
+	if !ok {
+		return
+	}
+	delete(h.paths, ci.key)
+	h.dirty = true
+	if len(h.paths) == 0 {
+		delete(x.hosts, ci.host)
+	}
+}
+
+func (x *purgeIndex) byTag(tag string) []string {
+	keys := make([]string, 0, len(x.tags[tag]))
+	for key := range x.tags[tag] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (x *purgeIndex) byPathPrefix(host, prefix string) []string {
+	h, ok := x.hosts[host]
+	if !ok {
+		return nil
+	}
+	if prefix == "" {
+		keys := make([]string, 0, len(h.paths))
+		for key := range h.paths {
+			keys = append(keys, key)
+		}
+		return keys
+	}
+	if h.dirty {
+		h.sorted = h.sorted[:0]
+		for key := range h.paths {
+			h.sorted = append(h.sorted, key)
+		}
+		sort.Slice(h.sorted, func(i, j int) bool {
+			return h.paths[h.sorted[i]] < h.paths[h.sorted[j]]
+		})
+		h.dirty = false
+	}
+	i := sort.Search(len(h.sorted), func(i int) bool {
+		return h.paths[h.sorted[i]] >= prefix
+	})
+	var keys []string
+	for ; i < len(h.sorted) && strings.HasPrefix(h.paths[h.sorted[i]], prefix); i++ {
+		keys = append(keys, h.sorted[i])
+	}
+	return keys
+}
@@ -0,0 +1,193 @@
+package rcutil
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/2manymws/rc"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResponseTags(t *testing.T) {
+	res := &http.Response{Header: http.Header{
+		"Surrogate-Key": {"a  b", "c"},
+		"Cache-Tag":     {"d, e,,f"},
+	}}
+	want := []string{"a", "b", "c", "d", "e", "f"}
+	if diff := cmp.Diff(want, ResponseTags(res)); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestDiskCachePurge(t *testing.T) {
+	entries := []struct {
+		key    string
+		host   string
+		path   string
+		tags   []string
+		header http.Header
+	}{
+		{"a1", "a.example", "/products/1", []string{"product"}, http.Header{}},
+		{"a2", "a.example", "/products/2", nil, http.Header{"Surrogate-Key": {"product product-2"}}},
+		{"a3", "a.example", "/about", nil, http.Header{"Cache-Tag": {"page"}}},
+		{"b1", "b.example", "/products/1", nil, http.Header{"Cache-Tag": {"product, product-1"}}},
+		{"b2", "b.example", "/product", nil, http.Header{}},
+		{"a4", "A.Example:443", "/contact", nil, http.Header{}},
+	}
+	tests := []struct {
+		name  string
+		purge func(dc *DiskCache) int
+		want  []string
+	}{
+		{"tag", func(dc *DiskCache) int { return dc.PurgeByTag("product") }, []string{"a1", "a2", "b1"}},
+		{"tag from header", func(dc *DiskCache) int { return dc.PurgeByTag("product-2") }, []string{"a2"}},
+		{"unknown tag", func(dc *DiskCache) int { return dc.PurgeByTag("unknown") }, nil},
+		{"host", func(dc *DiskCache) int { return dc.PurgeByHost("a.example") }, []string{"a1", "a2", "a3", "a4"}},
+		{"host with default port", func(dc *DiskCache) int { return dc.PurgeByHost("A.example:80") }, []string{"a1", "a2", "a3", "a4"}},
+		{"host with other port", func(dc *DiskCache) int { return dc.PurgeByHost("a.example:8080") }, nil},
+		{"path prefix", func(dc *DiskCache) int { return dc.PurgeByPathPrefix("a.example", "/products/") }, []string{"a1", "a2"}},
+		{"path prefix of all hosts", func(dc *DiskCache) int { return dc.PurgeByPathPrefix("", "/product") }, []string{"a1", "a2", "b1", "b2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dc, err := NewDiskCache(root, 1*time.Hour, DisableWarmUp())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				req := &http.Request{Method: http.MethodGet, Host: e.host, Header: http.Header{}, URL: &url.URL{Path: e.path}, Body: newBody(nil)}
+				res := &http.Response{StatusCode: http.StatusOK, Header: e.header, Body: newBody([]byte("hello"))}
+				if err := dc.StoreWithTags(e.key, req, res, e.tags...); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// The index is rebuilt from the metadata
+			dc, err = NewDiskCache(root, 1*time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			<-dc.warmUpDone
+
+			if got := tt.purge(dc); got != len(tt.want) {
+				t.Errorf("got %d, want %d", got, len(tt.want))
+			}
+			var purged []string
+			for _, e := range entries {
+				_, _, err := dc.Load(e.key)
+				switch {
+				case errors.Is(err, rc.ErrCacheNotFound):
+					purged = append(purged, e.key)
+				case err != nil:
+					t.Fatal(err)
+				}
+			}
+			sort.Strings(purged)
+			if diff := cmp.Diff(tt.want, purged); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestDiskCachePurgeReplaced(t *testing.T) {
+	dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := func(tags ...string) {
+		req := &http.Request{Method: http.MethodGet, Host: "a.example", Header: http.Header{}, URL: &url.URL{Path: "/"}, Body: newBody(nil)}
+		res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("hello"))}
+		if err := dc.StoreWithTags("test", req, res, tags...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store("old")
+	store("new")
+	// The tags of the replaced entry are forgotten
+	if got := dc.PurgeByTag("old"); got != 0 {
+		t.Errorf("got %d, want %d", got, 0)
+	}
+	if got := dc.PurgeByTag("new"); got != 1 {
+		t.Errorf("got %d, want %d", got, 1)
+	}
+}
+
+func TestDiskCacheSoftPurge(t *testing.T) {
+	root := t.TempDir()
+	dc, err := NewDiskCache(root, 1*time.Hour, DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := func(key, cacheControl string) {
+		req := &http.Request{Method: http.MethodGet, Host: "a.example", Header: http.Header{}, URL: &url.URL{Path: "/" + key}, Body: newBody(nil)}
+		res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Cache-Control": {cacheControl}}, Body: newBody([]byte("hello"))}
+		if err := dc.StoreWithTags(key, req, res, "tag"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store("swr", "max-age=3600, stale-while-revalidate=60")
+	store("no-stale", "max-age=3600")
+
+	if err := dc.SoftPurge("swr"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.SoftPurge("swr"); err != nil {
+		t.Errorf("soft purge of a stale entry: %v", err)
+	}
+	if err := dc.SoftPurge("no-stale"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.SoftPurge("unknown"); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+	if m := dc.Metrics(); m.SoftPurges != 1 || m.HardPurges != 1 {
+		t.Errorf("got %d soft and %d hard purges, want 1 and 1", m.SoftPurges, m.HardPurges)
+	}
+
+	// The entry without stale windows is deleted
+	if _, _, err := dc.LoadExpired("no-stale"); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+
+	// The stale entry is kept across restarts, while the files of the deleted entry are removed
+	time.Sleep(100 * time.Millisecond)
+	dc, err = NewDiskCache(root, 1*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-dc.warmUpDone
+	if _, _, err := dc.Load("swr"); !errors.Is(err, rc.ErrCacheExpired) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheExpired)
+	}
+	_, res, stale, err := dc.LoadStale("swr", StaleWhileRevalidate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stale {
+		t.Error("want stale")
+	}
+	if got := readBody(res.Body); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+	_, res, err = dc.LoadExpired("swr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = readBody(res.Body)
+
+	// Entries revalidated after a soft purge are fresh again
+	if err := dc.Revalidate("swr", &http.Response{StatusCode: http.StatusNotModified, Header: http.Header{}}, 1*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got := dc.SoftPurgeByTag("tag"); got != 1 {
+		t.Errorf("got %d, want %d", got, 1)
+	}
+	if got := dc.Metrics().SoftPurges; got != 1 {
+		t.Errorf("got %d, want %d", got, 1)
+	}
+}
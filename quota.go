@@ -0,0 +1,160 @@
+package rcutil
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+)
+
+// QuotaGroupFunc returns the name of the quota group that the entry of key belongs to, e.g. req.Host.
+// The entry belongs to no group if it returns "".
+type QuotaGroupFunc func(key string, req *http.Request) string
+
+// Quota is the limits of a quota group.
+type Quota struct {
+	// MaxKeys is the maximum number of keys in the group. If NoLimitKeys is specified, there is no limit.
+	MaxKeys uint64
+	// MaxTotalBytes is the maximum number of bytes in the group. If NoLimitTotalBytes is specified, there is no limit.
+	MaxTotalBytes uint64
+	// NewEvictionPolicy returns the EvictionPolicy that chooses the entries of the group to be evicted
+	// when the group exceeds the quota. If it is nil, NewLRUPolicy is used.
+	NewEvictionPolicy func() EvictionPolicy
+}
+
+// GroupMetrics is the metrics of a quota group.
+type GroupMetrics struct {
+	KeyCount     uint64
+	TotalBytes   uint64
+	LogicalBytes uint64
+	// Hits is the number of times the entries of the group are loaded.
+	Hits uint64
+	// Evictions is the number of entries evicted to keep the group within the quota.
+	Evictions uint64
+}
+
+// quotaGroup is the accounting of the entries of a quota group. The fields other than policy and hits are guarded by DiskCache.mu.
+type quotaGroup struct {
+	name  string
+	quota Quota
+	// policy is guarded by DiskCache.policyMu.
+	policy EvictionPolicy
+	// explicit is true if the quota is set by GroupQuota. Other groups are dropped when they become empty.
+	explicit      bool
+	keys          uint64
+	totalBytes    uint64
+	logicalBytes  uint64
+	reservedKeys  uint64
+	reservedBytes uint64
+	hits          uint64
+	evictions     uint64
+}
+
+func newQuotaGroup(name string, q Quota, explicit bool) *quotaGroup {
+	newPolicy := q.NewEvictionPolicy
+	if newPolicy == nil {
+		newPolicy = NewLRUPolicy
+	}
+	return &quotaGroup{
+		name:     name,
+		quota:    q,
+		policy:   newPolicy(),
+		explicit: explicit,
+	}
+}
+
+// full reports whether the entry of n bytes that replaces old does not fit in the group.
+func (g *quotaGroup) full(old *cacheItem, n uint64) bool {
+	var replacedKeys, replacedBytes uint64
+	if old != nil && old.group == g {
+		replacedKeys, replacedBytes = 1, old.bytes
+	}
+	if g.quota.MaxKeys != NoLimitKeys && g.keys+g.reservedKeys+1 > g.quota.MaxKeys+replacedKeys {
+		return true
+	}
+	if g.quota.MaxTotalBytes != NoLimitTotalBytes && g.totalBytes+g.reservedBytes+n > g.quota.MaxTotalBytes+replacedBytes {
+		return true
+	}
+	return false
+}
+
+// over reports whether the group exceeds the quota.
+func (g *quotaGroup) over() bool {
+	return (g.quota.MaxKeys != NoLimitKeys && g.keys > g.quota.MaxKeys) ||
+		(g.quota.MaxTotalBytes != NoLimitTotalBytes && g.totalBytes > g.quota.MaxTotalBytes)
+}
+
+// groupName returns the name of the quota group of the entry.
+func (c *DiskCache) groupName(key string, req *http.Request) string {
+	if c.quotaGroupFunc == nil {
+		return ""
+	}
+	return c.quotaGroupFunc(key, req)
+}
+
+// group returns the quota group of name, creating it if it does not exist. It returns nil for no group.
+// c.mu must be held.
+func (c *DiskCache) group(name string) *quotaGroup {
+	if c.quotaGroupFunc == nil || name == "" {
+		return nil
+	}
+	g, ok := c.groups[name]
+	if !ok {
+		g = newQuotaGroup(name, c.defaultQuota, false)
+		c.groups[name] = g
+	}
+	return g
+}
+
+// dropGroup drops the group if it has no entries and no reservations, so that the groups do not pile up.
+// c.mu must be held.
+func (c *DiskCache) dropGroup(g *quotaGroup) {
+	if g.explicit || g.keys > 0 || g.reservedKeys > 0 {
+		return
+	}
+	if c.groups[g.name] == g {
+		delete(c.groups, g.name)
+	}
+}
+
+// trimGroups evicts the entries of the groups that exceed their quotas, e.g. after the quotas are lowered.
+func (c *DiskCache) trimGroups() {
+	c.mu.Lock()
+	var over []*quotaGroup
+	for _, g := range c.groups {
+		if g.over() {
+			over = append(over, g)
+		}
+	}
+	c.mu.Unlock()
+	for _, g := range over {
+		for {
+			c.mu.Lock()
+			done := !g.over()
+			c.mu.Unlock()
+			if done {
+				break
+			}
+			if evicted, _ := c.evictOne(context.Background(), g); !evicted {
+				break
+			}
+		}
+	}
+}
+
+// groupMetrics returns the metrics of the groups. c.mu must be held.
+func (c *DiskCache) groupMetrics() map[string]GroupMetrics {
+	if c.quotaGroupFunc == nil {
+		return nil
+	}
+	m := make(map[string]GroupMetrics, len(c.groups))
+	for name, g := range c.groups {
+		m[name] = GroupMetrics{
+			KeyCount:     g.keys,
+			TotalBytes:   g.totalBytes,
+			LogicalBytes: g.logicalBytes,
+			Hits:         atomic.LoadUint64(&g.hits),
+			Evictions:    g.evictions,
+		}
+	}
+	return m
+}
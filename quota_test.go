@@ -0,0 +1,167 @@
+package rcutil
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/2manymws/rc"
+	"github.com/google/go-cmp/cmp"
+)
+
+func groupByHost(key string, req *http.Request) string {
+	return req.Host
+}
+
+func storeHost(t *testing.T, dc *DiskCache, host, path string) error {
+	t.Helper()
+	req := &http.Request{Method: http.MethodGet, Host: host, Header: http.Header{}, URL: &url.URL{Path: path}, Body: newBody(nil)}
+	res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("hello"))}
+	return dc.Store(host+path, req, res)
+}
+
+func TestDiskCacheQuotaGroups(t *testing.T) {
+	dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, UseQuotaGroups(groupByHost), GroupQuota("noisy.example", Quota{MaxKeys: 2}), DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/a", "/b"} {
+		if err := storeHost(t, dc, "quiet.example", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if err := storeHost(t, dc, "noisy.example", fmt.Sprintf("/%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The noisy group evicts its own entries only
+	for _, key := range []string{"quiet.example/a", "quiet.example/b", "noisy.example/3", "noisy.example/4"} {
+		if _, _, err := dc.Load(key); err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+	for _, key := range []string{"noisy.example/0", "noisy.example/1", "noisy.example/2"} {
+		if _, _, err := dc.Load(key); !errors.Is(err, rc.ErrCacheNotFound) {
+			t.Errorf("%s: got %v, want %v", key, err, rc.ErrCacheNotFound)
+		}
+	}
+
+	m := dc.Metrics()
+	// The size of the metadata varies by a few bytes with the timestamps in it
+	bytesOf := func(keys ...string) uint64 {
+		t.Helper()
+		var total uint64
+		for _, key := range keys {
+			bytes, err := entryBytes(dc.pathkey(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			total += bytes
+		}
+		return total
+	}
+	quiet := bytesOf("quiet.example/a", "quiet.example/b")
+	noisy := bytesOf("noisy.example/3", "noisy.example/4")
+	want := map[string]GroupMetrics{
+		"quiet.example": {KeyCount: 2, TotalBytes: quiet, LogicalBytes: quiet, Hits: 2},
+		"noisy.example": {KeyCount: 2, TotalBytes: noisy, LogicalBytes: noisy, Hits: 2, Evictions: 3},
+	}
+	if diff := cmp.Diff(want, m.Groups); diff != "" {
+		t.Error(diff)
+	}
+
+	if _, err := NewDiskCache(t.TempDir(), 1*time.Hour, UseQuotaGroups(nil)); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestDiskCacheQuotaGroupsTotalBytes(t *testing.T) {
+	root := t.TempDir()
+	dc, err := NewDiskCache(root, 1*time.Hour, UseQuotaGroups(groupByHost), DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storeHost(t, dc, "a.example", "/0"); err != nil {
+		t.Fatal(err)
+	}
+	// The size of the metadata varies by a few bytes with the timestamps in it
+	size := dc.Metrics().TotalBytes
+	bytes := size + 24
+
+	// Each group holds 2 entries, and the cache holds 5 entries
+	dc, err = NewDiskCache(t.TempDir(), 1*time.Hour,
+		UseQuotaGroups(groupByHost),
+		DefaultGroupQuota(Quota{MaxTotalBytes: 2 * bytes, NewEvictionPolicy: NewLFUPolicy}),
+		MaxTotalBytes(5*bytes),
+		DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"a.example", "b.example"} {
+		for i := 0; i < 3; i++ {
+			if err := storeHost(t, dc, host, fmt.Sprintf("/%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := storeHost(t, dc, "c.example", "/0"); err != nil {
+		t.Fatal(err)
+	}
+	// The global limit is still respected without auto-adjust
+	if err := storeHost(t, dc, "d.example", "/0"); !errors.Is(err, ErrCacheFull) {
+		t.Errorf("got %v, want %v", err, ErrCacheFull)
+	}
+	m := dc.Metrics()
+	if m.KeyCount != 5 || m.TotalBytes > 5*bytes {
+		t.Errorf("got %d keys of %d bytes, want 5 keys of <= %d bytes", m.KeyCount, m.TotalBytes, 5*bytes)
+	}
+	for _, host := range []string{"a.example", "b.example"} {
+		if got := m.Groups[host]; got.KeyCount != 2 || got.TotalBytes > 2*bytes {
+			t.Errorf("%s: got %d keys of %d bytes, want 2 keys of <= %d bytes", host, got.KeyCount, got.TotalBytes, 2*bytes)
+		}
+	}
+	if _, ok := m.Groups["d.example"]; ok {
+		t.Error("empty group should be dropped")
+	}
+
+	// An entry larger than the quota is never stored
+	dc, err = NewDiskCache(t.TempDir(), 1*time.Hour, UseQuotaGroups(groupByHost), GroupQuota("a.example", Quota{MaxTotalBytes: size / 2}), DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storeHost(t, dc, "a.example", "/0"); !errors.Is(err, ErrCacheFull) {
+		t.Errorf("got %v, want %v", err, ErrCacheFull)
+	}
+}
+
+func TestDiskCacheQuotaGroupsWarmUp(t *testing.T) {
+	root := t.TempDir()
+	dc, err := NewDiskCache(root, 1*time.Hour, UseQuotaGroups(groupByHost), DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := storeHost(t, dc, "a.example", fmt.Sprintf("/%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The groups are restored from the metadata and trimmed to the lowered quota
+	dc, err = NewDiskCache(root, 1*time.Hour, UseQuotaGroups(groupByHost), GroupQuota("a.example", Quota{MaxKeys: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-dc.warmUpDone
+	if got := dc.Metrics().Groups["a.example"].KeyCount; got != 2 {
+		t.Errorf("got %d, want %d", got, 2)
+	}
+	if _, _, err := dc.Load("a.example/0"); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+}
@@ -0,0 +1,302 @@
+package rcutil
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// httpRange is a byte range of a body.
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+// ServeRange returns the response to the Range request made from the cached full response.
+// It returns 206 Partial Content (multipart/byteranges for multiple ranges) or 416 Range Not Satisfiable,
+// or the cached response as it is if the request is not a satisfiable Range request (e.g. If-Range does not match).
+// The body of the cached response must implement io.ReaderAt or io.ReadSeeker, and only the requested ranges are read.
+// The body of the returned response closes the body of the cached response.
+func ServeRange(req *http.Request, cachedRes *http.Response) (*http.Response, error) {
+	rangeHeader := req.Header.Get("Range")
+	if rangeHeader == "" || req.Method != http.MethodGet || cachedRes.StatusCode != http.StatusOK {
+		return cachedRes, nil
+	}
+	if !ifRangeMatches(req, cachedRes) {
+		return cachedRes, nil
+	}
+	ra, size, err := readerAt(cachedRes)
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := parseRange(rangeHeader, size)
+	switch {
+	case errors.Is(err, errNoOverlap):
+		res := newRangeResponse(cachedRes, http.StatusRequestedRangeNotSatisfiable)
+		res.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		res.Header.Set("Content-Length", "0")
+		res.ContentLength = 0
+		res.Body = closer{Reader: strings.NewReader(""), Closer: cachedRes.Body}
+		return res, nil
+	case err != nil:
+		// Ignore an invalid Range header
+		return cachedRes, nil
+	}
+	if sumRangesSize(ranges) > size {
+		// The total of the ranges is larger than the body, so it is more efficient to send the full body.
+		return cachedRes, nil
+	}
+
+	res := newRangeResponse(cachedRes, http.StatusPartialContent)
+	if len(ranges) == 1 {
+		r := ranges[0]
+		res.Header.Set("Content-Range", r.contentRange(size))
+		res.Header.Set("Content-Length", strconv.FormatInt(r.length, 10))
+		res.ContentLength = r.length
+		res.Body = closer{Reader: io.NewSectionReader(ra, r.start, r.length), Closer: cachedRes.Body}
+		return res, nil
+	}
+
+	contentType := cachedRes.Header.Get("Content-Type")
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	length := multipartLength(ranges, mw.Boundary(), contentType, size)
+	res.Header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	res.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	res.Header.Del("Content-Range")
+	res.ContentLength = length
+	go func() {
+		for _, r := range ranges {
+			part, err := mw.CreatePart(r.mimeHeader(contentType, size))
+			if err != nil {
+				_ = pw.CloseWithError(err) //nostyle:handlerrors
+				return
+			}
+			if _, err := io.Copy(part, io.NewSectionReader(ra, r.start, r.length)); err != nil {
+				_ = pw.CloseWithError(err) //nostyle:handlerrors
+				return
+			}
+		}
+		_ = pw.CloseWithError(mw.Close()) //nostyle:handlerrors
+	}()
+	res.Body = closer{Reader: pr, Closer: closeFunc(func() error {
+		return errors.Join(pr.Close(), cachedRes.Body.Close())
+	})}
+	return res, nil
+}
+
+func newRangeResponse(cachedRes *http.Response, status int) *http.Response {
+	res := *cachedRes
+	res.StatusCode = status
+	res.Status = fmt.Sprintf("%d %s", status, http.StatusText(status))
+	res.Header = cachedRes.Header.Clone()
+	res.Header.Set("Accept-Ranges", "bytes")
+	res.TransferEncoding = nil
+	return &res
+}
+
+// ifRangeMatches reports whether the If-Range condition of the request is satisfied by the cached response.
+// See https://httpwg.org/specs/rfc9110.html#field.if-range
+func ifRangeMatches(req *http.Request, cachedRes *http.Response) bool {
+	ir := strings.TrimSpace(req.Header.Get("If-Range"))
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		// If-Range requires a strong comparison
+		etag := cachedRes.Header.Get("ETag")
+		return !strings.HasPrefix(ir, "W/") && etag != "" && !strings.HasPrefix(etag, "W/") && ir == etag
+	}
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(cachedRes.Header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return t.Equal(lastModified)
+}
+
+// readerAt returns the body of the response as io.ReaderAt and its size.
+func readerAt(res *http.Response) (io.ReaderAt, int64, error) {
+	var ra io.ReaderAt
+	switch b := res.Body.(type) {
+	case io.ReaderAt:
+		ra = b
+	case io.ReadSeeker:
+		ra = &seekReaderAt{rs: b}
+	default:
+		return nil, 0, ErrBodyNotSeekable
+	}
+	if res.ContentLength >= 0 {
+		return ra, res.ContentLength, nil
+	}
+	switch b := res.Body.(type) {
+	case interface{ Size() int64 }:
+		return ra, b.Size(), nil
+	case io.Seeker:
+		// Restore the offset so that the body can still be served as it is
+		cur, err := b.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, 0, err
+		}
+		end, err := b.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, err := b.Seek(cur, io.SeekStart); err != nil {
+			return nil, 0, err
+		}
+		return ra, end - cur, nil
+	default:
+		return nil, 0, ErrBodyNotSeekable
+	}
+}
+
+// seekReaderAt is io.ReaderAt implemented by io.ReadSeeker.
+type seekReaderAt struct {
+	mu sync.Mutex
+	rs io.ReadSeeker
+}
+
+func (s *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(s.rs, p)
+}
+
+var (
+	errInvalidRange = errors.New("invalid range")
+	errNoOverlap    = errors.New("invalid range: failed to overlap")
+)
+
+// parseRange parses a Range header string as per RFC 9110.
+// See https://httpwg.org/specs/rfc9110.html#field.range
+func parseRange(s string, size int64) ([]httpRange, error) {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errInvalidRange
+	}
+	var ranges []httpRange
+	noOverlap := false
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = textproto.TrimString(ra)
+		if ra == "" {
+			continue
+		}
+		start, end, ok := strings.Cut(ra, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		start, end = textproto.TrimString(start), textproto.TrimString(end)
+		var r httpRange
+		if start == "" {
+			// suffix-range
+			if end == "" || end[0] == '-' {
+				return nil, errInvalidRange
+			}
+			i, err := strconv.ParseInt(end, 10, 64)
+			if i < 0 || err != nil {
+				return nil, errInvalidRange
+			}
+			if i == 0 {
+				noOverlap = true
+				continue
+			}
+			if i > size {
+				i = size
+			}
+			r.start = size - i
+			r.length = size - r.start
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errInvalidRange
+			}
+			if i >= size {
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				r.length = size - r.start
+			} else {
+				i, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > i {
+					return nil, errInvalidRange
+				}
+				if i >= size {
+					i = size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if noOverlap && len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	if len(ranges) == 0 {
+		return nil, errInvalidRange
+	}
+	return ranges, nil
+}
+
+func sumRangesSize(ranges []httpRange) int64 {
+	var size int64
+	for _, r := range ranges {
+		size += r.length
+	}
+	return size
+}
+
+// multipartLength returns the length of the multipart/byteranges body.
+func multipartLength(ranges []httpRange, boundary, contentType string, size int64) int64 {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	_ = mw.SetBoundary(boundary) //nostyle:handlerrors
+	for _, r := range ranges {
+		_, _ = mw.CreatePart(r.mimeHeader(contentType, size)) //nostyle:handlerrors
+		w += countingWriter(r.length)
+	}
+	_ = mw.Close() //nostyle:handlerrors
+	return int64(w)
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+type closer struct {
+	io.Reader
+	io.Closer
+}
+
+type closeFunc func() error
+
+func (f closeFunc) Close() error {
+	return f()
+}
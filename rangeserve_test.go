@@ -0,0 +1,161 @@
+package rcutil
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type seekableBody struct {
+	*bytes.Reader
+}
+
+func (seekableBody) Close() error { return nil }
+
+func TestServeRange(t *testing.T) {
+	const (
+		body         = "0123456789abcdefghij"
+		lastModified = "Mon, 01 Jan 2024 00:00:00 GMT"
+	)
+	tests := []struct {
+		name             string
+		method           string
+		reqHeader        http.Header
+		wantStatus       int
+		wantContentRange string
+		wantBody         string
+		wantParts        []string
+	}{
+		{"no Range", http.MethodGet, http.Header{}, http.StatusOK, "", body, nil},
+		{"single range", http.MethodGet, http.Header{"Range": {"bytes=0-4"}}, http.StatusPartialContent, "bytes 0-4/20", "01234", nil},
+		{"open-ended range", http.MethodGet, http.Header{"Range": {"bytes=15-"}}, http.StatusPartialContent, "bytes 15-19/20", "fghij", nil},
+		{"suffix range", http.MethodGet, http.Header{"Range": {"bytes=-3"}}, http.StatusPartialContent, "bytes 17-19/20", "hij", nil},
+		{"end beyond the body", http.MethodGet, http.Header{"Range": {"bytes=18-100"}}, http.StatusPartialContent, "bytes 18-19/20", "ij", nil},
+		{"multiple ranges", http.MethodGet, http.Header{"Range": {"bytes=0-1, 10-12"}}, http.StatusPartialContent, "", "", []string{"01", "abc"}},
+		{"multiple ranges with an unsatisfiable one", http.MethodGet, http.Header{"Range": {"bytes=0-1,30-40"}}, http.StatusPartialContent, "bytes 0-1/20", "01", nil},
+		{"unsatisfiable", http.MethodGet, http.Header{"Range": {"bytes=20-30"}}, http.StatusRequestedRangeNotSatisfiable, "bytes */20", "", nil},
+		{"invalid", http.MethodGet, http.Header{"Range": {"bytes=5-1"}}, http.StatusOK, "", body, nil},
+		{"not bytes", http.MethodGet, http.Header{"Range": {"items=0-1"}}, http.StatusOK, "", body, nil},
+		{"ranges larger than the body", http.MethodGet, http.Header{"Range": {"bytes=0-19,0-19"}}, http.StatusOK, "", body, nil},
+		{"HEAD", http.MethodHead, http.Header{"Range": {"bytes=0-4"}}, http.StatusOK, "", body, nil},
+		{"If-Range ETag matches", http.MethodGet, http.Header{"Range": {"bytes=0-4"}, "If-Range": {`"v1"`}}, http.StatusPartialContent, "bytes 0-4/20", "01234", nil},
+		{"If-Range ETag does not match", http.MethodGet, http.Header{"Range": {"bytes=0-4"}, "If-Range": {`"v2"`}}, http.StatusOK, "", body, nil},
+		{"If-Range weak ETag", http.MethodGet, http.Header{"Range": {"bytes=0-4"}, "If-Range": {`W/"v1"`}}, http.StatusOK, "", body, nil},
+		{"If-Range date matches", http.MethodGet, http.Header{"Range": {"bytes=0-4"}, "If-Range": {lastModified}}, http.StatusPartialContent, "bytes 0-4/20", "01234", nil},
+		{"If-Range date does not match", http.MethodGet, http.Header{"Range": {"bytes=0-4"}, "If-Range": {"Tue, 02 Jan 2024 00:00:00 GMT"}}, http.StatusOK, "", body, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, "http://example.com/foo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header = tt.reqHeader
+			cachedRes := &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{"Content-Type": {"text/plain"}, "Etag": {`"v1"`}, "Last-Modified": {lastModified}, "Content-Length": {"20"}},
+				Body:          seekableBody{bytes.NewReader([]byte(body))},
+				ContentLength: int64(len(body)),
+			}
+			got, err := ServeRange(req, cachedRes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer got.Body.Close()
+			if got.StatusCode != tt.wantStatus {
+				t.Errorf("got %v, want %v", got.StatusCode, tt.wantStatus)
+			}
+			if got := got.Header.Get("Content-Range"); got != tt.wantContentRange {
+				t.Errorf("got %q, want %q", got, tt.wantContentRange)
+			}
+			b, err := io.ReadAll(got.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Header.Get("Content-Length") != strconv.Itoa(len(b)) || got.ContentLength != int64(len(b)) {
+				t.Errorf("got Content-Length %q (%d), want %d", got.Header.Get("Content-Length"), got.ContentLength, len(b))
+			}
+			if tt.wantParts == nil {
+				if string(b) != tt.wantBody {
+					t.Errorf("got %q, want %q", string(b), tt.wantBody)
+				}
+				return
+			}
+			mediaType, params, err := mime.ParseMediaType(got.Header.Get("Content-Type"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mediaType != "multipart/byteranges" {
+				t.Errorf("got %q, want %q", mediaType, "multipart/byteranges")
+			}
+			var parts []string
+			mr := multipart.NewReader(bytes.NewReader(b), params["boundary"])
+			for {
+				p, err := mr.NextPart()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := p.Header.Get("Content-Type"); got != "text/plain" {
+					t.Errorf("got %q, want %q", got, "text/plain")
+				}
+				pb, err := io.ReadAll(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				parts = append(parts, string(pb))
+			}
+			if diff := cmp.Diff(tt.wantParts, parts); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestServeRangeFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "body")
+	if err := os.WriteFile(p, []byte("0123456789"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=-4")
+	// The size is taken from the file if the Content-Length is unknown
+	got, err := ServeRange(req, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: f, ContentLength: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := got.Header.Get("Content-Range"); got != "bytes 6-9/10" {
+		t.Errorf("got %q, want %q", got, "bytes 6-9/10")
+	}
+	if got := readBody(got.Body); got != "6789" {
+		t.Errorf("got %q, want %q", got, "6789")
+	}
+	if err := got.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(make([]byte, 1)); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("got %v, want %v", err, os.ErrClosed)
+	}
+
+	if _, err := ServeRange(req, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("0123456789"))}); !errors.Is(err, ErrBodyNotSeekable) {
+		t.Errorf("got %v, want %v", err, ErrBodyNotSeekable)
+	}
+}
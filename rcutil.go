@@ -3,8 +3,11 @@ package rcutil
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
 	"errors"
+	"hash"
 	"io"
 	"net/http"
 	"net/url"
@@ -23,6 +26,7 @@ var ErrInvalidRequest = errors.New("invalid request")
 
 // Seed returns seed for cache key.
 // The return value seed is NOT path-safe.
+// To select variants by the Vary header of the response instead of vary, use Seed(req, nil) as the primary key of DiskCache.StoreVary and DiskCache.LoadVary.
 func Seed(req *http.Request, vary []string) (string, error) {
 	if req == nil {
 		return "", ErrNoRequest
@@ -142,8 +146,23 @@ func DecodeReqRes(r io.Reader) (*http.Request, *http.Response, error) {
 	return req, res, nil
 }
 
+// KeyHasher converts a cache key into a path-safe string.
+type KeyHasher func(key string) string
+
+// SHA256KeyHasher is a KeyHasher that returns the hex-encoded SHA-256 digest of the key.
+func SHA256KeyHasher(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// NoKeyHasher is a KeyHasher that returns the key as it is.
+// It is the responsibility of the user to pass path-safe keys.
+func NoKeyHasher(key string) string {
+	return key
+}
+
 // KeyToPath converts key to path
-// It is the responsibility of the user to pass path-safe keys
+// The key must be path-safe. DiskCache converts keys with its KeyHasher before calling it.
 func KeyToPath(key string, n int) string {
 	if n <= 0 {
 		return key
@@ -169,11 +188,16 @@ func PathToKey(path string) string {
 type WriteCounter struct {
 	io.Writer
 	Bytes uint64
+	// Hash, if not nil, is also written the bytes written.
+	Hash hash.Hash
 }
 
 // Write writes bytes.
 func (wc *WriteCounter) Write(p []byte) (int, error) {
 	n, err := wc.Writer.Write(p)
+	if wc.Hash != nil {
+		_, _ = wc.Hash.Write(p[:n]) //nostyle:handlerrors
+	}
 	if err != nil {
 		return n, err
 	}
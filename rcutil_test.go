@@ -330,6 +330,24 @@ func TestKeyToPath(t *testing.T) {
 	}
 }
 
+func TestSHA256KeyHasher(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"get|example.com|/foo|", "38d4e11b4e5f88fc7ac921b41fab2e1552be533723d104013623b1cd7b2524fb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			got := SHA256KeyHasher(tt.key)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
 func newBody(b []byte) io.ReadCloser {
 	return io.NopCloser(bytes.NewReader(b))
 }
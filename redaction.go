@@ -0,0 +1,91 @@
+package rcutil
+
+import "net/http"
+
+// RedactionPolicy is a policy for header fields that are not written to the cache files.
+// Header field names are case-insensitive.
+type RedactionPolicy struct {
+	// RequestHeaders are the request header fields that are not stored.
+	RequestHeaders []string
+	// AllowRequestHeaders, if not nil, are the only request header fields that are stored
+	// in addition to the fields named in the Vary header of the response.
+	// RequestHeaders are not stored even if they are allowed.
+	AllowRequestHeaders []string
+	// ResponseHeaders are the response header fields that are not stored (e.g. Set-Cookie).
+	ResponseHeaders []string
+}
+
+// DefaultRedactionPolicy returns the default RedactionPolicy of DiskCache.
+// It does not store the credentials of the request nor the cookies set by the response.
+func DefaultRedactionPolicy() RedactionPolicy {
+	return RedactionPolicy{
+		RequestHeaders:  []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key"},
+		ResponseHeaders: []string{"Set-Cookie", "Set-Cookie2"},
+	}
+}
+
+// NoRedactionPolicy is a RedactionPolicy that stores all header fields as they are.
+var NoRedactionPolicy = RedactionPolicy{}
+
+// redactRequest returns the request without the header fields that are not stored.
+// The original request is not modified.
+func (p RedactionPolicy) redactRequest(req *http.Request, res *http.Response) *http.Request {
+	var allow map[string]struct{}
+	if p.AllowRequestHeaders != nil {
+		allow = headerSet(p.AllowRequestHeaders)
+		spec, _ := VarySpec(res) //nostyle:handlerrors
+		for _, h := range spec {
+			allow[h] = struct{}{}
+		}
+	}
+	h := redactHeader(req.Header, headerSet(p.RequestHeaders), allow)
+	if h == nil {
+		return req
+	}
+	r := *req
+	r.Header = h
+	return &r
+}
+
+// redactResponse returns the response without the header fields that are not stored.
+// The original response is not modified.
+func (p RedactionPolicy) redactResponse(res *http.Response) *http.Response {
+	h := redactHeader(res.Header, headerSet(p.ResponseHeaders), nil)
+	if h == nil {
+		return res
+	}
+	r := *res
+	r.Header = h
+	return &r
+}
+
+// redactHeader returns a copy of h without the fields in deny and, if allow is not nil, the fields not in allow.
+// It returns nil if no field is removed.
+func redactHeader(h http.Header, deny, allow map[string]struct{}) http.Header {
+	removed := false
+	redacted := make(http.Header, len(h))
+	for k, v := range h {
+		ck := http.CanonicalHeaderKey(k)
+		if _, ok := deny[ck]; ok {
+			removed = true
+			continue
+		}
+		if _, ok := allow[ck]; allow != nil && !ok {
+			removed = true
+			continue
+		}
+		redacted[k] = v
+	}
+	if !removed {
+		return nil
+	}
+	return redacted
+}
+
+func headerSet(names []string) map[string]struct{} {
+	s := make(map[string]struct{}, len(names))
+	for _, n := range names {
+		s[http.CanonicalHeaderKey(n)] = struct{}{}
+	}
+	return s
+}
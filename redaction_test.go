@@ -0,0 +1,124 @@
+package rcutil
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRedactionPolicy(t *testing.T) {
+	reqHeader := http.Header{
+		"Authorization": {"Bearer secret"},
+		"Cookie":        {"session=secret"},
+		"X-Api-Key":     {"secret"},
+		"Accept":        {"text/html"},
+		"User-Agent":    {"test"},
+	}
+	tests := []struct {
+		name          string
+		policy        RedactionPolicy
+		vary          string
+		wantReqHeader http.Header
+		wantResHeader http.Header
+	}{
+		{
+			"default",
+			DefaultRedactionPolicy(),
+			"",
+			http.Header{"Accept": {"text/html"}, "User-Agent": {"test"}},
+			http.Header{"Vary": {""}},
+		},
+		{
+			"no redaction",
+			NoRedactionPolicy,
+			"",
+			reqHeader,
+			http.Header{"Set-Cookie": {"session=secret"}, "Vary": {""}},
+		},
+		{
+			"allowlist with Vary",
+			RedactionPolicy{RequestHeaders: []string{"authorization"}, AllowRequestHeaders: []string{}},
+			"accept, authorization",
+			http.Header{"Accept": {"text/html"}},
+			http.Header{"Set-Cookie": {"session=secret"}, "Vary": {"accept, authorization"}},
+		},
+		{
+			"response headers",
+			RedactionPolicy{ResponseHeaders: []string{"set-cookie"}},
+			"",
+			reqHeader,
+			http.Header{"Vary": {""}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{Header: reqHeader.Clone()}
+			res := &http.Response{Header: http.Header{"Set-Cookie": {"session=secret"}, "Vary": {tt.vary}}}
+			if diff := cmp.Diff(tt.wantReqHeader, tt.policy.redactRequest(req, res).Header); diff != "" {
+				t.Error(diff)
+			}
+			if diff := cmp.Diff(tt.wantResHeader, tt.policy.redactResponse(res).Header); diff != "" {
+				t.Error(diff)
+			}
+			if diff := cmp.Diff(reqHeader, req.Header); diff != "" {
+				t.Errorf("original request should not be modified: %s", diff)
+			}
+		})
+	}
+}
+
+func TestDefaultRedactionPolicy(t *testing.T) {
+	p := DefaultRedactionPolicy()
+	p.RequestHeaders[0] = "X-Test"
+	if got := DefaultRedactionPolicy().RequestHeaders[0]; got != "Authorization" {
+		t.Errorf("the default should not be modified: %q", got)
+	}
+}
+
+func TestDiskCacheRedaction(t *testing.T) {
+	dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "test"
+	req := &http.Request{Method: http.MethodGet, Header: http.Header{"Authorization": {"Bearer secret"}, "X-Test": {"test"}}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+	res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Set-Cookie": {"session=secret"}, "Etag": {`"v1"`}}, Body: newBody([]byte("hello"))}
+	if err := dc.Store(key, req, res); err != nil {
+		t.Fatal(err)
+	}
+	for _, suffix := range []string{reqCacheSuffix, resCacheSuffix} {
+		b, err := os.ReadFile(dc.pathkey(key) + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(b, []byte("secret")) {
+			t.Errorf("%s contains the secret", suffix)
+		}
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("original request should not be modified: %q", got)
+	}
+
+	// Redacted response header fields are not merged by revalidation
+	if err := dc.Revalidate(key, &http.Response{StatusCode: http.StatusNotModified, Header: http.Header{"Set-Cookie": {"session=secret"}}}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	gotReq, gotRes, err := dc.Load(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gotReq.Header.Get("Authorization"); got != "" {
+		t.Errorf("got %q, want no Authorization", got)
+	}
+	if got := gotReq.Header.Get("X-Test"); got != "test" {
+		t.Errorf("got %q, want %q", got, "test")
+	}
+	if got := gotRes.Header.Get("Set-Cookie"); got != "" {
+		t.Errorf("got %q, want no Set-Cookie", got)
+	}
+}
@@ -0,0 +1,134 @@
+package rcutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/2manymws/rc"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// notUpdatedHeaders are header fields of a 304 response that are not merged into the stored response.
+// See https://httpwg.org/specs/rfc9111.html#rfc.section.3.2
+var notUpdatedHeaders = map[string]struct{}{
+	"Connection":          {},
+	"Content-Length":      {},
+	"Keep-Alive":          {},
+	"Proxy-Authenticate":  {},
+	"Proxy-Authorization": {},
+	"Proxy-Connection":    {},
+	"Te":                  {},
+	"Trailer":             {},
+	"Transfer-Encoding":   {},
+	"Upgrade":             {},
+}
+
+// NewConditionalRequest returns a copy of the request with the validators of the cached response
+// (If-None-Match from ETag and If-Modified-Since from Last-Modified).
+// If the cached response has no validators, it returns false.
+func NewConditionalRequest(req *http.Request, cachedRes *http.Response) (*http.Request, bool) {
+	etag := cachedRes.Header.Get("ETag")
+	lastModified := cachedRes.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return nil, false
+	}
+	creq := req.Clone(req.Context())
+	if etag != "" {
+		creq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		creq.Header.Set("If-Modified-Since", lastModified)
+	}
+	return creq, true
+}
+
+// LoadExpired loads the response from the cache even if it has expired, as long as it is kept by EnableKeepStale.
+// It is intended to build a conditional request for revalidation.
+func (c *DiskCache) LoadExpired(key string) (*http.Request, *http.Response, error) {
+	return c.LoadExpiredContext(context.Background(), key)
+}
+
+// LoadExpiredContext loads the response from the cache even if it has expired like LoadExpired.
+// ctx applies as in LoadContext.
+func (c *DiskCache) LoadExpiredContext(ctx context.Context, key string) (_ *http.Request, _ *http.Response, err error) {
+	if err := c.rlockKey(ctx, key); err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		err = errors.Join(err, c.keyMu.RUnlockKey(key))
+	}()
+	i := c.getItem(key, time.Now())
+	if i == nil {
+		return nil, nil, rc.ErrCacheNotFound
+	}
+	return loadContext(ctx, i.Value(), c.loadItem)
+}
+
+// Revalidate merges the header fields of the 304 Not Modified response into the cached response
+// and refreshes its TTL without rewriting the body.
+// If you want to refresh the cache with no TTL, use NoLimitTTL.
+func (c *DiskCache) Revalidate(key string, res *http.Response, ttl time.Duration) error {
+	return c.RevalidateContext(context.Background(), key, res, ttl)
+}
+
+// RevalidateContext merges the header fields of the 304 Not Modified response into the cached response like Revalidate.
+// It returns the error of ctx if ctx is done while it waits for the lock of the key.
+func (c *DiskCache) RevalidateContext(ctx context.Context, key string, res *http.Response, ttl time.Duration) (err error) {
+	if res.StatusCode != http.StatusNotModified {
+		return fmt.Errorf("not a 304 Not Modified response: %d", res.StatusCode)
+	}
+	if err := c.lockKey(ctx, key); err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, c.keyMu.UnlockKey(key))
+	}()
+	i := c.m.Get(key, ttlcache.WithDisableTouchOnHit[string, *cacheItem]())
+	if i == nil {
+		return rc.ErrCacheNotFound
+	}
+	ci := i.Value()
+	meta, _, err := c.readMeta(ci.pathkey)
+	if err != nil {
+		return errors.Join(err, rc.ErrCacheNotFound)
+	}
+	now := time.Now()
+	header := meta.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	redacted := headerSet(c.redaction.ResponseHeaders)
+	for k, v := range res.Header {
+		if _, ok := notUpdatedHeaders[http.CanonicalHeaderKey(k)]; ok {
+			continue
+		}
+		if _, ok := redacted[http.CanonicalHeaderKey(k)]; ok {
+			continue
+		}
+		header[http.CanonicalHeaderKey(k)] = v
+	}
+	meta.Header = header
+	if res.Header.Get("Cache-Control") != "" {
+		meta.StaleWhileRevalidate, meta.StaleIfError = c.staleWindows(res)
+	}
+	meta.StoredAt = now
+	meta.ExpiresAt = c.expiresAt(now, ttl)
+	if err := c.writeMeta(ci.pathkey, meta); err != nil {
+		return err
+	}
+
+	nci := *ci
+	nci.header = header
+	nci.bytes, nci.logicalBytes = meta.Bytes, meta.LogicalBytes
+	nci.storedAt = now
+	nci.retention = c.retention(meta)
+	nci.staleWhileRevalidate = meta.StaleWhileRevalidate
+	nci.staleIfError = meta.StaleIfError
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setItem(&nci, cacheTTL(now, meta.ExpiresAt, nci.retention))
+	return nil
+}
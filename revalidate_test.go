@@ -0,0 +1,192 @@
+package rcutil
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/2manymws/rc"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewConditionalRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		resHeader http.Header
+		want      http.Header
+		wantOK    bool
+	}{
+		{"no validators", http.Header{}, nil, false},
+		{"ETag", http.Header{"Etag": {`"abc"`}}, http.Header{"X-Test": {"test"}, "If-None-Match": {`"abc"`}}, true},
+		{
+			"ETag and Last-Modified",
+			http.Header{"Etag": {`W/"abc"`}, "Last-Modified": {"Mon, 01 Jan 2024 00:00:00 GMT"}},
+			http.Header{"X-Test": {"test"}, "If-None-Match": {`W/"abc"`}, "If-Modified-Since": {"Mon, 01 Jan 2024 00:00:00 GMT"}},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Test", "test")
+			got, ok := NewConditionalRequest(req, &http.Response{Header: tt.resHeader})
+			if ok != tt.wantOK {
+				t.Errorf("got %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if diff := cmp.Diff(tt.want, got.Header); diff != "" {
+				t.Error(diff)
+			}
+			if len(req.Header) != 1 {
+				t.Errorf("original request should not be modified: %v", req.Header)
+			}
+		})
+	}
+}
+
+func TestDiskCacheRevalidate(t *testing.T) {
+	root := t.TempDir()
+	dc, err := NewDiskCache(root, 24*time.Hour, EnableKeepStale(time.Hour), DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "test"
+	req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+	res := &http.Response{
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Etag": {`"v1"`}, "X-Test": {"old"}, "Content-Length": {"5"}},
+		Body:          newBody([]byte("hello")),
+		ContentLength: 5,
+	}
+	ttl := 50 * time.Millisecond
+	if err := dc.StoreWithTTL(key, req, res, ttl); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(ttl)
+
+	if _, _, err := dc.Load(key); !errors.Is(err, rc.ErrCacheExpired) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheExpired)
+	}
+	_, stale, err := dc.LoadExpired(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readBody(stale.Body); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+	creq, ok := NewConditionalRequest(req, stale)
+	if !ok {
+		t.Fatal("want conditional request")
+	}
+	if got := creq.Header.Get("If-None-Match"); got != `"v1"` {
+		t.Errorf("got %q, want %q", got, `"v1"`)
+	}
+
+	notModified := &http.Response{
+		StatusCode: http.StatusNotModified,
+		Header:     http.Header{"Etag": {`"v1"`}, "X-Test": {"new"}, "Content-Length": {"0"}},
+	}
+	if err := dc.Revalidate(key, notModified, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, dc := range []*DiskCache{dc, func() *DiskCache {
+		// Revalidated header fields and TTL are persisted
+		dc, err := NewDiskCache(root, 24*time.Hour, EnableKeepStale(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-dc.warmUpDone
+		return dc
+	}()} {
+		_, got, err := dc.Load(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := got.Header.Get("X-Test"); got != "new" {
+			t.Errorf("got %q, want %q", got, "new")
+		}
+		if got := got.Header.Get("Content-Length"); got != "5" {
+			t.Errorf("got %q, want %q", got, "5")
+		}
+		if got := readBody(got.Body); got != "hello" {
+			t.Errorf("got %q, want %q", got, "hello")
+		}
+	}
+
+	if err := dc.Revalidate(key, &http.Response{StatusCode: http.StatusOK}, time.Hour); err == nil {
+		t.Error("want error")
+	}
+	if err := dc.Revalidate("notfound", notModified, time.Hour); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+}
+
+func TestDiskCacheKeepStaleExpires(t *testing.T) {
+	root := t.TempDir()
+	grace := 50 * time.Millisecond
+	dc, err := NewDiskCache(root, 24*time.Hour, EnableKeepStale(grace), DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "test"
+	req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+	res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("hello"))}
+	if err := dc.StoreWithTTL(key, req, res, grace); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * grace)
+	if _, _, err := dc.LoadExpired(key); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+}
+
+func TestDiskCacheKeepStaleWithTouchOnHit(t *testing.T) {
+	ttl := 200 * time.Millisecond
+	dc, err := NewDiskCache(t.TempDir(), 24*time.Hour, EnableKeepStale(1*time.Hour), EnableTouchOnHit(), DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "test"
+	req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+	res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("hello"))}
+	if err := dc.StoreWithTTL(key, req, res, ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	// A hit on the fresh entry extends it
+	time.Sleep(ttl / 2)
+	_, got, err := dc.Load(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = readBody(got.Body)
+	time.Sleep(ttl * 3 / 4)
+	if _, got, err = dc.Load(key); err != nil {
+		t.Fatalf("the touched entry has expired: %v", err)
+	}
+	_ = readBody(got.Body)
+
+	// A hit on the stale entry does not make it fresh again
+	time.Sleep(ttl * 3 / 2)
+	for i := 0; i < 2; i++ {
+		if _, _, err := dc.Load(key); !errors.Is(err, rc.ErrCacheExpired) {
+			t.Errorf("got %v, want %v", err, rc.ErrCacheExpired)
+		}
+		if _, got, err := dc.LoadExpired(key); err != nil {
+			t.Error(err)
+		} else {
+			_ = readBody(got.Body)
+		}
+	}
+}
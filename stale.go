@@ -0,0 +1,98 @@
+package rcutil
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/2manymws/rc"
+)
+
+// StaleMode is a mode of serving stale caches.
+// See https://httpwg.org/specs/rfc5861.html
+type StaleMode int
+
+const (
+	// StaleWhileRevalidate serves a stale cache while the cache is revalidated in the background.
+	StaleWhileRevalidate StaleMode = iota + 1
+	// StaleIfError serves a stale cache when the origin returns an error.
+	StaleIfError
+)
+
+// LoadStale loads the response from the cache.
+// If the cache has expired but is still within the window of mode, it returns the stale response with stale true.
+// The Age header of the returned response is computed from the time the response was stored.
+func (c *DiskCache) LoadStale(key string, mode StaleMode) (*http.Request, *http.Response, bool, error) {
+	return c.LoadStaleContext(context.Background(), key, mode)
+}
+
+// LoadStaleContext loads the response from the cache like LoadStale.
+// ctx applies as in LoadContext.
+func (c *DiskCache) LoadStaleContext(ctx context.Context, key string, mode StaleMode) (_ *http.Request, _ *http.Response, stale bool, err error) {
+	if err := c.rlockKey(ctx, key); err != nil {
+		return nil, nil, false, err
+	}
+	defer func() {
+		err = errors.Join(err, c.keyMu.RUnlockKey(key))
+	}()
+	now := time.Now()
+	// The stale windows are measured from the expiration, which is not extended by the stale hits
+	i := c.getItem(key, now)
+	if i == nil {
+		return nil, nil, false, rc.ErrCacheNotFound
+	}
+	ci := i.Value()
+	if isStale(i, now) {
+		var window time.Duration
+		switch mode {
+		case StaleWhileRevalidate:
+			window = ci.staleWhileRevalidate
+		case StaleIfError:
+			window = ci.staleIfError
+		}
+		freshUntil := i.ExpiresAt().Add(-ci.retention)
+		if now.Sub(freshUntil) >= window {
+			return nil, nil, false, rc.ErrCacheExpired
+		}
+		stale = true
+	}
+	req, res, err := loadContext(ctx, ci, c.loadItem)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	setAge(res, ci.storedAt, now)
+	return req, res, stale, nil
+}
+
+// staleWindows returns the windows in which the response can be served stale.
+// The stale-while-revalidate and stale-if-error directives of the response take precedence over the global windows.
+// A response that must be revalidated is never served stale.
+func (c *DiskCache) staleWindows(res *http.Response) (swr, sie time.Duration) {
+	cc := parseCacheControl(res.Header)
+	if cc.has("must-revalidate") || cc.has("proxy-revalidate") || cc.has("no-cache") {
+		return 0, 0
+	}
+	swr, sie = c.staleWhileRevalidate, c.staleIfError
+	if cc.has("stale-while-revalidate") {
+		swr = cc.seconds("stale-while-revalidate")
+	}
+	if cc.has("stale-if-error") {
+		sie = cc.seconds("stale-if-error")
+	}
+	return swr, sie
+}
+
+// setAge sets the Age header of the response to the age of the stored response plus the time since it was stored.
+func setAge(res *http.Response, storedAt, now time.Time) {
+	age := int64(0)
+	if v, err := strconv.ParseInt(strings.TrimSpace(res.Header.Get("Age")), 10, 64); err == nil && v > 0 {
+		age = v
+	}
+	if storedAt.Before(now) {
+		age += int64(now.Sub(storedAt) / time.Second)
+	}
+	res.Header.Set("Age", strconv.FormatInt(age, 10))
+}
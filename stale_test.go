@@ -0,0 +1,104 @@
+package rcutil
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/2manymws/rc"
+)
+
+func TestDiskCacheLoadStale(t *testing.T) {
+	const ttl = 100 * time.Millisecond
+	tests := []struct {
+		name         string
+		opts         []DiskCacheOption
+		cacheControl string
+		mode         StaleMode
+		wait         time.Duration
+		wantStale    bool
+		wantErr      error
+	}{
+		{"fresh", nil, "", StaleWhileRevalidate, 0, false, nil},
+		{"no window", nil, "", StaleWhileRevalidate, ttl, false, rc.ErrCacheNotFound},
+		{"global stale-while-revalidate", []DiskCacheOption{EnableStaleWhileRevalidate(time.Hour)}, "", StaleWhileRevalidate, ttl, true, nil},
+		{"global stale-while-revalidate does not apply to stale-if-error", []DiskCacheOption{EnableStaleWhileRevalidate(time.Hour)}, "", StaleIfError, ttl, false, rc.ErrCacheExpired},
+		{"global stale-if-error", []DiskCacheOption{EnableStaleIfError(time.Hour)}, "", StaleIfError, ttl, true, nil},
+		{"per entry stale-while-revalidate", nil, "max-age=1, stale-while-revalidate=3600", StaleWhileRevalidate, ttl, true, nil},
+		{"per entry stale-if-error", nil, "max-age=1, stale-if-error=3600", StaleIfError, ttl, true, nil},
+		{"per entry window takes precedence", []DiskCacheOption{EnableStaleIfError(time.Hour), EnableKeepStale(time.Hour)}, "stale-if-error=0", StaleIfError, ttl, false, rc.ErrCacheExpired},
+		{"must-revalidate", []DiskCacheOption{EnableStaleIfError(time.Hour), EnableKeepStale(time.Hour)}, "must-revalidate", StaleIfError, ttl, false, rc.ErrCacheExpired},
+		{"out of window", []DiskCacheOption{EnableStaleIfError(ttl), EnableKeepStale(time.Hour)}, "", StaleIfError, 2 * ttl, false, rc.ErrCacheExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			dc, err := NewDiskCache(t.TempDir(), 24*time.Hour, append(tt.opts, DisableWarmUp())...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := "test"
+			req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+			res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Age": {"10"}}, Body: newBody([]byte("hello"))}
+			if tt.cacheControl != "" {
+				res.Header.Set("Cache-Control", tt.cacheControl)
+			}
+			if err := dc.StoreWithTTL(key, req, res, ttl); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(tt.wait)
+			_, got, stale, err := dc.LoadStale(key, tt.mode)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if stale != tt.wantStale {
+				t.Errorf("got %v, want %v", stale, tt.wantStale)
+			}
+			age, err := strconv.Atoi(got.Header.Get("Age"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if age < 10 {
+				t.Errorf("got Age %d, want >= 10", age)
+			}
+			if got := readBody(got.Body); got != "hello" {
+				t.Errorf("got %q, want %q", got, "hello")
+			}
+		})
+	}
+}
+
+func TestDiskCacheLoadStaleWithTouchOnHit(t *testing.T) {
+	const ttl = 200 * time.Millisecond
+	dc, err := NewDiskCache(t.TempDir(), 24*time.Hour, EnableStaleIfError(ttl), EnableKeepStale(time.Hour), EnableTouchOnHit(), DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "test"
+	req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+	res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte("hello"))}
+	if err := dc.StoreWithTTL(key, req, res, ttl); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(ttl * 3 / 2)
+	_, got, stale, err := dc.LoadStale(key, StaleIfError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stale {
+		t.Error("want stale")
+	}
+	_ = readBody(got.Body)
+
+	// The window ends at ttl after the expiration regardless of the hit
+	time.Sleep(ttl * 3 / 4)
+	if _, _, _, err := dc.LoadStale(key, StaleIfError); !errors.Is(err, rc.ErrCacheExpired) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheExpired)
+	}
+}
@@ -0,0 +1,128 @@
+package rcutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+)
+
+var errStreamAborted = errors.New("stream aborted before the end of the body")
+
+// StoreStream stores the response in the cache with the default TTL while the body is streamed.
+func (c *DiskCache) StoreStream(key string, req *http.Request, res *http.Response) (*http.Response, error) {
+	return c.StoreStreamWithTTL(key, req, res, ttlcache.DefaultTTL)
+}
+
+// StoreStreamWithTTL returns a copy of the response whose body is written to the cache while it is read,
+// so that the client does not have to wait for the cache to be written.
+// The entry is committed when the body is read to the end and closed.
+// It is discarded if the body is closed before the end or the upstream body returns an error.
+// Close of the returned body returns the error of committing the entry, if any.
+// If the response is not admitted, it returns ErrNotAdmitted. A body of unknown length that turns out to be
+// out of MinObjectBytes and MaxObjectBytes is discarded.
+func (c *DiskCache) StoreStreamWithTTL(key string, req *http.Request, res *http.Response, ttl time.Duration) (_ *http.Response, err error) {
+	now := time.Now()
+	if err := c.admit(key, req, res); err != nil {
+		return nil, err
+	}
+	meta := &entryMeta{Group: c.groupName(key, req)}
+	meta.setPurgeIndex(req, res)
+	tmp := &tempFiles{}
+	reqBytes, err := c.writeTempEntryFile(&tmp.req, &tmp.reqChecksum, c.entryAAD(key, reqCacheSuffix), func(w io.Writer) error {
+		return EncodeReq(c.redaction.redactRequest(req, res), w)
+	})
+	if err != nil {
+		return nil, errors.Join(err, tmp.remove())
+	}
+
+	pr, pw := io.Pipe()
+	cached := *res
+	cached.Body = pr
+	b := &teeBody{
+		upstream: res.Body,
+		pw:       pw,
+		done:     make(chan struct{}),
+	}
+	admitted, admitSize := c.admitBody(&cached)
+	go func() {
+		defer close(b.done)
+		resBytes, err := c.writeTempRes(key, tmp, admitted)
+		// Unblock the writes of the body that the response does not consume.
+		_ = pr.CloseWithError(errStreamAborted) //nostyle:handlerrors
+		if err != nil {
+			b.err = err
+			return
+		}
+		tmp.bytes = reqBytes + resBytes
+	}()
+	b.commit = func(ok bool) error {
+		<-b.done
+		if !ok || b.err != nil || admitSize() != nil {
+			return tmp.remove()
+		}
+		return c.commit(context.Background(), key, tmp, &cached, ttl, meta, now)
+	}
+
+	streamed := *res
+	streamed.Body = b
+	return &streamed, nil
+}
+
+// teeBody is a body that writes what is read from the upstream body to the pipe to the cache file.
+type teeBody struct {
+	upstream io.ReadCloser
+	pw       *io.PipeWriter
+	// done is closed when the response has been written to the cache file.
+	done chan struct{}
+	// err is the error of writing the response to the cache file.
+	err error
+	// commit commits the entry if ok is true, otherwise discards it.
+	commit func(ok bool) error
+	mu     sync.Mutex
+	eof    bool
+	failed bool
+	closed bool
+}
+
+// Read reads from the upstream body and writes it to the cache file.
+// Errors of writing to the cache file do not affect the client.
+func (b *teeBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err := b.upstream.Read(p)
+	if n > 0 && !b.failed {
+		if _, werr := b.pw.Write(p[:n]); werr != nil {
+			b.failed = true
+		}
+	}
+	switch {
+	case err == io.EOF:
+		b.eof = true
+		_ = b.pw.Close() //nostyle:handlerrors
+	case err != nil:
+		b.failed = true
+		_ = b.pw.CloseWithError(err) //nostyle:handlerrors
+	}
+	return n, err
+}
+
+// Close closes the upstream body and commits or discards the entry.
+func (b *teeBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	ok := b.eof && !b.failed
+	if !b.eof {
+		_ = b.pw.CloseWithError(errStreamAborted) //nostyle:handlerrors
+	}
+	err := b.upstream.Close()
+	return errors.Join(err, b.commit(ok))
+}
@@ -0,0 +1,131 @@
+package rcutil
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2manymws/rc"
+)
+
+func TestDiskCacheStoreStream(t *testing.T) {
+	body := strings.Repeat("hello", 10000)
+	readAll := func(t *testing.T, r io.Reader) {
+		t.Helper()
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != body {
+			t.Errorf("got %d bytes, want %d bytes", len(b), len(body))
+		}
+	}
+	tests := []struct {
+		name          string
+		contentLength int64
+		upstream      func() io.Reader
+		read          func(t *testing.T, r io.Reader)
+		wantCached    bool
+	}{
+		{
+			"read to the end",
+			int64(len(body)),
+			func() io.Reader { return strings.NewReader(body) },
+			readAll,
+			true,
+		},
+		{
+			"unknown length",
+			-1,
+			func() io.Reader { return strings.NewReader(body) },
+			readAll,
+			true,
+		},
+		{
+			"client aborts",
+			int64(len(body)),
+			func() io.Reader { return strings.NewReader(body) },
+			func(t *testing.T, r io.Reader) {
+				t.Helper()
+				if _, err := io.ReadFull(r, make([]byte, 10)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			false,
+		},
+		{
+			"upstream error",
+			int64(len(body)),
+			func() io.Reader { return &failingReader{r: strings.NewReader(body), n: 100} },
+			func(t *testing.T, r io.Reader) {
+				t.Helper()
+				if _, err := io.ReadAll(r); !errors.Is(err, errInterrupted) {
+					t.Errorf("got %v, want %v", err, errInterrupted)
+				}
+			},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dc, err := NewDiskCache(root, 24*time.Hour, DisableWarmUp())
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := "test"
+			req := &http.Request{Method: http.MethodGet, Header: http.Header{}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+			res := &http.Response{
+				Proto:         "HTTP/1.1",
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{"X-Test": {"test"}},
+				Body:          io.NopCloser(tt.upstream()),
+				ContentLength: tt.contentLength,
+			}
+			streamed, err := dc.StoreStream(key, req, res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.read(t, streamed.Body)
+			if _, _, err := dc.Load(key); !errors.Is(err, rc.ErrCacheNotFound) {
+				t.Errorf("entry should not be committed before Close: %v", err)
+			}
+			if err := streamed.Body.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			_, cached, err := dc.Load(key)
+			if !tt.wantCached {
+				if !errors.Is(err, rc.ErrCacheNotFound) {
+					t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := readBody(cached.Body); got != body {
+					t.Errorf("got %d bytes, want %d bytes", len(got), len(body))
+				}
+				if got := cached.Header.Get("X-Test"); got != "test" {
+					t.Errorf("got %q, want %q", got, "test")
+				}
+			}
+			entries, err := os.ReadDir(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if strings.HasPrefix(e.Name(), tmpFilePrefix) {
+					t.Errorf("temporary file remains: %s", e.Name())
+				}
+			}
+		})
+	}
+}
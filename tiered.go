@@ -0,0 +1,427 @@
+package rcutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/2manymws/keyrwmutex"
+	"github.com/2manymws/rc"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// TieredCache is a cache that composes a MemoryCache as the hot tier in front of a DiskCache.
+// Entries loaded from the disk tier are promoted to the memory tier, and entries are stored to the disk tier
+// and the memory tier at the same time (write-through) or to the disk tier later (write-back).
+// Entries that are larger than the memory tier are stored to the disk tier only.
+type TieredCache struct {
+	memory *MemoryCache
+	disk   *DiskCache
+	keyMu  *keyrwmutex.KeyRWMutex
+	// queue is the entries to be written to the disk tier by write-back. It is nil if write-back is disabled.
+	queue chan *bufferedEntry
+	// pending is the latest entry of each key waiting to be written to the disk tier. It is guarded by mu.
+	pending map[string]*bufferedEntry
+	closed  bool
+	mu      sync.Mutex
+	done    chan struct{}
+
+	memoryHits uint64
+	diskHits   uint64
+	misses     uint64
+	promotions uint64
+}
+
+// TieredCacheOption is an option for TieredCache.
+type TieredCacheOption func(*TieredCache) error
+
+// EnableWriteBack enables write-back, which stores entries to the memory tier and writes them to the disk tier
+// in the background. If more than queueSize entries are waiting, the entry is written to the disk tier synchronously.
+// The entries that the disk tier fails to store are deleted from the memory tier.
+func EnableWriteBack(queueSize int) TieredCacheOption {
+	return func(t *TieredCache) error {
+		if queueSize < 1 {
+			return fmt.Errorf("queue size must be positive: %d", queueSize)
+		}
+		t.queue = make(chan *bufferedEntry, queueSize)
+		return nil
+	}
+}
+
+// TierMetrics is the metrics of each tier of TieredCache.
+type TierMetrics struct {
+	Memory Metrics
+	Disk   Metrics
+	// MemoryHits and DiskHits are the numbers of loads served by each tier, and Misses is the number of loads served by neither.
+	MemoryHits uint64
+	DiskHits   uint64
+	Misses     uint64
+	// Promotions is the number of entries copied from the disk tier to the memory tier.
+	Promotions uint64
+	// PendingWrites is the number of entries waiting to be written to the disk tier by write-back.
+	PendingWrites uint64
+}
+
+// bufferedEntry is an entry whose bodies are read in advance.
+type bufferedEntry struct {
+	key     string
+	req     *http.Request
+	reqBody []byte
+	res     *http.Response
+	resBody []byte
+	ttl     time.Duration
+}
+
+func (e *bufferedEntry) request() *http.Request {
+	r := e.req.Clone(context.Background())
+	r.Body = io.NopCloser(bytes.NewReader(e.reqBody))
+	return r
+}
+
+func (e *bufferedEntry) response() *http.Response {
+	r := cloneResponse(e.res)
+	r.Body = io.NopCloser(bytes.NewReader(e.resBody))
+	return r
+}
+
+// NewTieredCache returns a new TieredCache of the memory tier and the disk tier.
+func NewTieredCache(memory *MemoryCache, disk *DiskCache, opts ...TieredCacheOption) (*TieredCache, error) {
+	t := &TieredCache{
+		memory:  memory,
+		disk:    disk,
+		keyMu:   keyrwmutex.New(0),
+		pending: make(map[string]*bufferedEntry),
+		done:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(t); err != nil {
+			return nil, err
+		}
+	}
+	if t.queue != nil {
+		go t.writeBackLoop()
+	} else {
+		close(t.done)
+	}
+	return t, nil
+}
+
+// Store stores the response in the cache with the default TTL.
+func (t *TieredCache) Store(key string, req *http.Request, res *http.Response) error {
+	return t.StoreWithTTL(key, req, res, ttlcache.DefaultTTL)
+}
+
+// StoreWithTTL stores the response in the cache with the specified TTL.
+// If you want to store the response with no TTL, use NoLimitTTL.
+// The TTL is computed with the default TTL of the disk tier in both tiers.
+func (t *TieredCache) StoreWithTTL(key string, req *http.Request, res *http.Response, ttl time.Duration) (err error) {
+	t.keyMu.LockKey(key)
+	defer func() {
+		err = errors.Join(err, t.keyMu.UnlockKey(key))
+	}()
+	e, res, err := t.buffer(key, req, res, ttl)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		// Too large for the memory tier
+		t.memory.Delete(key)
+		t.dropPending(key)
+		return t.disk.StoreWithTTL(key, req, res, ttl)
+	}
+	if err := t.setMemory(e, time.Now()); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	if t.queue != nil && !t.closed {
+		select {
+		case t.queue <- e:
+			t.pending[key] = e
+			t.mu.Unlock()
+			return nil
+		default:
+		}
+	}
+	delete(t.pending, key)
+	t.mu.Unlock()
+	return t.writeDisk(e)
+}
+
+// buffer reads the bodies of the request and response for both tiers.
+// If the response is too large for the memory tier, it returns a nil entry and the response whose body is
+// the part read so far followed by the rest.
+func (t *TieredCache) buffer(key string, req *http.Request, res *http.Response, ttl time.Duration) (*bufferedEntry, *http.Response, error) {
+	limit := int64(t.memory.maxTotalBytes)
+	if t.memory.maxTotalBytes != NoLimitTotalBytes && res.ContentLength > limit {
+		return nil, res, nil
+	}
+	var resBody []byte
+	if res.Body != nil && res.Body != http.NoBody {
+		r := io.Reader(res.Body)
+		if t.memory.maxTotalBytes != NoLimitTotalBytes {
+			r = io.LimitReader(res.Body, limit+1)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, nil, errors.Join(err, res.Body.Close())
+		}
+		if t.memory.maxTotalBytes != NoLimitTotalBytes && int64(len(b)) > limit {
+			rest := *res
+			rest.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(b), res.Body), res.Body}
+			return nil, &rest, nil
+		}
+		if err := res.Body.Close(); err != nil {
+			return nil, nil, err
+		}
+		resBody = b
+	}
+	reqBody, err := readAllAndClose(req.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &bufferedEntry{key: key, req: req.Clone(req.Context()), reqBody: reqBody, res: cloneResponse(res), resBody: resBody, ttl: ttl}, nil, nil
+}
+
+// setMemory stores the entry to the memory tier as the disk tier would store it, so that both tiers return the same entry.
+func (t *TieredCache) setMemory(e *bufferedEntry, now time.Time) error {
+	req := t.disk.redaction.redactRequest(e.req, e.res)
+	res := t.disk.redaction.redactResponse(e.res)
+	if err := t.memory.set(e.key, req, e.reqBody, res, e.resBody, t.disk.expiresAt(now, e.ttl)); err != nil {
+		t.memory.Delete(e.key)
+		if errors.Is(err, ErrCacheFull) {
+			// Larger than the memory tier as the header fields are counted
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// writeDisk writes the entry to the disk tier, and deletes it from the memory tier if it fails.
+// The lock of the key must be held.
+func (t *TieredCache) writeDisk(e *bufferedEntry) error {
+	if err := t.disk.StoreWithTTL(e.key, e.request(), e.response(), e.ttl); err != nil {
+		t.memory.Delete(e.key)
+		return err
+	}
+	return nil
+}
+
+func (t *TieredCache) writeBackLoop() {
+	defer close(t.done)
+	for e := range t.queue {
+		t.keyMu.LockKey(e.key)
+		t.writePending(e.key)
+		_ = t.keyMu.UnlockKey(e.key) //nostyle:handlerrors
+	}
+}
+
+// writePending writes the latest entry of key waiting for write-back to the disk tier, if any.
+// The lock of the key must be held.
+func (t *TieredCache) writePending(key string) {
+	t.mu.Lock()
+	e, ok := t.pending[key]
+	delete(t.pending, key)
+	t.mu.Unlock()
+	if ok {
+		_ = t.writeDisk(e) //nostyle:handlerrors
+	}
+}
+
+// flush writes all the entries waiting for write-back to the disk tier.
+func (t *TieredCache) flush() {
+	t.mu.Lock()
+	keys := make([]string, 0, len(t.pending))
+	for key := range t.pending {
+		keys = append(keys, key)
+	}
+	t.mu.Unlock()
+	for _, key := range keys {
+		t.keyMu.LockKey(key)
+		t.writePending(key)
+		_ = t.keyMu.UnlockKey(key) //nostyle:handlerrors
+	}
+}
+
+func (t *TieredCache) dropPending(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, key)
+}
+
+// Load loads the response from the memory tier, or from the disk tier and promotes it to the memory tier.
+func (t *TieredCache) Load(key string) (_ *http.Request, _ *http.Response, err error) {
+	t.keyMu.RLockKey(key)
+	defer func() {
+		err = errors.Join(err, t.keyMu.RUnlockKey(key))
+	}()
+	if req, res, err := t.memory.Load(key); err == nil {
+		atomic.AddUint64(&t.memoryHits, 1)
+		return req, res, nil
+	}
+	t.mu.Lock()
+	e, ok := t.pending[key]
+	t.mu.Unlock()
+	if ok {
+		// Evicted from the memory tier before it is written to the disk tier
+		atomic.AddUint64(&t.memoryHits, 1)
+		return e.request(), e.response(), nil
+	}
+	req, res, err := t.disk.Load(key)
+	if err != nil {
+		if errors.Is(err, rc.ErrCacheNotFound) || errors.Is(err, rc.ErrCacheExpired) {
+			atomic.AddUint64(&t.misses, 1)
+		}
+		return nil, nil, err
+	}
+	atomic.AddUint64(&t.diskHits, 1)
+	return t.promote(key, req, res)
+}
+
+// promote stores the entry loaded from the disk tier to the memory tier, unless it is too large.
+func (t *TieredCache) promote(key string, req *http.Request, res *http.Response) (*http.Request, *http.Response, error) {
+	info, err := t.disk.Info(key)
+	if err != nil {
+		return req, res, nil
+	}
+	e, res, err := t.buffer(key, req, res, ttlcache.DefaultTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if e == nil {
+		return req, res, nil
+	}
+	if err := t.memory.set(key, e.req, e.reqBody, e.res, e.resBody, info.ExpiresAt); err == nil {
+		atomic.AddUint64(&t.promotions, 1)
+	}
+	return e.request(), e.response(), nil
+}
+
+// Delete deletes the cache from both tiers.
+func (t *TieredCache) Delete(key string) {
+	t.keyMu.LockKey(key)
+	defer func() {
+		_ = t.keyMu.UnlockKey(key) //nostyle:handlerrors
+	}()
+	t.dropPending(key)
+	t.memory.Delete(key)
+	t.disk.Delete(key)
+}
+
+// PurgeByTag deletes the entries with the tag from both tiers and returns the number of them.
+// The tags are those of the disk tier, so the entries waiting for write-back are written to it first.
+func (t *TieredCache) PurgeByTag(tag string) int {
+	t.flush()
+	return t.purge(t.disk.keysByTag(tag), false)
+}
+
+// PurgeByHost deletes the entries whose requests are for the host from both tiers and returns the number of them.
+func (t *TieredCache) PurgeByHost(host string) int {
+	t.flush()
+	return t.purge(t.disk.keysByPathPrefix(host, ""), false)
+}
+
+// PurgeByPathPrefix deletes the entries whose request paths start with prefix from both tiers and returns the number of them.
+// If host is empty, the entries of all hosts are deleted.
+func (t *TieredCache) PurgeByPathPrefix(host, prefix string) int {
+	t.flush()
+	return t.purge(t.disk.keysByPathPrefix(host, prefix), false)
+}
+
+// SoftPurge marks the entry of the disk tier as stale like DiskCache.SoftPurge and deletes it from the memory tier,
+// which can not serve stale entries.
+func (t *TieredCache) SoftPurge(key string) (err error) {
+	t.keyMu.LockKey(key)
+	defer func() {
+		err = errors.Join(err, t.keyMu.UnlockKey(key))
+	}()
+	t.writePending(key)
+	t.memory.Delete(key)
+	return t.disk.SoftPurge(key)
+}
+
+// SoftPurgeByTag marks the entries with the tag as stale like SoftPurge and returns the number of them.
+func (t *TieredCache) SoftPurgeByTag(tag string) int {
+	t.flush()
+	return t.purge(t.disk.keysByTag(tag), true)
+}
+
+// SoftPurgeByHost marks the entries whose requests are for the host as stale like SoftPurge and returns the number of them.
+func (t *TieredCache) SoftPurgeByHost(host string) int {
+	t.flush()
+	return t.purge(t.disk.keysByPathPrefix(host, ""), true)
+}
+
+// SoftPurgeByPathPrefix marks the entries whose request paths start with prefix as stale like SoftPurge
+// and returns the number of them. If host is empty, the entries of all hosts are marked.
+func (t *TieredCache) SoftPurgeByPathPrefix(host, prefix string) int {
+	t.flush()
+	return t.purge(t.disk.keysByPathPrefix(host, prefix), true)
+}
+
+// purge deletes the entries of the keys from the memory tier, and deletes them from the disk tier
+// or marks them as stale if soft is true. It returns the number of the entries purged from the disk tier.
+func (t *TieredCache) purge(keys []string, soft bool) int {
+	n := 0
+	for _, key := range keys {
+		t.keyMu.LockKey(key)
+		// Deleted from the memory tier under the lock, so that it is not promoted again in between
+		t.memory.Delete(key)
+		if soft {
+			if err := t.disk.SoftPurge(key); err == nil {
+				n++
+			}
+		} else {
+			n += t.disk.purge([]string{key})
+		}
+		_ = t.keyMu.UnlockKey(key) //nostyle:handlerrors
+	}
+	return n
+}
+
+// Metrics returns the metrics of the cache as a whole. The bytes and keys are those of the disk tier.
+// Use TierMetrics for the metrics of each tier.
+func (t *TieredCache) Metrics() Metrics {
+	m := t.disk.Metrics()
+	m.Hits = atomic.LoadUint64(&t.memoryHits) + atomic.LoadUint64(&t.diskHits)
+	m.Misses = atomic.LoadUint64(&t.misses)
+	return m
+}
+
+// TierMetrics returns the metrics of each tier.
+func (t *TieredCache) TierMetrics() TierMetrics {
+	t.mu.Lock()
+	pending := len(t.pending)
+	t.mu.Unlock()
+	return TierMetrics{
+		Memory:        t.memory.Metrics(),
+		Disk:          t.disk.Metrics(),
+		MemoryHits:    atomic.LoadUint64(&t.memoryHits),
+		DiskHits:      atomic.LoadUint64(&t.diskHits),
+		Misses:        atomic.LoadUint64(&t.misses),
+		Promotions:    atomic.LoadUint64(&t.promotions),
+		PendingWrites: uint64(pending),
+	}
+}
+
+// Close writes the entries waiting for write-back to the disk tier, stops write-back and closes both tiers.
+// The entries stored after Close are written through.
+func (t *TieredCache) Close() error {
+	t.mu.Lock()
+	if !t.closed && t.queue != nil {
+		close(t.queue)
+	}
+	t.closed = true
+	t.mu.Unlock()
+	<-t.done
+	return errors.Join(t.memory.Close(), t.disk.Close())
+}
@@ -0,0 +1,201 @@
+package rcutil
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2manymws/rc"
+	"github.com/google/go-cmp/cmp"
+)
+
+func newTieredCache(t *testing.T, memoryBytes uint64, opts ...TieredCacheOption) (*TieredCache, *MemoryCache, *DiskCache) {
+	t.Helper()
+	dc, err := NewDiskCache(t.TempDir(), 1*time.Hour, DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc := NewMemoryCache(memoryBytes, 1*time.Hour)
+	tc, err := NewTieredCache(mc, dc, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = tc.Close()
+	})
+	return tc, mc, dc
+}
+
+type tieredStorer interface {
+	Store(key string, req *http.Request, res *http.Response) error
+}
+
+func storeTiered(t *testing.T, c tieredStorer, key, body string) {
+	t.Helper()
+	req := &http.Request{Method: http.MethodGet, Header: http.Header{"Authorization": {"secret"}}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+	res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"X-Test": {"test"}}, Body: newBody([]byte(body)), ContentLength: -1}
+	if err := c.Store(key, req, res); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTieredCache(t *testing.T) {
+	tc, mc, dc := newTieredCache(t, 1000)
+	load := func(key, want string) {
+		t.Helper()
+		req, res, err := tc.Load(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Header.Get("Authorization"); got != "" {
+			t.Errorf("the credential is stored: %q", got)
+		}
+		if got := readBody(res.Body); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	// Written through to both tiers
+	storeTiered(t, tc, "a", "hello")
+	if _, _, err := dc.Load("a"); err != nil {
+		t.Errorf("disk tier: %v", err)
+	}
+	load("a", "hello")
+
+	// Promoted from the disk tier
+	storeTiered(t, dc, "b", "world")
+	load("b", "world")
+	load("b", "world")
+
+	// Too large for the memory tier
+	large := strings.Repeat("a", 1001)
+	storeTiered(t, tc, "c", large)
+	if _, _, err := mc.Load("c"); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+	load("c", large)
+
+	if _, _, err := tc.Load("d"); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+
+	got := tc.TierMetrics()
+	want := TierMetrics{MemoryHits: 2, DiskHits: 2, Misses: 1, Promotions: 1}
+	got.Memory, got.Disk = Metrics{}, Metrics{}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+	if m := tc.Metrics(); m.Hits != 4 || m.Misses != 1 {
+		t.Errorf("got %d hits and %d misses, want 4 and 1", m.Hits, m.Misses)
+	}
+
+	// Deleted from both tiers
+	tc.Delete("a")
+	for _, c := range []interface {
+		Load(string) (*http.Request, *http.Response, error)
+	}{tc, mc, dc} {
+		if _, _, err := c.Load("a"); !errors.Is(err, rc.ErrCacheNotFound) {
+			t.Errorf("%T: got %v, want %v", c, err, rc.ErrCacheNotFound)
+		}
+	}
+}
+
+func TestTieredCacheWriteBack(t *testing.T) {
+	tc, mc, dc := newTieredCache(t, 1000, EnableWriteBack(10))
+	for _, key := range []string{"a", "b"} {
+		storeTiered(t, tc, key, key)
+	}
+	// Served from the memory tier or the queue until it is written back
+	mc.Delete("a")
+	_, res, err := tc.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readBody(res.Body); got != "a" {
+		t.Errorf("got %q, want %q", got, "a")
+	}
+
+	// The entry deleted before it is written back is not written
+	tc.Delete("b")
+	if err := tc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := tc.TierMetrics().PendingWrites; got != 0 {
+		t.Errorf("got %d, want %d", got, 0)
+	}
+	if dc.autoCleanupRunning {
+		t.Error("the disk tier is not closed")
+	}
+	if _, _, err := dc.Load("a"); err != nil {
+		t.Errorf("not written back: %v", err)
+	}
+	if _, _, err := dc.Load("b"); !errors.Is(err, rc.ErrCacheNotFound) {
+		t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+	}
+
+	// Written through after Close
+	storeTiered(t, tc, "c", "c")
+	if _, _, err := dc.Load("c"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := NewTieredCache(mc, dc, EnableWriteBack(0)); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestTieredCachePurge(t *testing.T) {
+	for _, opts := range [][]TieredCacheOption{nil, {EnableWriteBack(10)}} {
+		tc, mc, dc := newTieredCache(t, NoLimitTotalBytes, opts...)
+		for _, key := range []string{"a", "b", "c", "d"} {
+			req := &http.Request{Method: http.MethodGet, Host: "example.com", Header: http.Header{}, URL: &url.URL{Path: "/" + key}, Body: newBody(nil)}
+			res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: newBody([]byte(key)), ContentLength: -1}
+			if key != "d" {
+				res.Header.Set("Surrogate-Key", "tag-"+key)
+			}
+			if err := tc.Store(key, req, res); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if got := tc.PurgeByTag("tag-a"); got != 1 {
+			t.Errorf("got %d, want %d", got, 1)
+		}
+		if got := tc.PurgeByPathPrefix("example.com", "/b"); got != 1 {
+			t.Errorf("got %d, want %d", got, 1)
+		}
+		if err := tc.SoftPurge("c"); err != nil {
+			t.Fatal(err)
+		}
+		// Purged from both tiers
+		for _, key := range []string{"a", "b", "c"} {
+			if _, _, err := mc.Load(key); !errors.Is(err, rc.ErrCacheNotFound) {
+				t.Errorf("%s: got %v, want %v", key, err, rc.ErrCacheNotFound)
+			}
+			if _, _, err := tc.Load(key); err == nil {
+				t.Errorf("%s: want error", key)
+			}
+		}
+		if _, _, err := dc.Load("a"); !errors.Is(err, rc.ErrCacheNotFound) {
+			t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+		}
+		_, res, err := tc.Load("d")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readBody(res.Body); got != "d" {
+			t.Errorf("got %q, want %q", got, "d")
+		}
+
+		tc.PurgeByHost("example.com")
+		if _, _, err := mc.Load("d"); !errors.Is(err, rc.ErrCacheNotFound) {
+			t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+		}
+		if _, _, err := tc.Load("d"); !errors.Is(err, rc.ErrCacheNotFound) {
+			t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package rcutil
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/2manymws/rc"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+const variantKeySep = "\x00"
+
+// VarySpec returns the request header names listed in the Vary header of the response.
+// The names are canonicalized, deduplicated and sorted.
+// If the response has Vary: *, it returns ErrUncacheableVary.
+func VarySpec(res *http.Response) ([]string, error) {
+	var spec []string
+	for _, v := range res.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name == "*" {
+				return nil, ErrUncacheableVary
+			}
+			spec = append(spec, http.CanonicalHeaderKey(name))
+		}
+	}
+	sort.Strings(spec)
+	return slices.Compact(spec), nil
+}
+
+// VarySeed returns the secondary seed computed from the request header values named in the vary spec.
+// Header values are normalized so that equivalent requests get the same seed.
+func VarySeed(req *http.Request, spec []string) string {
+	const sep = "|"
+	var seed strings.Builder
+	for i, name := range spec {
+		if i > 0 {
+			seed.WriteString(sep)
+		}
+		seed.WriteString(strings.ToLower(name))
+		seed.WriteString(":")
+		seed.WriteString(normalizeVaryValue(name, req.Header.Values(name)))
+	}
+	return seed.String()
+}
+
+// normalizeVaryValue joins the header values into a single comma-separated list without redundant whitespace.
+// The tokens of Accept-Encoding are case-insensitive and unordered, so they are lowercased and sorted.
+func normalizeVaryValue(name string, values []string) string {
+	var elems []string
+	for _, v := range values {
+		for _, e := range strings.Split(v, ",") {
+			e = strings.Join(strings.Fields(e), " ")
+			e = strings.ReplaceAll(e, " ;", ";")
+			e = strings.ReplaceAll(e, "; ", ";")
+			if e == "" {
+				continue
+			}
+			elems = append(elems, e)
+		}
+	}
+	if http.CanonicalHeaderKey(name) == "Accept-Encoding" {
+		for i := range elems {
+			elems[i] = strings.ToLower(elems[i])
+		}
+		sort.Strings(elems)
+	}
+	return strings.Join(elems, ",")
+}
+
+func variantKey(primary, seed string) string {
+	return primary + variantKeySep + seed
+}
+
+// StoreVary stores the response as a variant of the primary key with the default TTL.
+func (c *DiskCache) StoreVary(primary string, req *http.Request, res *http.Response) error {
+	return c.StoreVaryWithTTL(primary, req, res, ttlcache.DefaultTTL)
+}
+
+// StoreVaryWithTTL stores the response as a variant of the primary key with the specified TTL.
+// The variant is selected by the request header values named in the Vary header of the response,
+// so multiple variants of one primary key (e.g. URL) coexist in the cache.
+// If the Vary header of the response differs from the one of the stored variants, the stored variants are deleted.
+// If the response has Vary: *, it returns ErrUncacheableVary.
+func (c *DiskCache) StoreVaryWithTTL(primary string, req *http.Request, res *http.Response, ttl time.Duration) error {
+	spec, err := VarySpec(res)
+	if err != nil {
+		return err
+	}
+	key := variantKey(primary, VarySeed(req, spec))
+	return c.store(context.Background(), key, req, res, ttl, &entryMeta{Primary: primary, Vary: spec})
+}
+
+// LoadVary loads the variant of the primary key that matches the request.
+func (c *DiskCache) LoadVary(primary string, req *http.Request) (*http.Request, *http.Response, error) {
+	return c.LoadVaryContext(context.Background(), primary, req)
+}
+
+// LoadVaryContext loads the variant of the primary key that matches the request like LoadVary.
+// ctx applies as in LoadContext.
+func (c *DiskCache) LoadVaryContext(ctx context.Context, primary string, req *http.Request) (*http.Request, *http.Response, error) {
+	spec, ok := c.varies.spec(primary)
+	if !ok {
+		return nil, nil, rc.ErrCacheNotFound
+	}
+	return c.LoadContext(ctx, variantKey(primary, VarySeed(req, spec)))
+}
+
+// DeleteVary deletes all variants of the primary key.
+func (c *DiskCache) DeleteVary(primary string) {
+	for _, key := range c.varies.variants(primary) {
+		c.Delete(key)
+	}
+}
+
+// varyIndex holds the vary spec of each primary key and the keys of its variants.
+type varyIndex struct {
+	mu sync.Mutex
+	m  map[string]*varyEntry
+}
+
+type varyEntry struct {
+	spec     []string
+	variants map[string]struct{}
+}
+
+func newVaryIndex() *varyIndex {
+	return &varyIndex{
+		m: make(map[string]*varyEntry),
+	}
+}
+
+// add adds the variant key to the primary key.
+// If the spec differs from the current one, it replaces the spec and returns the keys of the variants stored with the old one.
+func (vi *varyIndex) add(primary string, spec []string, key string) []string {
+	vi.mu.Lock()
+	defer vi.mu.Unlock()
+	e, ok := vi.m[primary]
+	if !ok {
+		e = &varyEntry{spec: spec, variants: make(map[string]struct{})}
+		vi.m[primary] = e
+	}
+	var stale []string
+	if !slices.Equal(e.spec, spec) {
+		for k := range e.variants {
+			if k != key {
+				stale = append(stale, k)
+			}
+		}
+		e.spec = spec
+		e.variants = make(map[string]struct{})
+	}
+	e.variants[key] = struct{}{}
+	return stale
+}
+
+func (vi *varyIndex) remove(primary, key string) {
+	vi.mu.Lock()
+	defer vi.mu.Unlock()
+	e, ok := vi.m[primary]
+	if !ok {
+		return
+	}
+	delete(e.variants, key)
+	if len(e.variants) == 0 {
+		delete(vi.m, primary)
+	}
+}
+
+func (vi *varyIndex) spec(primary string) ([]string, bool) {
+	vi.mu.Lock()
+	defer vi.mu.Unlock()
+	e, ok := vi.m[primary]
+	if !ok {
+		return nil, false
+	}
+	return e.spec, true
+}
+
+func (vi *varyIndex) variants(primary string) []string {
+	vi.mu.Lock()
+	defer vi.mu.Unlock()
+	e, ok := vi.m[primary]
+	if !ok {
+		return nil
+	}
+	keys := make([]string, 0, len(e.variants))
+	for k := range e.variants {
+		keys = append(keys, k)
+	}
+	return keys
+}
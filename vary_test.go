@@ -0,0 +1,170 @@
+package rcutil
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/2manymws/rc"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestVarySpec(t *testing.T) {
+	tests := []struct {
+		vary    []string
+		want    []string
+		wantErr error
+	}{
+		{nil, nil, nil},
+		{[]string{"Accept-Encoding"}, []string{"Accept-Encoding"}, nil},
+		{[]string{"accept-language, Accept-Encoding"}, []string{"Accept-Encoding", "Accept-Language"}, nil},
+		{[]string{"Accept-Encoding", "accept-encoding,  User-Agent ,"}, []string{"Accept-Encoding", "User-Agent"}, nil},
+		{[]string{"Accept-Encoding, *"}, nil, ErrUncacheableVary},
+	}
+	for _, tt := range tests {
+		res := &http.Response{Header: http.Header{"Vary": tt.vary}}
+		got, err := VarySpec(res)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("got %v, want %v", err, tt.wantErr)
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Error(diff)
+		}
+	}
+}
+
+func TestVarySeed(t *testing.T) {
+	spec := []string{"Accept-Encoding", "Accept-Language"}
+	tests := []struct {
+		name   string
+		header http.Header
+		want   string
+	}{
+		{"no headers", http.Header{}, "accept-encoding:|accept-language:"},
+		{
+			"Accept-Encoding tokens are sorted",
+			http.Header{"Accept-Encoding": {"gzip, BR,deflate"}},
+			"accept-encoding:br,deflate,gzip|accept-language:",
+		},
+		{
+			"Accept-Encoding over multiple fields",
+			http.Header{"Accept-Encoding": {"deflate", "gzip ;q=0.5"}},
+			"accept-encoding:deflate,gzip;q=0.5|accept-language:",
+		},
+		{
+			"Accept-Language keeps order",
+			http.Header{"Accept-Language": {"ja,  en-US;q=0.7"}},
+			"accept-encoding:|accept-language:ja,en-US;q=0.7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{Header: tt.header}
+			got := VarySeed(req, spec)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestDiskCacheVary(t *testing.T) {
+	newReq := func(ae string) *http.Request {
+		return &http.Request{Method: http.MethodGet, Header: http.Header{"Accept-Encoding": {ae}}, URL: &url.URL{Path: "/foo"}, Body: newBody(nil)}
+	}
+	newRes := func(vary, body string) *http.Response {
+		return &http.Response{
+			Status:     http.StatusText(http.StatusOK),
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Vary": {vary}},
+			Body:       newBody([]byte(body)),
+		}
+	}
+	root := t.TempDir()
+	dc, err := NewDiskCache(root, 24*time.Hour, DisableWarmUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := "get|example.com|/foo|"
+	if err := dc.StoreVary(primary, newReq("gzip, br"), newRes("Accept-Encoding", "gzip")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.StoreVary(primary, newReq("identity"), newRes("Accept-Encoding", "identity")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.StoreVary(primary, newReq("gzip"), newRes("*", "uncacheable")); !errors.Is(err, ErrUncacheableVary) {
+		t.Errorf("got %v, want %v", err, ErrUncacheableVary)
+	}
+
+	t.Run("Variants coexist", func(t *testing.T) {
+		for _, tt := range []struct {
+			ae   string
+			want string
+		}{
+			{"br,gzip", "gzip"},
+			{"identity", "identity"},
+		} {
+			_, res, err := dc.LoadVary(primary, newReq(tt.ae))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readBody(res.Body); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		}
+		if _, _, err := dc.LoadVary(primary, newReq("deflate")); !errors.Is(err, rc.ErrCacheNotFound) {
+			t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+		}
+	})
+
+	t.Run("Variants are restored on warm up", func(t *testing.T) {
+		dc2, err := NewDiskCache(root, 24*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-dc2.warmUpDone
+		_, res, err := dc2.LoadVary(primary, newReq("gzip,br"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readBody(res.Body); got != "gzip" {
+			t.Errorf("got %q, want %q", got, "gzip")
+		}
+	})
+
+	t.Run("Variants are deleted when Vary changes", func(t *testing.T) {
+		req := newReq("gzip")
+		req.Header.Set("Accept-Language", "ja")
+		if err := dc.StoreVary(primary, req, newRes("Accept-Encoding, Accept-Language", "gzip ja")); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(dc.varies.variants(primary)); got != 1 {
+			t.Errorf("got %d variants, want 1", got)
+		}
+		_, res, err := dc.LoadVary(primary, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readBody(res.Body); got != "gzip ja" {
+			t.Errorf("got %q, want %q", got, "gzip ja")
+		}
+		if _, _, err := dc.LoadVary(primary, newReq("identity")); !errors.Is(err, rc.ErrCacheNotFound) {
+			t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+		}
+	})
+
+	t.Run("Variants are deleted together", func(t *testing.T) {
+		if err := dc.StoreVary(primary, newReq("br"), newRes("Accept-Encoding, Accept-Language", "br")); err != nil {
+			t.Fatal(err)
+		}
+		dc.DeleteVary(primary)
+		if _, _, err := dc.LoadVary(primary, newReq("br")); !errors.Is(err, rc.ErrCacheNotFound) {
+			t.Errorf("got %v, want %v", err, rc.ErrCacheNotFound)
+		}
+		if got := dc.Metrics().KeyCount; got != 0 {
+			t.Errorf("got %d keys, want 0", got)
+		}
+	})
+}